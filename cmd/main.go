@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"strings"
+	"time"
+	// The image is built from scratch without /usr/share/zoneinfo. Embedding the tz database lets
+	// time.LoadLocation resolve the timezones of schedules.
+	_ "time/tzdata"
 
 	"github.com/galleybytes/infrakube-stella/pkg/api"
 	"github.com/galleybytes/infrakube-stella/pkg/common/db"
+	"github.com/galleybytes/infrakube-stella/pkg/common/logstore"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"gorm.io/gorm"
@@ -30,6 +36,39 @@ var (
 	serviceName     string
 	dashboard       string
 	fswatchImage    string
+
+	retentionKeepGenerations int
+	retentionMaxAge          time.Duration
+	retentionInterval        time.Duration
+	retentionDryRun          bool
+	redactionConfig          string
+
+	logStore                  string
+	logStoreThreshold         int
+	logStoreDir               string
+	logStoreS3Endpoint        string
+	logStoreS3Bucket          string
+	logStoreS3Region          string
+	logStoreS3Prefix          string
+	logStoreS3AccessKeyID     string
+	logStoreS3SecretAccessKey string
+	artifactMaxSize           int64
+	userRoles                 string
+	stateQueryTimeout         time.Duration
+	driftDetectionInterval    time.Duration
+	scheduleInterval          time.Duration
+	rollbackCallbackURL       string
+	rollbackCallbackSecret    string
+	approvalTTL               time.Duration
+	approvalExpiryInterval    time.Duration
+	approvalExpiryRerun       bool
+	approvalLinkBaseURL       string
+	webhookDeliveryInterval   time.Duration
+	smtpAddr                  string
+	smtpFrom                  string
+	smtpUsername              string
+	smtpPassword              string
+	notifyDomains             []string
 )
 
 func main() {
@@ -63,6 +102,68 @@ func main() {
 	viper.BindPFlag("dashboard", pflag.Lookup("dashboard"))
 	pflag.StringVar(&fswatchImage, "fswatch-image", "ghcr.io/galleybytes/fswatch:1.0.0-dev.1", "Docker image for fswatch (log-service)")
 	viper.BindPFlag("fswatch-image", pflag.Lookup("fswatch-image"))
+	pflag.IntVar(&retentionKeepGenerations, "retention-keep-generations", 0, "Number of newest generations to keep per resource (0 keeps all)")
+	viper.BindPFlag("retention-keep-generations", pflag.Lookup("retention-keep-generations"))
+	pflag.DurationVar(&retentionMaxAge, "retention-max-age", 0, "Drop task logs and soft-deleted resources older than the duration (0 keeps all)")
+	viper.BindPFlag("retention-max-age", pflag.Lookup("retention-max-age"))
+	pflag.DurationVar(&retentionInterval, "retention-interval", time.Hour, "How often the retention job runs")
+	viper.BindPFlag("retention-interval", pflag.Lookup("retention-interval"))
+	pflag.BoolVar(&retentionDryRun, "retention-dry-run", false, "Only record what the retention job would prune")
+	viper.BindPFlag("retention-dry-run", pflag.Lookup("retention-dry-run"))
+	pflag.StringVar(&redactionConfig, "redaction-config", "", "YAML file with keywords and regex rules used to mask secrets before logs and specs are saved")
+	viper.BindPFlag("redaction-config", pflag.Lookup("redaction-config"))
+	pflag.StringVar(&logStore, "log-store", "postgres", "Where task logs over the threshold are offloaded to: 'postgres', 'filesystem' or 's3'")
+	viper.BindPFlag("log-store", pflag.Lookup("log-store"))
+	pflag.IntVar(&logStoreThreshold, "log-store-threshold", 512*1024, "Size in bytes after which a task log is offloaded to the log store (0 keeps logs in infra3_task_logs)")
+	viper.BindPFlag("log-store-threshold", pflag.Lookup("log-store-threshold"))
+	pflag.StringVar(&logStoreDir, "log-store-dir", "", "Directory of the filesystem log store")
+	viper.BindPFlag("log-store-dir", pflag.Lookup("log-store-dir"))
+	pflag.StringVar(&logStoreS3Endpoint, "log-store-s3-endpoint", "", "Endpoint of the s3 log store (Example: 'http://minio:9000')")
+	viper.BindPFlag("log-store-s3-endpoint", pflag.Lookup("log-store-s3-endpoint"))
+	pflag.StringVar(&logStoreS3Bucket, "log-store-s3-bucket", "", "Bucket of the s3 log store")
+	viper.BindPFlag("log-store-s3-bucket", pflag.Lookup("log-store-s3-bucket"))
+	pflag.StringVar(&logStoreS3Region, "log-store-s3-region", "us-east-1", "Region of the s3 log store")
+	viper.BindPFlag("log-store-s3-region", pflag.Lookup("log-store-s3-region"))
+	pflag.StringVar(&logStoreS3Prefix, "log-store-s3-prefix", "", "Key prefix of logs in the s3 log store")
+	viper.BindPFlag("log-store-s3-prefix", pflag.Lookup("log-store-s3-prefix"))
+	pflag.StringVar(&logStoreS3AccessKeyID, "log-store-s3-access-key-id", "", "Access key id of the s3 log store")
+	viper.BindPFlag("log-store-s3-access-key-id", pflag.Lookup("log-store-s3-access-key-id"))
+	pflag.StringVar(&logStoreS3SecretAccessKey, "log-store-s3-secret-access-key", "", "Secret access key of the s3 log store")
+	viper.BindPFlag("log-store-s3-secret-access-key", pflag.Lookup("log-store-s3-secret-access-key"))
+	pflag.Int64Var(&artifactMaxSize, "artifact-max-size", api.DefaultArtifactMaxSize, "Largest artifact in bytes a task can upload")
+	viper.BindPFlag("artifact-max-size", pflag.Lookup("artifact-max-size"))
+	pflag.StringVar(&userRoles, "user-roles", "", "Roles granted to users in the form 'user=role,user=role' (Example: 'alice=privileged')")
+	viper.BindPFlag("user-roles", pflag.Lookup("user-roles"))
+	pflag.DurationVar(&stateQueryTimeout, "state-query-timeout", api.DefaultStateQueryTimeout, "How long a state inspection pod may run before it is deleted")
+	viper.BindPFlag("state-query-timeout", pflag.Lookup("state-query-timeout"))
+	pflag.DurationVar(&driftDetectionInterval, "drift-detection-interval", api.DefaultDriftDetectionInterval, "How often pending drift checks are evaluated (0 disables drift detection)")
+	viper.BindPFlag("drift-detection-interval", pflag.Lookup("drift-detection-interval"))
+	pflag.DurationVar(&scheduleInterval, "schedule-interval", api.DefaultScheduleInterval, "How often the scheduler looks for due schedules (0 disables scheduled reruns)")
+	viper.BindPFlag("schedule-interval", pflag.Lookup("schedule-interval"))
+	pflag.StringVar(&rollbackCallbackURL, "rollback-callback-url", "", "URL that receives the reverted spec after a rollback so it can be written back to the origin cluster")
+	viper.BindPFlag("rollback-callback-url", pflag.Lookup("rollback-callback-url"))
+	pflag.StringVar(&rollbackCallbackSecret, "rollback-callback-secret", "", "Secret used to sign the rollback callback in the X-Infra3-Signature-256 header")
+	viper.BindPFlag("rollback-callback-secret", pflag.Lookup("rollback-callback-secret"))
+	pflag.DurationVar(&approvalTTL, "approval-ttl", 0, "How long after a plan was created it can be approved and applied when the approval policy sets no ttl (0 never expires approvals)")
+	viper.BindPFlag("approval-ttl", pflag.Lookup("approval-ttl"))
+	pflag.DurationVar(&approvalExpiryInterval, "approval-expiry-interval", api.DefaultApprovalExpiryInterval, "How often approvals are checked for expiry and newer plans (0 disables invalidating approvals)")
+	viper.BindPFlag("approval-expiry-interval", pflag.Lookup("approval-expiry-interval"))
+	pflag.BoolVar(&approvalExpiryRerun, "approval-expiry-rerun", false, "Rerun the workflow when the approval of its plan expires")
+	viper.BindPFlag("approval-expiry-rerun", pflag.Lookup("approval-expiry-rerun"))
+	pflag.StringVar(&approvalLinkBaseURL, "approval-link-base-url", "", "Public url of the API used in approve and deny links (Example: 'https://infra3.example.com')")
+	viper.BindPFlag("approval-link-base-url", pflag.Lookup("approval-link-base-url"))
+	pflag.DurationVar(&webhookDeliveryInterval, "webhook-delivery-interval", api.DefaultWebhookDeliveryInterval, "How often failed webhook deliveries and notifications are retried and notifications held back by quiet hours are sent (0 disables retries)")
+	viper.BindPFlag("webhook-delivery-interval", pflag.Lookup("webhook-delivery-interval"))
+	pflag.StringVar(&smtpAddr, "smtp-addr", "", "host:port of the SMTP server that sends email notifications (Example: 'smtp.example.com:587')")
+	viper.BindPFlag("smtp-addr", pflag.Lookup("smtp-addr"))
+	pflag.StringVar(&smtpFrom, "smtp-from", "", "Sender of email notifications (Example: 'Infra3 <infra3@example.com>')")
+	viper.BindPFlag("smtp-from", pflag.Lookup("smtp-from"))
+	pflag.StringVar(&smtpUsername, "smtp-username", "", "Username to authenticate to the SMTP server")
+	viper.BindPFlag("smtp-username", pflag.Lookup("smtp-username"))
+	pflag.StringVar(&smtpPassword, "smtp-password", "", "Password to authenticate to the SMTP server")
+	viper.BindPFlag("smtp-password", pflag.Lookup("smtp-password"))
+	pflag.StringSliceVar(&notifyDomains, "notify-domains", nil, "Email domains the notify annotation of resources may send to, all domains when empty (Example: 'example.com,example.org')")
+	viper.BindPFlag("notify-domains", pflag.Lookup("notify-domains"))
 	pflag.Parse()
 
 	pflag.Set("alsologtostderr", "false")
@@ -84,6 +185,37 @@ func main() {
 	serviceName = viper.GetString("service-name")
 	dashboard = viper.GetString("dashboard")
 	fswatchImage = viper.GetString("fswatch-image")
+	retentionKeepGenerations = viper.GetInt("retention-keep-generations")
+	retentionMaxAge = viper.GetDuration("retention-max-age")
+	retentionInterval = viper.GetDuration("retention-interval")
+	retentionDryRun = viper.GetBool("retention-dry-run")
+	redactionConfig = viper.GetString("redaction-config")
+	logStore = viper.GetString("log-store")
+	logStoreThreshold = viper.GetInt("log-store-threshold")
+	logStoreDir = viper.GetString("log-store-dir")
+	logStoreS3Endpoint = viper.GetString("log-store-s3-endpoint")
+	logStoreS3Bucket = viper.GetString("log-store-s3-bucket")
+	logStoreS3Region = viper.GetString("log-store-s3-region")
+	logStoreS3Prefix = viper.GetString("log-store-s3-prefix")
+	logStoreS3AccessKeyID = viper.GetString("log-store-s3-access-key-id")
+	logStoreS3SecretAccessKey = viper.GetString("log-store-s3-secret-access-key")
+	artifactMaxSize = viper.GetInt64("artifact-max-size")
+	userRoles = viper.GetString("user-roles")
+	stateQueryTimeout = viper.GetDuration("state-query-timeout")
+	driftDetectionInterval = viper.GetDuration("drift-detection-interval")
+	scheduleInterval = viper.GetDuration("schedule-interval")
+	rollbackCallbackURL = viper.GetString("rollback-callback-url")
+	rollbackCallbackSecret = viper.GetString("rollback-callback-secret")
+	approvalTTL = viper.GetDuration("approval-ttl")
+	approvalExpiryInterval = viper.GetDuration("approval-expiry-interval")
+	approvalExpiryRerun = viper.GetBool("approval-expiry-rerun")
+	approvalLinkBaseURL = viper.GetString("approval-link-base-url")
+	webhookDeliveryInterval = viper.GetDuration("webhook-delivery-interval")
+	smtpAddr = viper.GetString("smtp-addr")
+	smtpFrom = viper.GetString("smtp-from")
+	smtpUsername = viper.GetString("smtp-username")
+	smtpPassword = viper.GetString("smtp-password")
+	notifyDomains = viper.GetStringSlice("notify-domains")
 
 	clientset := kubernetes.NewForConfigOrDie(NewConfigOrDie(os.Getenv("KUBECONFIG")))
 	var database *gorm.DB
@@ -103,6 +235,35 @@ func main() {
 		ssoConfig.URL = ssoLoginURL
 	}
 
+	redactor, err := api.NewRedactor(redactionConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	roles, err := api.ParseUserRoles(userRoles)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var store logstore.LogStore
+	if database != nil && logStoreThreshold > 0 {
+		store, err = logstore.New(database, logstore.Config{
+			Kind: logStore,
+			Dir:  logStoreDir,
+			S3: logstore.S3{
+				Endpoint:        logStoreS3Endpoint,
+				Bucket:          logStoreS3Bucket,
+				Region:          logStoreS3Region,
+				Prefix:          logStoreS3Prefix,
+				AccessKeyID:     logStoreS3AccessKeyID,
+				SecretAccessKey: logStoreS3SecretAccessKey,
+			},
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	var serviceIP string
 	if useServiceHost {
 		s := strings.ReplaceAll(strings.ToUpper(serviceName), "-", "_")
@@ -114,7 +275,41 @@ func main() {
 	}
 
 	apiHandler := api.NewAPIHandler(database, clientset, ssoConfig, &serviceIP, &dashboard, fswatchImage)
+	apiHandler.Retention = api.RetentionPolicy{
+		KeepGenerations: retentionKeepGenerations,
+		MaxAge:          retentionMaxAge,
+		Interval:        retentionInterval,
+		DryRun:          retentionDryRun,
+	}
+	apiHandler.Redactor = redactor
+	apiHandler.LogStore = store
+	apiHandler.LogStoreThreshold = logStoreThreshold
+	apiHandler.ArtifactMaxSize = artifactMaxSize
+	apiHandler.UserRoles = roles
+	apiHandler.StateQueryTimeout = stateQueryTimeout
+	apiHandler.DriftDetectionInterval = driftDetectionInterval
+	apiHandler.ScheduleInterval = scheduleInterval
+	apiHandler.RollbackCallbackURL = rollbackCallbackURL
+	apiHandler.RollbackCallbackSecret = rollbackCallbackSecret
+	apiHandler.ApprovalTTL = approvalTTL
+	apiHandler.ApprovalExpiryInterval = approvalExpiryInterval
+	apiHandler.ApprovalExpiryRerun = approvalExpiryRerun
+	apiHandler.ApprovalLinkBaseURL = approvalLinkBaseURL
+	apiHandler.WebhookDeliveryInterval = webhookDeliveryInterval
+	apiHandler.SMTP = api.SMTPConfig{
+		Addr:          smtpAddr,
+		From:          smtpFrom,
+		Username:      smtpUsername,
+		Password:      smtpPassword,
+		NotifyDomains: notifyDomains,
+	}
 	apiHandler.RegisterRoutes()
+	go apiHandler.RunRetention(context.Background())
+	go apiHandler.RunDriftDetection(context.Background())
+	go apiHandler.RunSchedules(context.Background())
+	go apiHandler.RunApprovalExpiry(context.Background())
+	go apiHandler.RunWebhookDeliveries(context.Background())
+	go apiHandler.RunBulkJobs(context.Background())
 	fmt.Printf("Starting server on %s\n", addr)
 	apiHandler.Server.Run(addr)
 }
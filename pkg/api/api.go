@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/akyoto/cache"
+	"github.com/galleybytes/infrakube-stella/pkg/common/logstore"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 	"k8s.io/client-go/kubernetes"
@@ -22,6 +23,56 @@ type APIHandler struct {
 	Cache        *cache.Cache
 	dashboard    *string
 	fswatchImage string
+
+	// Retention configures the background pruning of old logs and generations
+	Retention RetentionPolicy
+
+	// Redactor masks secrets in task logs and resource specs before they are saved
+	Redactor *Redactor
+
+	// LogStore receives the content of task logs larger than LogStoreThreshold bytes. Logs stay in the
+	// infra3_task_logs table when either is unset. Task artifacts are saved to the LogStore and can't be
+	// uploaded without one.
+	LogStore          logstore.LogStore
+	LogStoreThreshold int
+
+	// ArtifactMaxSize limits the size of artifacts uploaded by tasks
+	ArtifactMaxSize int64
+
+	// UserRoles grants roles to users, eg RolePrivileged to read sensitive outputs
+	UserRoles UserRoles
+
+	// StateQueryTimeout limits how long a state inspection pod may run
+	StateQueryTimeout time.Duration
+
+	// DriftDetectionInterval is how often pending drift checks are evaluated, zero disables drift detection
+	DriftDetectionInterval time.Duration
+
+	// ScheduleInterval is how often the scheduler looks for due schedules, zero disables the scheduler
+	ScheduleInterval time.Duration
+
+	// RollbackCallbackURL receives the reverted spec after a rollback so the origin cluster can write it
+	// back to its Tf. RollbackCallbackSecret signs the callback.
+	RollbackCallbackURL    string
+	RollbackCallbackSecret string
+
+	// ApprovalTTL is how long after a plan was created it can be approved and applied when the approval
+	// policy does not set a TTL, zero never expires approvals. Approvals are checked for expiry every
+	// ApprovalExpiryInterval and the plan is rerun when ApprovalExpiryRerun is set.
+	ApprovalTTL            time.Duration
+	ApprovalExpiryInterval time.Duration
+	ApprovalExpiryRerun    bool
+
+	// ApprovalLinkBaseURL is the public url of the API used in approval links. The url of the request that
+	// minted the link is used when it is empty.
+	ApprovalLinkBaseURL string
+
+	// WebhookDeliveryInterval is how often failed webhook deliveries and notifications are retried and
+	// notifications held back by quiet hours are sent, zero only makes the first attempt
+	WebhookDeliveryInterval time.Duration
+
+	// SMTP sends the emails of email notification channels
+	SMTP SMTPConfig
 }
 
 type SSOConfig struct {
@@ -91,6 +142,8 @@ func (h APIHandler) RegisterRoutes() {
 	preauth.GET("/connect", h.defaultConnectMethod) // Determine preferred auth method
 	preauth.GET("/sso", h.ssoRedirecter)
 	preauth.POST("/sso/saml", h.samlConnecter)
+	preauth.GET("/approval-link/:token", h.showApprovalLink)
+	preauth.POST("/approval-link/:token", h.useApprovalLink)
 
 	basic := h.Server.Group("/")
 	basic.Use(validateJwt)
@@ -100,6 +153,7 @@ func (h APIHandler) RegisterRoutes() {
 	authenticatedAPIV1.Use(validateJwt)
 	authenticatedAPIV1.GET("/", h.Index)
 	authenticatedAPIV1.GET("/workflows", h.workflows)
+	authenticatedAPIV1.GET("/drift", h.getDriftedResources)
 
 	cluster := authenticatedAPIV1.Group("/cluster")
 	cluster.POST("/", h.AddCluster) // Resource from Add/Update/Delete event
@@ -114,6 +168,10 @@ func (h APIHandler) RegisterRoutes() {
 	cluster.GET("/:cluster_name/resource/:namespace/:name/debug", h.Debugger)
 	cluster.GET("/:cluster_name/debug/:namespace/:name", h.Debugger) // Alias
 	cluster.GET("/:cluster_name/resource/:namespace/:name/unlock", h.UnlockTerraform)
+	cluster.POST("/:cluster_name/resource/:namespace/:name/cancel", h.cancelWorkflow)
+	cluster.GET("/:cluster_name/resource/:namespace/:name/state", h.getStateList)
+	cluster.GET("/:cluster_name/resource/:namespace/:name/state/show", h.getStateResource)
+	cluster.GET("/:cluster_name/resource/:namespace/:name/state/json", h.getStateJSON)
 	cluster.GET("/:cluster_name/resource/:namespace/:name/status", h.ResourceStatusCheck)
 	cluster.GET("/:cluster_name/status/:namespace/:name", h.ResourceStatusCheck) // Alias
 	cluster.GET("/:cluster_name/resource/:namespace/:name/last-task-log", h.LastTaskLog)
@@ -123,6 +181,16 @@ func (h APIHandler) RegisterRoutes() {
 	metrics := authenticatedAPIV1.Group("/metrics")
 	metrics.GET("/total/resources", h.TotalResources)
 	metrics.GET("/total/failed-resources", h.TotalFailedResources)
+	metrics.GET("/retention", h.RetentionMetrics)
+
+	retention := authenticatedAPIV1.Group("/retention")
+	retention.GET("/report", h.retentionDryRun)
+
+	bulk := authenticatedAPIV1.Group("/bulk")
+	bulk.POST("/preview", h.previewBulkJob)
+	bulk.POST("/jobs", h.addBulkJob)
+	bulk.GET("/jobs", h.getBulkJobs)
+	bulk.GET("/jobs/:job_id", h.getBulkJob)
 
 	// DEPRECATED usage of clusterid is being removed. todo ensure galleybytes projects aren't using this
 	clusterid := authenticatedAPIV1.Group("/cluster-id")
@@ -134,14 +202,38 @@ func (h APIHandler) RegisterRoutes() {
 	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid", h.GetResourceByUUID)
 	// List Generations
 	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/generations", h.GetDistinctGeneration)
+	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/diff", h.getGenerationDiff)
+	authenticatedAPIV1.POST("/resource/:infra3_resource_uuid/rollback", h.rollbackResource)
+	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/rollbacks", h.getRollbacks)
+	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/redactions", h.getRedactions)
+	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/cancellations", h.getCancellations)
+	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/drift-schedule", h.getDriftSchedule)
+	authenticatedAPIV1.PUT("/resource/:infra3_resource_uuid/drift-schedule", h.putDriftSchedule)
+	authenticatedAPIV1.DELETE("/resource/:infra3_resource_uuid/drift-schedule", h.deleteDriftSchedule)
+	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/drift", h.getDriftStatus)
+	authenticatedAPIV1.POST("/resource/:infra3_resource_uuid/drift/check", h.triggerDriftCheck)
+	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/schedules", h.getSchedules)
+	authenticatedAPIV1.POST("/resource/:infra3_resource_uuid/schedules", h.addSchedule)
+	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/schedules/:schedule_id", h.getSchedule)
+	authenticatedAPIV1.PUT("/resource/:infra3_resource_uuid/schedules/:schedule_id", h.updateSchedule)
+	authenticatedAPIV1.DELETE("/resource/:infra3_resource_uuid/schedules/:schedule_id", h.deleteSchedule)
 	// ReourceSpec
 	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/generation/:generation/resource-spec", h.getWorkflowResourceConfiguration)
 	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/generation/:generation/tasks", h.getAllTasksGeneratedForResource)
 	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/generation/:generation/latest-tasks", h.getHighestRerunOfTasksGeneratedForResource)
 	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/generation/:generation/approval-status", h.getApprovalStatusForResource)
 	authenticatedAPIV1.POST("/resource/:infra3_resource_uuid/generation/:generation/approval", h.setApprovalForResource)
+	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/generation/:generation/plan-summary", h.getPlanSummary)
 	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/generation/:generation/logs", h.preLogs)
+	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/generation/:generation/logs/download", h.downloadLogs)
 	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/generation/:generation/ws-logs", h.websocketLogs)
+	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/task/:task_pod_uuid/logs", h.getTaskLogLines)
+	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/task/:task_pod_uuid/logs/line/:line_no", h.getTaskLogLine)
+	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/generation/:generation/artifacts", h.getTaskArtifacts)
+	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/outputs", h.getResourceOutputs)
+	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/outputs/history", h.getResourceOutputsHistory)
+	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/generation/:generation/outputs", h.getResourceOutputs)
+	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/task/:task_pod_uuid/artifacts/:kind", h.downloadTaskArtifact)
 
 	// authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/logs", h.GetClustersResourcesLogs)
 	// authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/logs/generation/:generation", h.GetClustersResourcesLogs)
@@ -157,11 +249,47 @@ func (h APIHandler) RegisterRoutes() {
 	authenticatedTask.GET("/status", h.ResourceStatusCheckViaTask)
 	authenticatedTask.POST("/status", h.UpdateResourceStatusViaTask)
 	authenticatedTask.GET("/:task_pod_uuid/approval-status", h.GetApprovalStatusViaTaskPodUUID)
+	authenticatedTask.POST("/:task_pod_uuid/plan", h.AddPlanJSONViaTask)
+	authenticatedTask.PUT("/:task_pod_uuid/artifacts/:kind", h.AddTaskArtifactViaTask)
 
 	// Approval
 	authenticatedAPIV1.GET("/resource/:infra3_resource_uuid/approval-status", h.GetApprovalStatus)
 	authenticatedAPIV1.POST("/approval/:task_pod_uuid", h.UpdateApproval)
+	authenticatedAPIV1.DELETE("/approval/:task_pod_uuid", h.RevokeApproval)
+	authenticatedAPIV1.GET("/approval/:task_pod_uuid/links", h.getApprovalLinks)
+	authenticatedAPIV1.POST("/approval/:task_pod_uuid/links", h.addApprovalLinks)
 	authenticatedAPIV1.GET("/approvals", h.AllApprovals)
+	authenticatedAPIV1.GET("/approvals/pending", h.getPendingApprovals)
+	authenticatedAPIV1.GET("/approval-policies", h.getApprovalPolicies)
+	authenticatedAPIV1.POST("/approval-policies", h.addApprovalPolicy)
+	authenticatedAPIV1.PUT("/approval-policies/:policy_id", h.updateApprovalPolicy)
+	authenticatedAPIV1.DELETE("/approval-policies/:policy_id", h.deleteApprovalPolicy)
+	authenticatedAPIV1.GET("/auto-approval-rules", h.getAutoApprovalRules)
+	authenticatedAPIV1.POST("/auto-approval-rules", h.addAutoApprovalRule)
+	authenticatedAPIV1.PUT("/auto-approval-rules/:rule_id", h.updateAutoApprovalRule)
+	authenticatedAPIV1.DELETE("/auto-approval-rules/:rule_id", h.deleteAutoApprovalRule)
+
+	// Webhooks
+	authenticatedAPIV1.GET("/webhooks", h.getWebhooks)
+	authenticatedAPIV1.POST("/webhooks", h.addWebhook)
+	authenticatedAPIV1.PUT("/webhooks/:webhook_id", h.updateWebhook)
+	authenticatedAPIV1.DELETE("/webhooks/:webhook_id", h.deleteWebhook)
+	authenticatedAPIV1.POST("/webhooks/:webhook_id/test", h.testWebhook)
+	authenticatedAPIV1.GET("/webhooks/:webhook_id/deliveries", h.getWebhookDeliveries)
+	authenticatedAPIV1.POST("/webhooks/:webhook_id/deliveries/:delivery_id/redeliver", h.redeliverWebhookDelivery)
+
+	// Notifications
+	authenticatedAPIV1.GET("/notification-channels", h.getNotificationChannels)
+	authenticatedAPIV1.POST("/notification-channels", h.addNotificationChannel)
+	authenticatedAPIV1.PUT("/notification-channels/:channel_id", h.updateNotificationChannel)
+	authenticatedAPIV1.DELETE("/notification-channels/:channel_id", h.deleteNotificationChannel)
+	authenticatedAPIV1.POST("/notification-channels/:channel_id/test", h.testNotificationChannel)
+	authenticatedAPIV1.GET("/notification-channels/:channel_id/notifications", h.getNotifications)
+	authenticatedAPIV1.GET("/me/subscriptions", h.getSubscriptions)
+	authenticatedAPIV1.POST("/me/subscriptions", h.addSubscription)
+	authenticatedAPIV1.DELETE("/me/subscriptions/:subscription_id", h.deleteSubscription)
+	authenticatedAPIV1.GET("/me/feed", h.getFeed)
+	authenticatedAPIV1.POST("/me/feed/read", h.markFeedRead)
 
 	// Websockets will be prefixed with /ws
 	sockets := h.Server.Group("/ws/")
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+	"gorm.io/gorm"
+)
+
+const (
+	// DefaultApprovalExpiryInterval is how often approvals are checked for expiry and newer plans
+	DefaultApprovalExpiryInterval = time.Minute
+
+	// approvalExpiredChangeCause is the change-cause of reruns of plans whose approval expired
+	approvalExpiredChangeCause = "approval-expired"
+
+	approvalExpired    = "expired"
+	approvalSuperseded = "superseded"
+)
+
+// approvalTTL is the TTL of the policy, or the global TTL when the policy does not set one
+func (h APIHandler) approvalTTL(policy models.ApprovalPolicy) time.Duration {
+	if policy.TTL == "" {
+		return h.ApprovalTTL
+	}
+	ttl, err := time.ParseDuration(policy.TTL)
+	if err != nil {
+		return h.ApprovalTTL
+	}
+	return ttl
+}
+
+// approvalExpiresAt returns when the plan becomes too old to be approved, nil when approvals don't
+// expire
+func (h APIHandler) approvalExpiresAt(policy models.ApprovalPolicy, taskPod models.TaskPod) *time.Time {
+	ttl := h.approvalTTL(policy)
+	if ttl <= 0 {
+		return nil
+	}
+	expiresAt := taskPod.CreatedAt.Add(ttl)
+	return &expiresAt
+}
+
+// planSuperseded reports if the plan is no longer the plan that requires approval, because the resource
+// moved to a newer generation or the workflow was rerun
+func planSuperseded(db *gorm.DB, taskPod models.TaskPod) (bool, error) {
+	var infra3Resource models.Infra3Resource
+	if result := db.First(&infra3Resource, "uuid = ?", taskPod.Infra3ResourceUUID); result.Error != nil {
+		return false, result.Error
+	}
+	if infra3Resource.CurrentGeneration != taskPod.Generation {
+		return true, nil
+	}
+	var podUUID string
+	if result := requiredApprovalPodUUID(db, taskPod.Infra3ResourceUUID, taskPod.Generation).Scan(&podUUID); result.Error != nil {
+		return false, result.Error
+	}
+	return podUUID != taskPod.UUID, nil
+}
+
+// approvalStatus is the status of the approval returned to the plan task. An approval that expired or was
+// superseded by a newer plan must not be applied.
+func approvalStatus(db *gorm.DB, approval models.Approval, taskPod models.TaskPod) string {
+	if approval.InvalidatedAt != nil {
+		if approval.InvalidatedReason == approvalExpired {
+			return "expired"
+		}
+		return "invalidated"
+	}
+	if !approval.IsApproved {
+		return "complete"
+	}
+	if approval.ExpiresAt != nil && time.Now().After(*approval.ExpiresAt) {
+		return "expired"
+	}
+	if superseded, err := planSuperseded(db, taskPod); err == nil && superseded {
+		return "invalidated"
+	}
+	return "complete"
+}
+
+// invalidateApproval marks the approval invalid. It reports false when another replica invalidated it
+// first.
+func (h APIHandler) invalidateApproval(approval models.Approval, reason string) bool {
+	result := h.DB.Model(&models.Approval{}).
+		Where("id = ? AND invalidated_at IS NULL", approval.ID).
+		Updates(map[string]any{"invalidated_at": time.Now(), "invalidated_reason": reason})
+	if result.Error != nil {
+		log.Printf("ERROR invalidating approval of plan %s: %s", approval.TaskPodUUID, result.Error)
+		return false
+	}
+	return result.RowsAffected == 1
+}
+
+// runApprovalExpiry invalidates approvals of plans that were not applied yet when they expire or when a
+// newer plan replaces them. Plans whose approval expired are rerun when ApprovalExpiryRerun is set.
+func (h APIHandler) runApprovalExpiry(ctx context.Context) {
+	// Plans that no task of the same run followed yet
+	unconsumedPlans := h.DB.Table("task_pods AS plan").Select("plan.uuid").Where(`
+		plan.task_type = 'plan' AND NOT EXISTS (
+			SELECT 1 FROM task_pods AS later
+			WHERE later.infra3_resource_uuid = plan.infra3_resource_uuid
+			AND later.generation = plan.generation
+			AND later.rerun = plan.rerun
+			AND later.in_cluster_generation = plan.in_cluster_generation
+			AND later.created_at > plan.created_at
+		)`)
+	var approvals []models.Approval
+	if result := h.DB.Where("is_approved AND invalidated_at IS NULL AND task_pod_uuid IN (?)", unconsumedPlans).Find(&approvals); result.Error != nil {
+		log.Printf("ERROR listing approvals to expire: %s", result.Error)
+		return
+	}
+
+	for _, approval := range approvals {
+		var taskPod models.TaskPod
+		if result := h.DB.First(&taskPod, "uuid = ?", approval.TaskPodUUID); result.Error != nil {
+			continue
+		}
+		superseded, err := planSuperseded(h.DB, taskPod)
+		if err != nil {
+			continue
+		}
+		if superseded {
+			h.invalidateApproval(approval, approvalSuperseded)
+			continue
+		}
+		if approval.ExpiresAt == nil || time.Now().Before(*approval.ExpiresAt) {
+			continue
+		}
+		if !h.invalidateApproval(approval, approvalExpired) || !h.ApprovalExpiryRerun {
+			continue
+		}
+
+		var infra3Resource models.Infra3Resource
+		if result := h.DB.First(&infra3Resource, "uuid = ?", taskPod.Infra3ResourceUUID); result.Error != nil {
+			continue
+		}
+		clusterName := getClusterName(infra3Resource.ClusterID, h.DB)
+		if _, err := rerun(h.clientset, clusterName, infra3Resource.Namespace, infra3Resource.Name, approvalExpiredChangeCause, ctx); err != nil {
+			log.Printf("ERROR rerunning '%s/%s' after its approval expired: %s", infra3Resource.Namespace, infra3Resource.Name, err)
+		}
+	}
+}
+
+// RunApprovalExpiry checks approvals every ApprovalExpiryInterval until the context is done
+func (h APIHandler) RunApprovalExpiry(ctx context.Context) {
+	if h.DB == nil || h.ApprovalExpiryInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(h.ApprovalExpiryInterval)
+	defer ticker.Stop()
+	for {
+		h.runApprovalExpiry(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// maxPendingApprovalsLimit limits the page size of the pending approvals inbox
+const maxPendingApprovalsLimit = 100
+
+// PendingApproval is a plan waiting for a decision. Status is "pending", or "expired" or "invalidated"
+// when the approval of the plan was invalidated. Such plans can't be voted on until they are rerun.
+type PendingApproval struct {
+	Infra3ResourceUUID string              `json:"infra3_resource_uuid"`
+	ClusterName        string              `json:"cluster_name"`
+	Namespace          string              `json:"namespace"`
+	Name               string              `json:"name"`
+	Generation         string              `json:"generation"`
+	TaskPodUUID        string              `json:"task_pod_uuid"`
+	RequestedAt        time.Time           `json:"requested_at"`
+	AgeSeconds         int64               `json:"age_seconds" gorm:"-"`
+	Requester          string              `json:"requester"`
+	Status             string              `json:"status"`
+	PlanSummary        *models.PlanSummary `json:"plan_summary" gorm:"-"`
+	Quorum             *ApprovalQuorum     `json:"quorum" gorm:"-"`
+}
+
+// PendingApprovals is a page of the inbox. Total and ByCluster count every pending approval matching the
+// filters, not only the ones in the page.
+type PendingApprovals struct {
+	Total     int               `json:"total"`
+	ByCluster map[string]int    `json:"by_cluster"`
+	Offset    int               `json:"offset"`
+	Limit     int               `json:"limit"`
+	Items     []PendingApproval `json:"items"`
+}
+
+// globRegexp translates a path.Match pattern to an anchored postgres regular expression
+func globRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		char := pattern[i]
+		switch {
+		case inClass:
+			if char == ']' {
+				inClass = false
+			} else if char == '\\' && i+1 < len(pattern) {
+				b.WriteByte(char)
+				i++
+				char = pattern[i]
+			}
+			b.WriteByte(char)
+		case char == '*':
+			b.WriteString("[^/]*")
+		case char == '?':
+			b.WriteString("[^/]")
+		case char == '[':
+			inClass = true
+			b.WriteByte(char)
+		case char == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// pendingApprovals selects the latest plan of the current generation of every resource, the same plan
+// requiredApprovalPodUUID returns, when the resource requires approval and the plan has no valid approval.
+// The requester is the author changeAuthor returns. The query is filtered by the glob patterns, the
+// requester and the time the plan was requested before.
+func (h APIHandler) pendingApprovals(clusterPattern, namespacePattern, requester string, requestedBefore time.Time) *gorm.DB {
+	query := h.DB.Raw(`
+		SELECT
+			infra3_resources.uuid AS infra3_resource_uuid,
+			clusters.name AS cluster_name,
+			infra3_resources.namespace,
+			infra3_resources.name,
+			infra3_resources.current_generation AS generation,
+			plan.uuid AS task_pod_uuid,
+			plan.created_at AS requested_at,
+			COALESCE(NULLIF(infra3_resource_specs.author, ''), (
+				SELECT rollbacks.requested_by FROM rollbacks
+				WHERE rollbacks.infra3_resource_uuid = infra3_resources.uuid
+				AND rollbacks.generation = infra3_resources.current_generation
+				AND rollbacks.deleted_at IS NULL
+				LIMIT 1
+			), '') AS requester,
+			CASE (SELECT approvals.invalidated_reason FROM approvals WHERE approvals.task_pod_uuid = plan.uuid LIMIT 1)
+				WHEN ? THEN 'expired'
+				WHEN ? THEN 'invalidated'
+				ELSE 'pending'
+			END AS status
+		FROM infra3_resources
+		JOIN clusters ON clusters.id = infra3_resources.cluster_id
+		JOIN infra3_resource_specs ON infra3_resource_specs.infra3_resource_uuid = infra3_resources.uuid
+			AND infra3_resource_specs.generation = infra3_resources.current_generation
+			AND infra3_resource_specs.deleted_at IS NULL
+		JOIN LATERAL (
+			SELECT task_pods.uuid, task_pods.created_at
+			FROM task_pods
+			WHERE task_pods.infra3_resource_uuid = infra3_resources.uuid
+			AND task_pods.generation = infra3_resources.current_generation
+			AND task_pods.task_type = 'plan'
+			AND task_pods.rerun = (
+				SELECT MAX(rerun) FROM task_pods AS reruns
+				WHERE reruns.infra3_resource_uuid = infra3_resources.uuid AND reruns.generation = infra3_resources.current_generation
+			)
+			AND task_pods.in_cluster_generation = (
+				SELECT MAX(in_cluster_generation) FROM task_pods AS reruns
+				WHERE reruns.infra3_resource_uuid = infra3_resources.uuid AND reruns.generation = infra3_resources.current_generation AND reruns.rerun = task_pods.rerun
+			)
+			LIMIT 1
+		) AS plan ON true
+		WHERE infra3_resources.deleted_at IS NULL
+		AND infra3_resources.current_state NOT IN (?, ?)
+		-- Specs are stored as compact json, so the field is matched as text
+		AND infra3_resource_specs.resource_spec LIKE '%"requireApproval":true%'
+		AND NOT EXISTS (SELECT 1 FROM approvals WHERE approvals.task_pod_uuid = plan.uuid AND approvals.invalidated_at IS NULL)
+	`, approvalExpired, approvalSuperseded, models.Failed, models.Canceled)
+
+	query = h.DB.Table("(?) AS pending", query).Where("requested_at <= ?", requestedBefore)
+	if clusterPattern != "*" {
+		query = query.Where("cluster_name ~ ?", globRegexp(clusterPattern))
+	}
+	if namespacePattern != "*" {
+		query = query.Where("namespace ~ ?", globRegexp(namespacePattern))
+	}
+	if requester != "" {
+		query = query.Where("requester = ?", requester)
+	}
+	return query
+}
+
+// getPendingApprovals lists the plans waiting for a decision, oldest first. Filter with the "cluster" and
+// "namespace" glob patterns, "requester" and "min_age" (eg "1h"), and page with "offset" and "limit".
+func (h APIHandler) getPendingApprovals(c *gin.Context) {
+	clusterPattern := c.DefaultQuery("cluster", "*")
+	namespacePattern := c.DefaultQuery("namespace", "*")
+	for _, pattern := range []string{clusterPattern, namespacePattern} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, fmt.Sprintf("pattern '%s' is invalid: %s", pattern, err), []any{}))
+			return
+		}
+	}
+	var minAge time.Duration
+	if s := c.Query("min_age"); s != "" {
+		var err error
+		if minAge, err = time.ParseDuration(s); err != nil {
+			c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, fmt.Sprintf("min_age must be a duration, got '%s'", s), []any{}))
+			return
+		}
+	}
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 {
+		limit = 10
+	}
+	limit = min(limit, maxPendingApprovalsLimit)
+	offset = max(offset, 0)
+
+	now := time.Now()
+	pending := func() *gorm.DB {
+		return h.pendingApprovals(clusterPattern, namespacePattern, c.Query("requester"), now.Add(-minAge))
+	}
+	var counts []struct {
+		ClusterName string
+		Count       int
+	}
+	if result := pending().Select("cluster_name, COUNT(*) AS count").Group("cluster_name").Scan(&counts); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	page := PendingApprovals{ByCluster: map[string]int{}, Offset: offset, Limit: limit, Items: []PendingApproval{}}
+	for _, count := range counts {
+		page.Total += count.Count
+		page.ByCluster[count.ClusterName] = count.Count
+	}
+	if result := pending().Order("requested_at, task_pod_uuid").Offset(offset).Limit(limit).Scan(&page.Items); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+
+	// Plan summaries and quorums are only looked up for the page
+	var err error
+	for i := range page.Items {
+		item := &page.Items[i]
+		item.AgeSeconds = int64(now.Sub(item.RequestedAt).Seconds())
+		taskPod := models.TaskPod{UUID: item.TaskPodUUID, TaskType: "plan", Generation: item.Generation, Infra3ResourceUUID: item.Infra3ResourceUUID}
+		if item.PlanSummary, err = planSummary(c, h.DB, h.LogStore, taskPod); err != nil {
+			log.Printf("ERROR summarizing plan %s: %s", item.TaskPodUUID, err)
+		}
+		if item.Quorum, err = h.approvalQuorum(taskPod); err != nil {
+			log.Printf("ERROR reading quorum of plan %s: %s", item.TaskPodUUID, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, fmt.Sprintf("%d pending approval(s)", page.Total), []PendingApprovals{page}))
+}
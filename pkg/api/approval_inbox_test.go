@@ -0,0 +1,21 @@
+package api
+
+import (
+	"path"
+	"regexp"
+	"testing"
+)
+
+// TestGlobRegexp checks that the regular expression the inbox filters with in SQL matches like path.Match
+func TestGlobRegexp(t *testing.T) {
+	names := []string{"prod", "prod-eu", "prod-us", "prod.eu", "dev", "prod/eu", "Prod", "p", "", "a*b", "a+b"}
+	for _, pattern := range []string{"prod-*", "prod?eu", "*", "prod.eu", "[pd]*", "[^p]*", "[a-c]+b", `a\*b`, "p"} {
+		re := regexp.MustCompile(globRegexp(pattern))
+		for _, name := range names {
+			want, _ := path.Match(pattern, name)
+			if got := re.MatchString(name); got != want {
+				t.Errorf("pattern %q on %q: regexp %q matched %t, path.Match %t", pattern, name, globRegexp(pattern), got, want)
+			}
+		}
+	}
+}
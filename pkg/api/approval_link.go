@@ -0,0 +1,391 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	// DefaultApprovalLinkTTL is how long approval links are valid when the request does not set a ttl
+	DefaultApprovalLinkTTL = 15 * time.Minute
+
+	// maxApprovalLinkTTL limits how long approval links are valid
+	maxApprovalLinkTTL = 24 * time.Hour
+
+	approvalLinkApprove = "approve"
+	approvalLinkDeny    = "deny"
+)
+
+// The page shown when an approval link is opened. Opening the link does not use it, so link previews of
+// chat and email clients can't approve the plan. The form posts back to the same url.
+var approvalLinkTemplate = template.Must(template.New("approval-link").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{ .Title }}</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 2em auto;">
+<h2>{{ .Title }}</h2>
+{{ if .Resource }}<p>{{ .Resource }}</p>{{ end }}
+{{ if .Summary }}<p>{{ .Summary }}</p>{{ end }}
+<p>{{ .Message }}</p>
+{{ if .Action }}<form method="post"><button type="submit">{{ .Action }} as {{ .Approver }}</button></form>{{ end }}
+</body>
+</html>
+`))
+
+// ApprovalLinks are the signed urls that approve or deny a plan as the approver. Using either url uses
+// the link.
+type ApprovalLinks struct {
+	ID          string    `json:"id"`
+	TaskPodUUID string    `json:"task_pod_uuid"`
+	Approver    string    `json:"approver"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	ApproveURL  string    `json:"approve_url"`
+	DenyURL     string    `json:"deny_url"`
+}
+
+// approvalLinkClaims are signed in the approval link token
+type approvalLinkClaims struct {
+	TaskPodUUID string `json:"task_pod_uuid"`
+	Approver    string `json:"approver"`
+	Action      string `json:"action"`
+	jwt.RegisteredClaims
+}
+
+// approvalLinkKey signs approval link tokens. It is derived from the JWT signing key so link tokens are
+// never accepted as user tokens.
+func approvalLinkKey() []byte {
+	mac := hmac.New(sha256.New, []byte(jwtSigningKey))
+	mac.Write([]byte("infra3-approval-link"))
+	return mac.Sum(nil)
+}
+
+// parseApprovalLinkToken verifies the signature and expiry of the token
+func parseApprovalLinkToken(token string) (*approvalLinkClaims, error) {
+	claims := approvalLinkClaims{}
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %s", t.Header["alg"])
+		}
+		return approvalLinkKey(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if claims.Action != approvalLinkApprove && claims.Action != approvalLinkDeny {
+		return nil, fmt.Errorf("invalid action '%s'", claims.Action)
+	}
+	return &claims, nil
+}
+
+// approvalLinkPlan finds the plan links are minted for. Links are refused for plans that a newer plan
+// replaced.
+func (h APIHandler) approvalLinkPlan(taskPodUUID string) (models.TaskPod, error) {
+	var taskPod models.TaskPod
+	if result := h.DB.First(&taskPod, "uuid = ?", taskPodUUID); result.Error != nil {
+		return taskPod, result.Error
+	}
+	if !isPlanTask(taskPod.TaskType) {
+		return taskPod, fmt.Errorf("approvals are for plan types, but uuid was for %s type", taskPod.TaskType)
+	}
+	superseded, err := planSuperseded(h.DB, taskPod)
+	if err != nil {
+		return taskPod, err
+	}
+	if superseded {
+		return taskPod, errApprovalSuperseded
+	}
+	return taskPod, nil
+}
+
+// mintApprovalLinks creates a single-use link for the approver to decide the plan. The urls are built on
+// the base url, which is the public url of the API.
+func (h APIHandler) mintApprovalLinks(taskPodUUID, approver, createdBy, baseURL string, ttl time.Duration) (*ApprovalLinks, error) {
+	if jwtSigningKey == "" {
+		return nil, fmt.Errorf("approval links require JWT_SIGNING_KEY")
+	}
+	if approver == "" {
+		return nil, fmt.Errorf("approver is required")
+	}
+	taskPod, err := h.approvalLinkPlan(taskPodUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	link := models.ApprovalLink{
+		ID:          hex.EncodeToString(id),
+		TaskPodUUID: taskPod.UUID,
+		Approver:    approver,
+		CreatedBy:   createdBy,
+		ExpiresAt:   time.Now().Add(ttl).Truncate(time.Second),
+	}
+	if result := h.DB.Create(&link); result.Error != nil {
+		return nil, result.Error
+	}
+
+	links := ApprovalLinks{ID: link.ID, TaskPodUUID: link.TaskPodUUID, Approver: link.Approver, ExpiresAt: link.ExpiresAt}
+	for _, action := range []string{approvalLinkApprove, approvalLinkDeny} {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, approvalLinkClaims{
+			TaskPodUUID: link.TaskPodUUID,
+			Approver:    link.Approver,
+			Action:      action,
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        link.ID,
+				ExpiresAt: jwt.NewNumericDate(link.ExpiresAt),
+			},
+		}).SignedString(approvalLinkKey())
+		if err != nil {
+			return nil, err
+		}
+		url := fmt.Sprintf("%s/approval-link/%s", strings.TrimSuffix(baseURL, "/"), token)
+		if action == approvalLinkApprove {
+			links.ApproveURL = url
+		} else {
+			links.DenyURL = url
+		}
+	}
+	return &links, nil
+}
+
+// approvalLinkBaseURL is the configured public url of the API, or the url the request was sent to
+func (h APIHandler) approvalLinkBaseURL(c *gin.Context) string {
+	if h.ApprovalLinkBaseURL != "" {
+		return h.ApprovalLinkBaseURL
+	}
+	return GetApiURL(c, h.serviceIP)
+}
+
+// sendApprovalLinks queues an approval link event for the notification channels of the approver. The
+// channels mint the links when they send the message, so the urls never reach the user that requested
+// them.
+func (h APIHandler) sendApprovalLinks(taskPodUUID, approver, createdBy, baseURL string, ttl time.Duration) ([]models.Notification, error) {
+	if jwtSigningKey == "" {
+		return nil, fmt.Errorf("approval links require JWT_SIGNING_KEY")
+	}
+	taskPod, err := h.approvalLinkPlan(taskPodUUID)
+	if err != nil {
+		return nil, err
+	}
+	var channels []models.NotificationChannel
+	if result := h.DB.Where("enabled AND approver = ?", approver).Order("id").Find(&channels); result.Error != nil {
+		return nil, result.Error
+	}
+	if len(channels) == 0 {
+		return nil, fmt.Errorf("no notification channel sends approval links to '%s'", approver)
+	}
+	var infra3Resource models.Infra3Resource
+	if result := h.DB.First(&infra3Resource, "uuid = ?", taskPod.Infra3ResourceUUID); result.Error != nil {
+		return nil, result.Error
+	}
+
+	event := h.resourceEvent(EventApprovalLink, infra3Resource, map[string]any{
+		"approver":   approver,
+		"created_by": createdBy,
+		"base_url":   baseURL,
+		"ttl":        ttl.String(),
+	})
+	event.Generation = taskPod.Generation
+	event.TaskPodUUID = taskPod.UUID
+	if result := h.DB.Create(&event); result.Error != nil {
+		return nil, result.Error
+	}
+	notifications := []models.Notification{}
+	for _, channel := range channels {
+		notification := models.Notification{
+			ChannelID:     channel.ID,
+			EventID:       event.ID,
+			EventType:     event.Type,
+			Status:        notificationPending,
+			NextAttemptAt: time.Now(),
+		}
+		if result := h.DB.Create(&notification); result.Error != nil {
+			return nil, result.Error
+		}
+		go h.attemptNotification(context.Background(), notification.ID)
+		notifications = append(notifications, notification)
+	}
+	return notifications, nil
+}
+
+// addApprovalLinks mints approve and deny urls for a plan, eg {"approver": "alice", "ttl": "30m"}. The
+// approver defaults to the caller. Only privileged users can request links for someone else, and those
+// links are sent to the notification channels of the approver instead of the response.
+func (h APIHandler) addApprovalLinks(c *gin.Context) {
+	jsonData := struct {
+		Approver string `json:"approver"`
+		TTL      string `json:"ttl"`
+	}{}
+	if err := c.BindJSON(&jsonData); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	if jsonData.Approver == "" {
+		jsonData.Approver = username(c)
+	}
+	if jsonData.Approver != username(c) && !h.requireRole(c, RolePrivileged) {
+		return
+	}
+	ttl := DefaultApprovalLinkTTL
+	if jsonData.TTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(jsonData.TTL)
+		if err != nil || ttl <= 0 || ttl > maxApprovalLinkTTL {
+			c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, fmt.Sprintf("ttl must be a duration of at most %s, got '%s'", maxApprovalLinkTTL, jsonData.TTL), []any{}))
+			return
+		}
+	}
+
+	if jsonData.Approver != username(c) {
+		notifications, err := h.sendApprovalLinks(c.Param("task_pod_uuid"), jsonData.Approver, username(c), h.approvalLinkBaseURL(c), ttl)
+		if err != nil {
+			status := approvalVoteStatus(err)
+			c.JSON(status, response(int64(status), err.Error(), []any{}))
+			return
+		}
+		c.JSON(http.StatusAccepted, response(http.StatusAccepted, fmt.Sprintf("links are sent to the %d notification channel(s) of '%s'", len(notifications), jsonData.Approver), notifications))
+		return
+	}
+
+	links, err := h.mintApprovalLinks(c.Param("task_pod_uuid"), jsonData.Approver, username(c), h.approvalLinkBaseURL(c), ttl)
+	if err != nil {
+		status := approvalVoteStatus(err)
+		c.JSON(status, response(int64(status), err.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusCreated, response(http.StatusCreated, "", []ApprovalLinks{*links}))
+}
+
+// getApprovalLinks lists the links minted for a plan with how they were used
+func (h APIHandler) getApprovalLinks(c *gin.Context) {
+	links := []models.ApprovalLink{}
+	if result := h.DB.Where("task_pod_uuid = ?", c.Param("task_pod_uuid")).Order("created_at").Find(&links); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", links))
+}
+
+// approvalLinkPage responds with the html page to browsers and json to everyone else
+func approvalLinkPage(c *gin.Context, status int, data gin.H) {
+	if c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) == gin.MIMEHTML {
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.Status(status)
+		if err := approvalLinkTemplate.Execute(c.Writer, data); err != nil {
+			log.Printf("ERROR rendering approval link page: %s", err)
+		}
+		return
+	}
+	message, _ := data["Message"].(string)
+	c.JSON(status, response(int64(status), message, []any{}))
+}
+
+// approvalLink verifies the token of the url and finds its link. It responds with an error when the
+// token is not valid.
+func (h APIHandler) approvalLink(c *gin.Context) (*approvalLinkClaims, *models.ApprovalLink, bool) {
+	claims, err := parseApprovalLinkToken(c.Param("token"))
+	if err != nil {
+		log.Printf("Rejected approval link from %s: %s", c.ClientIP(), err)
+		approvalLinkPage(c, http.StatusUnauthorized, gin.H{"Title": "Invalid link", "Message": "The link is invalid or expired."})
+		return nil, nil, false
+	}
+	var link models.ApprovalLink
+	if result := h.DB.First(&link, "id = ?", claims.ID); result.Error != nil || link.TaskPodUUID != claims.TaskPodUUID || link.Approver != claims.Approver {
+		log.Printf("Rejected approval link %s from %s: link not found", claims.ID, c.ClientIP())
+		approvalLinkPage(c, http.StatusNotFound, gin.H{"Title": "Invalid link", "Message": "The link does not exist."})
+		return nil, nil, false
+	}
+	return claims, &link, true
+}
+
+// showApprovalLink shows what the link does without using it
+func (h APIHandler) showApprovalLink(c *gin.Context) {
+	claims, link, ok := h.approvalLink(c)
+	if !ok {
+		return
+	}
+	action := strings.ToUpper(claims.Action[:1]) + claims.Action[1:]
+	title := action + " plan"
+	if link.UsedAt != nil {
+		approvalLinkPage(c, http.StatusConflict, gin.H{"Title": title, "Message": fmt.Sprintf("The link was already used to %s the plan.", link.UsedAction)})
+		return
+	}
+
+	data := gin.H{"Title": title, "Approver": link.Approver, "Action": action}
+	var taskPod models.TaskPod
+	if result := h.DB.Preload("Infra3Resource").First(&taskPod, "uuid = ?", link.TaskPodUUID); result.Error == nil {
+		clusterName := getClusterName(taskPod.Infra3Resource.ClusterID, h.DB)
+		data["Resource"] = fmt.Sprintf("%s/%s/%s generation %s", clusterName, taskPod.Infra3Resource.Namespace, taskPod.Infra3Resource.Name, taskPod.Generation)
+		if summary, err := planSummary(c, h.DB, h.LogStore, taskPod); err == nil && summary != nil {
+			data["Summary"] = fmt.Sprintf("Plan: %d to add, %d to change, %d to destroy.", summary.Add, summary.Change, summary.Destroy)
+		}
+	}
+	data["Message"] = fmt.Sprintf("The link expires at %s.", link.ExpiresAt.UTC().Format(time.RFC1123))
+	approvalLinkPage(c, http.StatusOK, data)
+}
+
+// useApprovalLink votes on the plan as the approver of the link. The link can only be used once, even
+// when the vote is refused.
+func (h APIHandler) useApprovalLink(c *gin.Context) {
+	claims, link, ok := h.approvalLink(c)
+	if !ok {
+		return
+	}
+	title := "Plan decision"
+
+	now := time.Now()
+	result := h.DB.Model(&models.ApprovalLink{}).
+		Where("id = ? AND used_at IS NULL", link.ID).
+		Updates(map[string]any{"used_at": now, "used_action": claims.Action, "used_from": c.ClientIP()})
+	if result.Error != nil {
+		approvalLinkPage(c, http.StatusUnprocessableEntity, gin.H{"Title": title, "Message": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		approvalLinkPage(c, http.StatusConflict, gin.H{"Title": title, "Message": "The link was already used."})
+		return
+	}
+
+	vote := models.ApprovalVote{
+		Approver:   link.Approver,
+		IsApproved: claims.Action == approvalLinkApprove,
+		Comment:    fmt.Sprintf("%s via approval link %s", claims.Action, link.ID),
+		MintedBy:   link.CreatedBy,
+	}
+	quorum, err := h.castApprovalVote(link.TaskPodUUID, vote)
+	status := http.StatusOK
+	message := ""
+	switch {
+	case err != nil:
+		status = approvalVoteStatus(err)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = fmt.Errorf("plan %s not found", link.TaskPodUUID)
+		}
+		message = "rejected: " + err.Error()
+	case !quorum.Decided:
+		message = fmt.Sprintf("%s recorded, %d of %d approvals", claims.Action, quorum.Approvals, quorum.Required)
+	case vote.IsApproved:
+		message = "plan approved"
+	default:
+		message = "plan denied"
+	}
+	h.DB.Model(link).Update("result", message)
+	log.Printf("Approval link %s of plan %s used by %s from %s: %s", link.ID, link.TaskPodUUID, link.Approver, c.ClientIP(), message)
+	approvalLinkPage(c, status, gin.H{"Title": title, "Message": strings.ToUpper(message[:1]) + message[1:] + "."})
+}
@@ -0,0 +1,520 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// systemApproverPrefix marks approvers that are the server itself, eg auto-approval rules and drift
+	// checks. Users can't vote under such a name.
+	systemApproverPrefix = "system:"
+
+	// authorAnnotation is set by the origin cluster to the user that changed the spec of the Tf. Specs are
+	// sent by the origin's sync identity, so the caller is not the author.
+	authorAnnotation = "infra3-stella.galleybytes.com/author"
+)
+
+var (
+	// errApprovalDecided is returned when the plan was already approved or denied
+	errApprovalDecided = errors.New("approval is already set")
+
+	// errApprovalForbidden is returned when the approver is not allowed to vote by the policy
+	errApprovalForbidden = errors.New("forbidden")
+
+	// errApprovalConsumed is returned when a task already ran after the plan, so the decision can no
+	// longer be revoked
+	errApprovalConsumed = errors.New("approval was already consumed")
+
+	// errApprovalExpired is returned when the plan is older than the approval TTL
+	errApprovalExpired = errors.New("plan is older than the approval ttl, rerun it to get a new plan")
+
+	// errApprovalSuperseded is returned when a newer plan replaced the plan
+	errApprovalSuperseded = errors.New("plan was superseded by a newer plan")
+)
+
+// maxApprovalCommentLength limits the comment of an approval vote
+const maxApprovalCommentLength = 4096
+
+// ApprovalQuorum is the progress of the approval of a plan
+type ApprovalQuorum struct {
+	PolicyID  uint     `json:"policy_id,omitempty"`
+	Required  int      `json:"required"`
+	Group     string   `json:"group,omitempty"`
+	Approvals int      `json:"approvals"`
+	Approvers []string `json:"approvers"`
+	Decided   bool     `json:"decided"`
+}
+
+// defaultApprovalPolicy is used when no policy matches the resource. The first vote decides like it did
+// before policies existed.
+var defaultApprovalPolicy = models.ApprovalPolicy{Required: 1, AllowSelfApproval: true}
+
+// approvalPolicySpecificity ranks policies so a policy for a cluster wins over a policy for every
+// cluster, and an exact namespace wins over a namespace pattern
+func approvalPolicySpecificity(policy models.ApprovalPolicy) int {
+	specificity := 0
+	if !strings.ContainsAny(policy.Cluster, "*?[") {
+		specificity += 2
+	}
+	if !strings.ContainsAny(policy.Namespace, "*?[") {
+		specificity++
+	}
+	return specificity
+}
+
+// approvalPolicy returns the most specific policy matching the cluster and namespace
+func (h APIHandler) approvalPolicy(clusterName, namespace string) (models.ApprovalPolicy, error) {
+	var policies []models.ApprovalPolicy
+	if result := h.DB.Order("id").Find(&policies); result.Error != nil {
+		return defaultApprovalPolicy, result.Error
+	}
+	policy := defaultApprovalPolicy
+	best := -1
+	for _, candidate := range policies {
+		clusterMatched, _ := path.Match(candidate.Cluster, clusterName)
+		namespaceMatched, _ := path.Match(candidate.Namespace, namespace)
+		if !clusterMatched || !namespaceMatched {
+			continue
+		}
+		if specificity := approvalPolicySpecificity(candidate); specificity > best {
+			policy, best = candidate, specificity
+		}
+	}
+	return policy, nil
+}
+
+// changeAuthor returns who authored the generation of the resource, the user the origin named in the
+// author annotation or who requested the rollback. Specs of rollbacks stored before the author was
+// recorded fall back to the requester. An empty author is unknown.
+func changeAuthor(db *gorm.DB, infra3ResourceUUID, generation string) string {
+	var infra3ResourceSpec models.Infra3ResourceSpec
+	if result := db.Where("infra3_resource_uuid = ? AND generation = ?", infra3ResourceUUID, generation).Limit(1).Find(&infra3ResourceSpec); result.Error != nil {
+		return ""
+	}
+	if infra3ResourceSpec.Author != "" {
+		return infra3ResourceSpec.Author
+	}
+	var rollback models.Rollback
+	if result := db.Where("infra3_resource_uuid = ? AND generation = ?", infra3ResourceUUID, generation).Limit(1).Find(&rollback); result.Error == nil {
+		return rollback.RequestedBy
+	}
+	return ""
+}
+
+// checkApprover returns an error unless the approver may vote on the plan. Approve and deny votes are
+// checked the same way because a single deny decides the plan. Without a group, configured policies
+// limit approvers to users granted a role, the default policy lets every user vote.
+func (h APIHandler) checkApprover(db *gorm.DB, policy models.ApprovalPolicy, taskPod models.TaskPod, approver string) error {
+	if strings.HasPrefix(approver, systemApproverPrefix) {
+		return fmt.Errorf("%w: '%s' is reserved for the server", errApprovalForbidden, approver)
+	}
+	if approver == "" && (policy.Required > 1 || policy.ID != 0) {
+		return fmt.Errorf("%w: the approval policy requires the identity of the approver", errApprovalForbidden)
+	}
+	if policy.Group != "" && !h.userHasRole(approver, policy.Group) {
+		return fmt.Errorf("%w: approvers must be in the '%s' group", errApprovalForbidden, policy.Group)
+	}
+	if policy.Group == "" && policy.ID != 0 && !h.knownUser(approver) {
+		return fmt.Errorf("%w: approvers must be granted a role", errApprovalForbidden)
+	}
+	if !policy.AllowSelfApproval {
+		author := changeAuthor(db, taskPod.Infra3ResourceUUID, taskPod.Generation)
+		if author == "" {
+			return fmt.Errorf("%w: the author of the change is unknown, so self approval can't be ruled out", errApprovalForbidden)
+		}
+		if approver == author {
+			return fmt.Errorf("%w: the author of the change can't vote on it", errApprovalForbidden)
+		}
+	}
+	return nil
+}
+
+// mintersCounted refuses a vote that would count a user twice. A user that minted an approval link for
+// someone else counts once, through their own vote or through a vote cast with a link they minted. Links
+// minted by the server don't count toward anyone.
+func mintersCounted(db *gorm.DB, taskPodUUID string, vote models.ApprovalVote) error {
+	var counted int64
+	query := db.Model(&models.ApprovalVote{}).Where("task_pod_uuid = ? AND revoked_at IS NULL", taskPodUUID)
+	if minter := vote.MintedBy; minter != "" && minter != vote.Approver && !strings.HasPrefix(minter, systemApproverPrefix) {
+		if result := query.Where("approver = ? OR minted_by = ?", minter, minter).Count(&counted); result.Error != nil {
+			return result.Error
+		}
+		if counted > 0 {
+			return fmt.Errorf("%w: '%s' minted the link and is already counted", errApprovalForbidden, minter)
+		}
+		return nil
+	}
+	if result := query.Where("minted_by = ? AND approver <> ?", vote.Approver, vote.Approver).Count(&counted); result.Error != nil {
+		return result.Error
+	}
+	if counted > 0 {
+		return fmt.Errorf("%w: '%s' is already counted through a link they minted", errApprovalForbidden, vote.Approver)
+	}
+	return nil
+}
+
+// taskPodApprovalPolicy returns the policy of the resource the plan belongs to
+func (h APIHandler) taskPodApprovalPolicy(db *gorm.DB, taskPod models.TaskPod) (models.ApprovalPolicy, error) {
+	var infra3Resource models.Infra3Resource
+	if result := db.First(&infra3Resource, "uuid = ?", taskPod.Infra3ResourceUUID); result.Error != nil {
+		return defaultApprovalPolicy, result.Error
+	}
+	return h.approvalPolicy(getClusterName(infra3Resource.ClusterID, db), infra3Resource.Namespace)
+}
+
+// quorum counts the approve votes of the plan against the policy
+func quorum(db *gorm.DB, policy models.ApprovalPolicy, taskPodUUID string) (*ApprovalQuorum, error) {
+	var votes []models.ApprovalVote
+	if result := db.Where("task_pod_uuid = ? AND is_approved AND revoked_at IS NULL", taskPodUUID).Order("created_at").Find(&votes); result.Error != nil {
+		return nil, result.Error
+	}
+	var approvals int64
+	if result := db.Model(&models.Approval{}).Where("task_pod_uuid = ?", taskPodUUID).Count(&approvals); result.Error != nil {
+		return nil, result.Error
+	}
+	q := ApprovalQuorum{
+		PolicyID:  policy.ID,
+		Required:  policy.Required,
+		Group:     policy.Group,
+		Approvals: len(votes),
+		Approvers: []string{},
+		Decided:   approvals > 0,
+	}
+	for _, vote := range votes {
+		q.Approvers = append(q.Approvers, vote.Approver)
+	}
+	return &q, nil
+}
+
+// approvalQuorum returns the progress of the approval of the plan
+func (h APIHandler) approvalQuorum(taskPod models.TaskPod) (*ApprovalQuorum, error) {
+	policy, err := h.taskPodApprovalPolicy(h.DB, taskPod)
+	if err != nil {
+		return nil, err
+	}
+	return quorum(h.DB, policy, taskPod.UUID)
+}
+
+// validateApprovalVote checks the comment and ticket link of a vote
+func validateApprovalVote(vote models.ApprovalVote) error {
+	if len(vote.Comment) > maxApprovalCommentLength {
+		return fmt.Errorf("comment is longer than %d characters", maxApprovalCommentLength)
+	}
+	if vote.TicketURL != "" {
+		ticketURL, err := url.Parse(vote.TicketURL)
+		if err != nil || (ticketURL.Scheme != "http" && ticketURL.Scheme != "https") || ticketURL.Host == "" {
+			return fmt.Errorf("ticket_url must be an http(s) url, got '%s'", vote.TicketURL)
+		}
+	}
+	return nil
+}
+
+// castApprovalVote records the vote of the approver on the plan. The Approval of the plan is saved once
+// enough approvers approved it, or as soon as an allowed approver denies it.
+func (h APIHandler) castApprovalVote(taskPodUUID string, vote models.ApprovalVote) (*ApprovalQuorum, error) {
+	return h.castVote(taskPodUUID, vote, false)
+}
+
+// castSystemApprovalVote records a decision the server made on the plan, eg a drift check denying a plan
+// without changes. The vote decides the plan on its own and the approver policy does not apply to it.
+func (h APIHandler) castSystemApprovalVote(taskPodUUID string, vote models.ApprovalVote) (*ApprovalQuorum, error) {
+	return h.castVote(taskPodUUID, vote, true)
+}
+
+func (h APIHandler) castVote(taskPodUUID string, vote models.ApprovalVote, system bool) (*ApprovalQuorum, error) {
+	approver := vote.Approver
+	var q *ApprovalQuorum
+	var taskPod models.TaskPod
+	var approval *models.Approval
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		// Lock the plan so concurrent votes can't both decide it
+		if result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&taskPod, "uuid = ?", taskPodUUID); result.Error != nil {
+			return result.Error
+		}
+		var decided models.Approval
+		if result := tx.Where("task_pod_uuid = ?", taskPod.UUID).Limit(1).Find(&decided); result.Error != nil {
+			return result.Error
+		}
+		if decided.ID != 0 {
+			// An invalidated approval can't be replaced, the plan must be rerun to vote again
+			switch {
+			case decided.InvalidatedAt == nil:
+				return errApprovalDecided
+			case decided.InvalidatedReason == approvalExpired:
+				return errApprovalExpired
+			default:
+				return errApprovalSuperseded
+			}
+		}
+
+		policy, err := h.taskPodApprovalPolicy(tx, taskPod)
+		if err != nil {
+			return err
+		}
+		if !system {
+			if err := h.checkApprover(tx, policy, taskPod, approver); err != nil {
+				return err
+			}
+		}
+		expiresAt := h.approvalExpiresAt(policy, taskPod)
+		if expiresAt != nil && time.Now().After(*expiresAt) {
+			return errApprovalExpired
+		}
+		superseded, err := planSuperseded(tx, taskPod)
+		if err != nil {
+			return err
+		}
+		if superseded {
+			return errApprovalSuperseded
+		}
+
+		var voted int64
+		if result := tx.Model(&models.ApprovalVote{}).Where("task_pod_uuid = ? AND approver = ? AND revoked_at IS NULL", taskPod.UUID, approver).Count(&voted); result.Error != nil {
+			return result.Error
+		}
+		if voted > 0 {
+			return fmt.Errorf("%w: '%s' already voted", errApprovalDecided, approver)
+		}
+		if !system {
+			if err := mintersCounted(tx, taskPod.UUID, vote); err != nil {
+				return err
+			}
+		}
+		vote.TaskPodUUID = taskPod.UUID
+		vote.ApprovalPolicyID = policy.ID
+		if result := tx.Create(&vote); result.Error != nil {
+			return result.Error
+		}
+
+		q, err = quorum(tx, policy, taskPod.UUID)
+		if err != nil {
+			return err
+		}
+		if system || !vote.IsApproved || q.Approvals >= max(policy.Required, 1) {
+			approval = &models.Approval{
+				IsApproved:  vote.IsApproved,
+				TaskPodUUID: taskPod.UUID,
+				Approver:    vote.Approver,
+				Comment:     vote.Comment,
+				TicketURL:   vote.TicketURL,
+				ExpiresAt:   expiresAt,
+			}
+			if result := tx.Create(approval); result.Error != nil {
+				return result.Error
+			}
+			q.Decided = true
+		}
+		return nil
+	})
+	if err == nil && approval != nil {
+		h.publishApprovalDecided(taskPod, *approval)
+	}
+	return q, err
+}
+
+// revokeApprovalVote withdraws the vote of the approver. When the vote decided the plan the Approval is
+// removed, unless a task already ran after the plan and consumed the decision.
+func (h APIHandler) revokeApprovalVote(taskPodUUID, approver, revokedBy string) (*ApprovalQuorum, error) {
+	var q *ApprovalQuorum
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		var taskPod models.TaskPod
+		if result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&taskPod, "uuid = ?", taskPodUUID); result.Error != nil {
+			return result.Error
+		}
+		var vote models.ApprovalVote
+		if result := tx.Where("task_pod_uuid = ? AND approver = ? AND revoked_at IS NULL", taskPod.UUID, approver).First(&vote); result.Error != nil {
+			if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("%w: '%s' has no vote to revoke", result.Error, approver)
+			}
+			return result.Error
+		}
+		now := time.Now()
+		if result := tx.Model(&vote).Updates(map[string]any{"revoked_at": now, "revoked_by": revokedBy}); result.Error != nil {
+			return result.Error
+		}
+
+		policy, err := h.taskPodApprovalPolicy(tx, taskPod)
+		if err != nil {
+			return err
+		}
+		q, err = quorum(tx, policy, taskPod.UUID)
+		if err != nil {
+			return err
+		}
+		var approval models.Approval
+		if result := tx.Where("task_pod_uuid = ?", taskPod.UUID).Limit(1).Find(&approval); result.Error != nil {
+			return result.Error
+		}
+		if approval.ID == 0 || approval.IsApproved != vote.IsApproved || (approval.IsApproved && q.Approvals >= max(policy.Required, 1)) {
+			// The plan is still undecided, the vote didn't decide it, or enough approvals remain without it
+			return nil
+		}
+		var nextTasks int64
+		if result := tx.Model(&models.TaskPod{}).Where("infra3_resource_uuid = ? AND created_at > ?", taskPod.Infra3ResourceUUID, taskPod.CreatedAt).Count(&nextTasks); result.Error != nil {
+			return result.Error
+		}
+		if nextTasks > 0 {
+			return errApprovalConsumed
+		}
+		// Approvals are read with raw table queries that don't skip soft deleted rows
+		if result := tx.Unscoped().Delete(&approval); result.Error != nil {
+			return result.Error
+		}
+		q.Decided = false
+		return nil
+	})
+	return q, err
+}
+
+// approvalVoteStatus is the response status of a failed vote
+func approvalVoteStatus(err error) int {
+	switch {
+	case errors.Is(err, errApprovalDecided), errors.Is(err, errApprovalConsumed), errors.Is(err, errApprovalExpired), errors.Is(err, errApprovalSuperseded):
+		return http.StatusConflict
+	case errors.Is(err, errApprovalForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusUnprocessableEntity
+	}
+}
+
+// approvalPolicyRequest is the body of create and update approval policy requests
+type approvalPolicyRequest struct {
+	Cluster           string `json:"cluster"`
+	Namespace         string `json:"namespace"`
+	Required          int    `json:"required"`
+	Group             string `json:"group"`
+	AllowSelfApproval bool   `json:"allow_self_approval"`
+	TTL               string `json:"ttl"`
+}
+
+// apply validates the request and sets it on the policy. Empty patterns match everything.
+func (r approvalPolicyRequest) apply(policy *models.ApprovalPolicy) error {
+	if r.Cluster == "" {
+		r.Cluster = "*"
+	}
+	if r.Namespace == "" {
+		r.Namespace = "*"
+	}
+	for _, pattern := range []string{r.Cluster, r.Namespace} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("pattern '%s' is invalid: %s", pattern, err)
+		}
+	}
+	if r.Required < 1 {
+		return fmt.Errorf("required must be at least 1")
+	}
+	if r.TTL != "" {
+		if ttl, err := time.ParseDuration(r.TTL); err != nil || ttl < 0 {
+			return fmt.Errorf("ttl must be a positive duration, got '%s'", r.TTL)
+		}
+	}
+	policy.Cluster = r.Cluster
+	policy.Namespace = r.Namespace
+	policy.Required = r.Required
+	policy.Group = r.Group
+	policy.AllowSelfApproval = r.AllowSelfApproval
+	policy.TTL = r.TTL
+	return nil
+}
+
+func (h APIHandler) getApprovalPolicies(c *gin.Context) {
+	policies := []models.ApprovalPolicy{}
+	if result := h.DB.Order("id").Find(&policies); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", policies))
+}
+
+// addApprovalPolicy creates a policy, eg {"cluster": "prod-*", "namespace": "*", "required": 2,
+// "group": "sre"}. Only privileged users can manage policies.
+func (h APIHandler) addApprovalPolicy(c *gin.Context) {
+	if !h.requireRole(c, RolePrivileged) {
+		return
+	}
+	var jsonData approvalPolicyRequest
+	if err := c.BindJSON(&jsonData); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	policy := models.ApprovalPolicy{CreatedBy: username(c)}
+	if err := jsonData.apply(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, err.Error(), []any{}))
+		return
+	}
+	if result := h.DB.Create(&policy); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusCreated, response(http.StatusCreated, "", []models.ApprovalPolicy{policy}))
+}
+
+// approvalPolicyFromParam finds the policy in the url params and responds with an error when it does not
+// exist
+func (h APIHandler) approvalPolicyFromParam(c *gin.Context) (*models.ApprovalPolicy, bool) {
+	id, err := strconv.ParseUint(c.Param("policy_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, fmt.Sprintf("policy_id must be a number, got '%s'", c.Param("policy_id")), []any{}))
+		return nil, false
+	}
+	var policy models.ApprovalPolicy
+	if result := h.DB.First(&policy, id); result.Error != nil {
+		c.JSON(http.StatusNotFound, response(http.StatusNotFound, fmt.Sprintf("approval policy %d not found", id), []any{}))
+		return nil, false
+	}
+	return &policy, true
+}
+
+func (h APIHandler) updateApprovalPolicy(c *gin.Context) {
+	if !h.requireRole(c, RolePrivileged) {
+		return
+	}
+	policy, found := h.approvalPolicyFromParam(c)
+	if !found {
+		return
+	}
+	var jsonData approvalPolicyRequest
+	if err := c.BindJSON(&jsonData); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	if err := jsonData.apply(policy); err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, err.Error(), []any{}))
+		return
+	}
+	if result := h.DB.Save(policy); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", []models.ApprovalPolicy{*policy}))
+}
+
+func (h APIHandler) deleteApprovalPolicy(c *gin.Context) {
+	if !h.requireRole(c, RolePrivileged) {
+		return
+	}
+	policy, found := h.approvalPolicyFromParam(c)
+	if !found {
+		return
+	}
+	if result := h.DB.Delete(policy); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// DefaultArtifactMaxSize is used when APIHandler.ArtifactMaxSize is not set
+const DefaultArtifactMaxSize = 100 << 20
+
+// taskArtifactKind describes a kind of artifact a task may upload. Sensitive artifacts hold the values of
+// sensitive outputs and variables unmasked and only privileged users can download them.
+type taskArtifactKind struct {
+	Filename    string
+	ContentType string
+	Sensitive   bool
+}
+
+var taskArtifactKinds = map[string]taskArtifactKind{
+	"plan":      {Filename: "tfplan", ContentType: "application/octet-stream", Sensitive: true},
+	"plan-json": {Filename: "plan.json", ContentType: "application/json", Sensitive: true},
+	"lock":      {Filename: ".terraform.lock.hcl", ContentType: "text/plain; charset=utf-8"},
+	"outputs":   {Filename: "outputs.json", ContentType: "application/json", Sensitive: true},
+}
+
+func artifactStoreKey(taskPod models.TaskPod, kind string) string {
+	return fmt.Sprintf("%s/%s/%s/artifacts/%s", taskPod.Infra3ResourceUUID, taskPod.Generation, taskPod.UUID, kind)
+}
+
+// AddTaskArtifactViaTask saves the request body as an artifact of the task pod. The kind is one of
+// "plan", "plan-json", "lock" or "outputs". Send the sha256 of the body in the "X-Checksum-Sha256" header
+// to have it verified. Artifacts can't be replaced; uploading the same content again is a no-op.
+func (h APIHandler) AddTaskArtifactViaTask(c *gin.Context) {
+	token, err := taskJWT(c.Request.Header["Token"][0])
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), nil))
+		return
+	}
+	claims := taskJWTClaims(token)
+	taskPodUUID := c.Param("task_pod_uuid")
+	kind := c.Param("kind")
+
+	artifactKind, found := taskArtifactKinds[kind]
+	if !found {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, fmt.Sprintf("unknown artifact kind '%s', use 'plan', 'plan-json', 'lock' or 'outputs'", kind), []any{}))
+		return
+	}
+	if h.LogStore == nil {
+		c.JSON(http.StatusServiceUnavailable, response(http.StatusServiceUnavailable, "artifacts require a log store, set --log-store-threshold to enable it", []any{}))
+		return
+	}
+
+	var taskPod models.TaskPod
+	if result := h.DB.First(&taskPod, "uuid = ? AND infra3_resource_uuid = ?", taskPodUUID, claims["resourceUUID"]); result.Error != nil {
+		c.JSON(http.StatusNotFound, response(http.StatusNotFound, result.Error.Error(), []any{}))
+		return
+	}
+
+	maxSize := h.ArtifactMaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultArtifactMaxSize
+	}
+	b, err := io.ReadAll(io.LimitReader(c.Request.Body, maxSize+1))
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	if int64(len(b)) > maxSize {
+		c.JSON(http.StatusRequestEntityTooLarge, response(http.StatusRequestEntityTooLarge, fmt.Sprintf("artifact is larger than %d bytes", maxSize), []any{}))
+		return
+	}
+	sum := sha256.Sum256(b)
+	checksum := hex.EncodeToString(sum[:])
+	if expected := c.GetHeader("X-Checksum-Sha256"); expected != "" && !strings.EqualFold(expected, checksum) {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, fmt.Sprintf("checksum mismatch, got sha256 %s", checksum), []any{}))
+		return
+	}
+
+	var artifact models.TaskArtifact
+	result := h.DB.Where("task_pod_uuid = ? AND kind = ?", taskPod.UUID, kind).First(&artifact)
+	if result.Error == nil {
+		if artifact.SHA256 != checksum {
+			c.JSON(http.StatusConflict, response(http.StatusConflict, fmt.Sprintf("%s artifact was already uploaded with sha256 %s", kind, artifact.SHA256), []any{}))
+			return
+		}
+		c.JSON(http.StatusOK, response(http.StatusOK, "", []models.TaskArtifact{artifact}))
+		return
+	}
+	if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+
+	artifact = models.TaskArtifact{
+		TaskPodUUID:        taskPod.UUID,
+		Kind:               kind,
+		Infra3ResourceUUID: taskPod.Infra3ResourceUUID,
+		Generation:         taskPod.Generation,
+		Filename:           artifactKind.Filename,
+		ContentType:        artifactKind.ContentType,
+		Size:               uint64(len(b)),
+		SHA256:             checksum,
+		Store:              h.LogStore.Name(),
+		StoreKey:           artifactStoreKey(taskPod, kind),
+	}
+	if err := h.LogStore.Write(c, artifact.StoreKey, b); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, fmt.Sprintf("failed to write artifact to the %s log store: %s", artifact.Store, err), []any{}))
+		return
+	}
+	if result := h.DB.Create(&artifact); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+
+	// The plan json is the most accurate source of the plan summary
+	if kind == "plan-json" && isPlanTask(taskPod.TaskType) {
+		if summary, err := parsePlanJSON(b); err != nil {
+			log.Printf("ERROR summarizing plan-json artifact of %s: %s", taskPod.UUID, err)
+		} else if err := savePlanSummary(h.DB, taskPod, &summary); err != nil {
+			log.Printf("ERROR saving plan summary of %s: %s", taskPod.UUID, err)
+		} else {
+			h.evaluateAutoApproval(c, taskPod)
+		}
+	}
+
+	c.JSON(http.StatusCreated, response(http.StatusCreated, "", []models.TaskArtifact{artifact}))
+}
+
+// getTaskArtifacts lists the artifacts uploaded by the tasks of a generation
+func (h APIHandler) getTaskArtifacts(c *gin.Context) {
+	infra3ResourceUUID := c.Param("infra3_resource_uuid")
+	generation := c.Param("generation")
+	if generation == "latest" {
+		generation = h.LatestGeneration(infra3ResourceUUID)
+	}
+
+	artifacts := []models.TaskArtifact{}
+	if result := h.DB.Where("infra3_resource_uuid = ? AND generation = ?", infra3ResourceUUID, generation).Order("created_at").Find(&artifacts); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", artifacts))
+}
+
+// downloadTaskArtifact sends the artifact as an attachment. The checksum is verified before the artifact
+// is sent and is returned in the "X-Checksum-Sha256" header. Sensitive artifacts are sent as they were
+// uploaded, so they require the privileged role; masked outputs are available from getResourceOutputs.
+func (h APIHandler) downloadTaskArtifact(c *gin.Context) {
+	infra3ResourceUUID := c.Param("infra3_resource_uuid")
+	taskPodUUID := c.Param("task_pod_uuid")
+	kind := c.Param("kind")
+
+	if taskArtifactKinds[kind].Sensitive {
+		if !h.requireRole(c, RolePrivileged) {
+			return
+		}
+	} else if !h.requireRole(c, RoleArtifactReader, RolePrivileged) {
+		return
+	}
+
+	var artifact models.TaskArtifact
+	if result := h.DB.First(&artifact, "infra3_resource_uuid = ? AND task_pod_uuid = ? AND kind = ?", infra3ResourceUUID, taskPodUUID, kind); result.Error != nil {
+		c.JSON(http.StatusNotFound, response(http.StatusNotFound, result.Error.Error(), []any{}))
+		return
+	}
+	if h.LogStore == nil || h.LogStore.Name() != artifact.Store {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, fmt.Sprintf("artifact was saved to the %s log store which is not configured", artifact.Store), []any{}))
+		return
+	}
+	b, err := h.LogStore.Read(c, artifact.StoreKey)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	sum := sha256.Sum256(b)
+	if hex.EncodeToString(sum[:]) != artifact.SHA256 {
+		c.JSON(http.StatusInternalServerError, response(http.StatusInternalServerError, fmt.Sprintf("%s artifact of %s does not match its sha256 %s", kind, taskPodUUID, artifact.SHA256), []any{}))
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s"`, taskPodUUID, artifact.Filename))
+	c.Header("X-Checksum-Sha256", artifact.SHA256)
+	c.Data(http.StatusOK, artifact.ContentType, b)
+}
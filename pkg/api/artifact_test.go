@@ -0,0 +1,40 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestDownloadSensitiveArtifact checks that artifacts holding unmasked sensitive values can't be
+// downloaded without the privileged role. The role is checked before the artifact is looked up.
+func TestDownloadSensitiveArtifact(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := APIHandler{UserRoles: UserRoles{"alice": {RoleArtifactReader}, "bob": {RoleStateReader}}}
+
+	for _, tc := range []struct {
+		user string
+		kind string
+	}{
+		{"alice", "outputs"},
+		{"alice", "plan"},
+		{"alice", "plan-json"},
+		{"bob", "lock"},
+		{"", "outputs"},
+	} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		c.Params = gin.Params{{Key: "infra3_resource_uuid", Value: "r"}, {Key: "task_pod_uuid", Value: "t"}, {Key: "kind", Value: tc.kind}}
+		if tc.user != "" {
+			c.Set(usernameContextKey, tc.user)
+		}
+
+		h.downloadTaskArtifact(c)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%q downloading %s: got status %d, want %d", tc.user, tc.kind, w.Code, http.StatusForbidden)
+		}
+	}
+}
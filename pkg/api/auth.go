@@ -56,11 +56,16 @@ func validateJwt(c *gin.Context) {
 		unauthorized(c, err.Error())
 	}
 
-	_, err = doValidation(userProvidedJWT)
+	token, err := doValidation(userProvidedJWT)
 	if err != nil {
 		unauthorized(c, err.Error())
 		return
 	}
+	if claims, ok := token.Claims.(jwt.MapClaims); ok {
+		if username, ok := claims["username"].(string); ok {
+			c.Set(usernameContextKey, username)
+		}
+	}
 }
 
 func doValidation(jwtToken string) (*jwt.Token, error) {
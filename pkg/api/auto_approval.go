@@ -0,0 +1,327 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+	"github.com/galleybytes/infrakube-stella/pkg/util"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// autoApprover is the approver recorded on approvals written by auto-approval rules
+const autoApprover = "system:auto-approval"
+
+// resourceTypeOfAddress returns the resource type of a plan address, eg "aws_instance" for
+// `module.app.aws_instance.web["a.b"]`
+func resourceTypeOfAddress(address string) string {
+	// Drop index keys first since they may contain dots
+	var b strings.Builder
+	depth, quoted := 0, false
+	for _, r := range address {
+		switch {
+		case quoted:
+			quoted = r != '"'
+		case r == '"' && depth > 0:
+			quoted = true
+		case r == '[':
+			depth++
+		case r == ']':
+			depth--
+		case depth == 0:
+			b.WriteRune(r)
+		}
+	}
+	parts := strings.Split(b.String(), ".")
+	i := 0
+	for i+1 < len(parts) && parts[i] == "module" {
+		i += 2
+	}
+	if i < len(parts) && parts[i] == "data" {
+		i++
+	}
+	if i >= len(parts) {
+		return ""
+	}
+	return parts[i]
+}
+
+// matchAutoApprovalRule reports if the rule approves the plan of a resource in the cluster and namespace.
+// The reason lists the conditions that matched.
+func matchAutoApprovalRule(rule models.AutoApprovalRule, clusterName, namespace string, summary models.PlanSummary) (bool, string) {
+	if matched, _ := path.Match(rule.Cluster, clusterName); !matched {
+		return false, ""
+	}
+	if matched, _ := path.Match(rule.Namespace, namespace); !matched {
+		return false, ""
+	}
+	changes := summary.Add + summary.Change + summary.Destroy
+	if changes == 0 && !summary.NoChanges {
+		// The plan did not report its totals, it may not have finished
+		return false, ""
+	}
+
+	reasons := []string{fmt.Sprintf("cluster '%s' and namespace '%s' matched", clusterName, namespace)}
+	if rule.NoDestroy {
+		if summary.Destroy > 0 || summary.Replace > 0 {
+			return false, ""
+		}
+		reasons = append(reasons, "nothing to destroy")
+	}
+	if rule.MaxChanges != nil {
+		if changes > *rule.MaxChanges {
+			return false, ""
+		}
+		reasons = append(reasons, fmt.Sprintf("%d change(s) of at most %d", changes, *rule.MaxChanges))
+	}
+	if len(rule.ResourceTypes) > 0 {
+		addresses := []string{}
+		for _, list := range [][]string{summary.ToAdd, summary.ToChange, summary.ToReplace, summary.ToDestroy} {
+			addresses = append(addresses, list...)
+		}
+		if len(addresses) < summary.Add+summary.Change+summary.Destroy-summary.Replace {
+			// Some changes have no address, so their type can't be checked
+			return false, ""
+		}
+		types := []string{}
+		for _, address := range addresses {
+			resourceType := resourceTypeOfAddress(address)
+			allowed := false
+			for _, pattern := range rule.ResourceTypes {
+				if matched, _ := path.Match(pattern, resourceType); matched {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				return false, ""
+			}
+			if !util.Contains(types, resourceType) {
+				types = append(types, resourceType)
+			}
+		}
+		if len(types) > 0 {
+			reasons = append(reasons, "resource types "+strings.Join(types, ", ")+" are allowed")
+		}
+	}
+	return true, fmt.Sprintf("auto-approved by rule '%s': %s", rule.Name, strings.Join(reasons, ", "))
+}
+
+// evaluateAutoApproval checks the plan against the auto-approval rules once the task saved the summary
+// of its plan json
+func (h APIHandler) evaluateAutoApproval(ctx context.Context, taskPod models.TaskPod) {
+	if _, err := h.autoApprove(ctx, taskPod); err != nil {
+		log.Printf("ERROR evaluating auto-approval rules for plan %s: %s", taskPod.UUID, err)
+	}
+}
+
+// autoApprove writes a system approval for the plan when an enabled rule matches its summary. Rules are
+// tried in the order they were created. It returns nil when no rule matched.
+func (h APIHandler) autoApprove(ctx context.Context, taskPod models.TaskPod) (*models.Approval, error) {
+	var rules []models.AutoApprovalRule
+	if result := h.DB.Where("enabled").Order("id").Find(&rules); result.Error != nil || len(rules) == 0 {
+		return nil, result.Error
+	}
+	if superseded, err := planSuperseded(h.DB, taskPod); err != nil || superseded {
+		return nil, err
+	}
+	// Drift checks must never apply, their plans are decided by the drift check or an approver
+	if drift, err := h.driftPlan(ctx, taskPod); err != nil || drift {
+		return nil, err
+	}
+	// Policies that need more than one approver or approvers of a group are left to humans
+	policy, err := h.taskPodApprovalPolicy(h.DB, taskPod)
+	if err != nil || policy.Required > 1 || policy.Group != "" {
+		return nil, err
+	}
+	// Summaries parsed from the log can be forged by output the plan prints, only the plan json uploaded by
+	// the task is trusted
+	summary, err := planSummary(ctx, h.DB, h.LogStore, taskPod)
+	if err != nil || summary == nil || summary.Source != planSummarySourceJSON {
+		return nil, err
+	}
+	var infra3Resource models.Infra3Resource
+	if result := h.DB.First(&infra3Resource, "uuid = ?", taskPod.Infra3ResourceUUID); result.Error != nil {
+		return nil, result.Error
+	}
+	clusterName := getClusterName(infra3Resource.ClusterID, h.DB)
+
+	for _, rule := range rules {
+		matched, reason := matchAutoApprovalRule(rule, clusterName, infra3Resource.Namespace, *summary)
+		if !matched {
+			continue
+		}
+		ruleID := rule.ID
+		approval := models.Approval{
+			IsApproved:         true,
+			TaskPodUUID:        taskPod.UUID,
+			Approver:           autoApprover,
+			Comment:            reason,
+			ExpiresAt:          h.approvalExpiresAt(policy, taskPod),
+			AutoApprovalRuleID: &ruleID,
+		}
+		err = h.DB.Transaction(func(tx *gorm.DB) error {
+			if result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&models.TaskPod{}, "uuid = ?", taskPod.UUID); result.Error != nil {
+				return result.Error
+			}
+			var approvals int64
+			if result := tx.Model(&models.Approval{}).Where("task_pod_uuid = ?", taskPod.UUID).Count(&approvals); result.Error != nil {
+				return result.Error
+			}
+			if approvals > 0 {
+				return errApprovalDecided
+			}
+			return tx.Create(&approval).Error
+		})
+		if errors.Is(err, errApprovalDecided) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Plan %s of '%s/%s' %s", taskPod.UUID, infra3Resource.Namespace, infra3Resource.Name, reason)
+		h.publishApprovalDecided(taskPod, approval)
+		return &approval, nil
+	}
+	return nil, nil
+}
+
+// autoApprovalRuleRequest is the body of create and update auto-approval rule requests
+type autoApprovalRuleRequest struct {
+	Name          string   `json:"name"`
+	Enabled       *bool    `json:"enabled"`
+	Cluster       string   `json:"cluster"`
+	Namespace     string   `json:"namespace"`
+	NoDestroy     bool     `json:"no_destroy"`
+	MaxChanges    *int     `json:"max_changes"`
+	ResourceTypes []string `json:"resource_types"`
+}
+
+// apply validates the request and sets it on the rule. Empty patterns match everything and rules are
+// enabled unless "enabled" is false.
+func (r autoApprovalRuleRequest) apply(rule *models.AutoApprovalRule) error {
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if r.Cluster == "" {
+		r.Cluster = "*"
+	}
+	if r.Namespace == "" {
+		r.Namespace = "*"
+	}
+	for _, pattern := range append([]string{r.Cluster, r.Namespace}, r.ResourceTypes...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("pattern '%s' is invalid: %s", pattern, err)
+		}
+	}
+	if r.MaxChanges != nil && *r.MaxChanges < 0 {
+		return fmt.Errorf("max_changes can't be negative")
+	}
+	if !r.NoDestroy && r.MaxChanges == nil && len(r.ResourceTypes) == 0 {
+		return fmt.Errorf("rule must set at least one of no_destroy, max_changes or resource_types")
+	}
+	rule.Name = r.Name
+	rule.Enabled = r.Enabled == nil || *r.Enabled
+	rule.Cluster = r.Cluster
+	rule.Namespace = r.Namespace
+	rule.NoDestroy = r.NoDestroy
+	rule.MaxChanges = r.MaxChanges
+	rule.ResourceTypes = r.ResourceTypes
+	return nil
+}
+
+func (h APIHandler) getAutoApprovalRules(c *gin.Context) {
+	rules := []models.AutoApprovalRule{}
+	if result := h.DB.Order("id").Find(&rules); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", rules))
+}
+
+// addAutoApprovalRule creates a rule, eg {"name": "dev-no-destroy", "cluster": "dev-*", "no_destroy": true,
+// "max_changes": 5}. Only privileged users can manage rules.
+func (h APIHandler) addAutoApprovalRule(c *gin.Context) {
+	if !h.requireRole(c, RolePrivileged) {
+		return
+	}
+	var jsonData autoApprovalRuleRequest
+	if err := c.BindJSON(&jsonData); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	rule := models.AutoApprovalRule{CreatedBy: username(c), UpdatedBy: username(c)}
+	if err := jsonData.apply(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, err.Error(), []any{}))
+		return
+	}
+	if result := h.DB.Create(&rule); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusCreated, response(http.StatusCreated, "", []models.AutoApprovalRule{rule}))
+}
+
+// autoApprovalRuleFromParam finds the rule in the url params and responds with an error when it does not
+// exist
+func (h APIHandler) autoApprovalRuleFromParam(c *gin.Context) (*models.AutoApprovalRule, bool) {
+	id, err := strconv.ParseUint(c.Param("rule_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, fmt.Sprintf("rule_id must be a number, got '%s'", c.Param("rule_id")), []any{}))
+		return nil, false
+	}
+	var rule models.AutoApprovalRule
+	if result := h.DB.First(&rule, id); result.Error != nil {
+		c.JSON(http.StatusNotFound, response(http.StatusNotFound, fmt.Sprintf("auto-approval rule %d not found", id), []any{}))
+		return nil, false
+	}
+	return &rule, true
+}
+
+func (h APIHandler) updateAutoApprovalRule(c *gin.Context) {
+	if !h.requireRole(c, RolePrivileged) {
+		return
+	}
+	rule, found := h.autoApprovalRuleFromParam(c)
+	if !found {
+		return
+	}
+	var jsonData autoApprovalRuleRequest
+	if err := c.BindJSON(&jsonData); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	if err := jsonData.apply(rule); err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, err.Error(), []any{}))
+		return
+	}
+	rule.UpdatedBy = username(c)
+	if result := h.DB.Save(rule); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", []models.AutoApprovalRule{*rule}))
+}
+
+func (h APIHandler) deleteAutoApprovalRule(c *gin.Context) {
+	if !h.requireRole(c, RolePrivileged) {
+		return
+	}
+	rule, found := h.autoApprovalRuleFromParam(c)
+	if !found {
+		return
+	}
+	if result := h.DB.Delete(rule); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
@@ -0,0 +1,410 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// DefaultBulkConcurrency is the number of resources a bulk job acts on at once unless the job asks
+	// for another concurrency
+	DefaultBulkConcurrency = 5
+
+	// maxBulkConcurrency keeps a single bulk job from flooding the vclusters
+	maxBulkConcurrency = 20
+
+	// bulkJobLease keeps other replicas from running a job while it runs. The lease is renewed every
+	// bulkJobLease/3 until the job completes.
+	bulkJobLease = time.Minute
+
+	// bulkJobInterval is how often jobs left behind by a stopped replica are looked for
+	bulkJobInterval = 30 * time.Second
+
+	bulkActionRerun   = "rerun"
+	bulkActionApprove = "approve"
+	bulkActionDeny    = "deny"
+
+	bulkStatusPending   = "pending"
+	bulkStatusRunning   = "running"
+	bulkStatusCompleted = "completed"
+	bulkStatusSucceeded = "succeeded"
+	bulkStatusFailed    = "failed"
+	bulkStatusSkipped   = "skipped"
+)
+
+// BulkResource is a resource matched by a bulk job filter
+type BulkResource struct {
+	UUID              string `json:"uuid"`
+	ClusterName       string `json:"cluster_name"`
+	Namespace         string `json:"namespace"`
+	Name              string `json:"name"`
+	CurrentState      string `json:"current_state"`
+	CurrentGeneration string `json:"current_generation"`
+	Labels            string `json:"-"`
+}
+
+// validateBulkFilter refuses filters that would select every resource
+func validateBulkFilter(filter models.BulkJobFilter) error {
+	if filter.Cluster == "" && filter.Namespace == "" && filter.State == "" && len(filter.Labels) == 0 {
+		return fmt.Errorf("filter must select by at least one of cluster, namespace, state or labels")
+	}
+	if filter.Namespace != "" {
+		if _, err := path.Match(filter.Namespace, ""); err != nil {
+			return fmt.Errorf("namespace pattern '%s' is invalid: %s", filter.Namespace, err)
+		}
+	}
+	return nil
+}
+
+// bulkResources returns the resources selected by the filter. Labels are matched against the resource
+// spec of the current generation.
+func bulkResources(db *gorm.DB, filter models.BulkJobFilter) ([]BulkResource, error) {
+	query := db.Table("infra3_resources").
+		Select(`
+			infra3_resources.uuid,
+			clusters.name AS cluster_name,
+			infra3_resources.namespace,
+			infra3_resources.name,
+			infra3_resources.current_state,
+			infra3_resources.current_generation,
+			infra3_resource_specs.labels
+		`).
+		Joins("JOIN clusters ON infra3_resources.cluster_id = clusters.id").
+		Joins("LEFT JOIN infra3_resource_specs ON infra3_resource_specs.infra3_resource_uuid = infra3_resources.uuid AND infra3_resource_specs.generation = infra3_resources.current_generation AND infra3_resource_specs.deleted_at IS NULL").
+		Where("infra3_resources.deleted_at IS NULL").
+		Order("clusters.name, infra3_resources.namespace, infra3_resources.name")
+	if filter.Cluster != "" {
+		query = query.Where("clusters.name = ?", filter.Cluster)
+	}
+	if filter.State != "" {
+		query = query.Where("infra3_resources.current_state = ?", filter.State)
+	}
+
+	var candidates []BulkResource
+	if result := query.Scan(&candidates); result.Error != nil {
+		return nil, result.Error
+	}
+
+	resources := []BulkResource{}
+	for _, resource := range candidates {
+		if filter.Namespace != "" {
+			if matched, _ := path.Match(filter.Namespace, resource.Namespace); !matched {
+				continue
+			}
+		}
+		if len(filter.Labels) > 0 {
+			labels := map[string]string{}
+			json.Unmarshal([]byte(resource.Labels), &labels)
+			matched := true
+			for key, value := range filter.Labels {
+				if labels[key] != value {
+					matched = false
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+		resources = append(resources, resource)
+	}
+	return resources, nil
+}
+
+// setLatestApproval votes as the approver on the plan waiting for approval in the current generation. An
+// approval that was already given is not changed.
+func (h APIHandler) setLatestApproval(resource BulkResource, approver string, isApproved bool) (string, string, error) {
+	var podUUID string
+	if result := requiredApprovalPodUUID(h.DB, resource.UUID, resource.CurrentGeneration).Scan(&podUUID); result.Error != nil {
+		return "", "", result.Error
+	}
+	if podUUID == "" {
+		return bulkStatusSkipped, "no plan in the current generation", nil
+	}
+	quorum, err := h.castApprovalVote(podUUID, models.ApprovalVote{Approver: approver, IsApproved: isApproved})
+	if errors.Is(err, errApprovalDecided) {
+		return bulkStatusSkipped, err.Error(), nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if !quorum.Decided {
+		return bulkStatusSucceeded, fmt.Sprintf("plan %s is_approved=%t, %d of %d approvals", podUUID, isApproved, quorum.Approvals, quorum.Required), nil
+	}
+	return bulkStatusSucceeded, fmt.Sprintf("plan %s is_approved=%t", podUUID, isApproved), nil
+}
+
+// runBulkJobItem runs the action of the job on a single resource and saves the result
+func (h APIHandler) runBulkJobItem(ctx context.Context, job models.BulkJob, item models.BulkJobItem) {
+	h.DB.Model(&item).Update("status", bulkStatusRunning)
+
+	// The generation is read when the item runs since a resumed job may run long after it was created
+	resource := BulkResource{
+		UUID:        item.Infra3ResourceUUID,
+		ClusterName: item.ClusterName,
+		Namespace:   item.Namespace,
+		Name:        item.Name,
+	}
+	var status, message string
+	err := h.DB.Model(&models.Infra3Resource{}).Where("uuid = ?", item.Infra3ResourceUUID).Select("current_generation").Scan(&resource.CurrentGeneration).Error
+	if err == nil {
+		switch job.Action {
+		case bulkActionRerun:
+			var changeCause string
+			changeCause, err = rerun(h.clientset, resource.ClusterName, resource.Namespace, resource.Name, fmt.Sprintf("bulk-job-%d", job.ID), ctx)
+			status, message = bulkStatusSucceeded, changeCause
+		case bulkActionApprove, bulkActionDeny:
+			status, message, err = h.setLatestApproval(resource, job.CreatedBy, job.Action == bulkActionApprove)
+		}
+	}
+	if err != nil {
+		status, message = bulkStatusFailed, err.Error()
+	}
+
+	finishedAt := time.Now().UTC()
+	h.DB.Model(&item).Updates(map[string]any{"status": status, "message": message, "finished_at": finishedAt})
+	// The succeeded, failed and skipped counters are named after the item status
+	h.DB.Model(&models.BulkJob{}).Where("id = ?", job.ID).Update(status, gorm.Expr(status+" + 1"))
+}
+
+// claimBulkJob takes the lease of a running job whose lease passed. Only the replica whose update matched
+// gets to run the job.
+func (h APIHandler) claimBulkJob(jobID uint, now time.Time) (bool, error) {
+	result := h.DB.Model(&models.BulkJob{}).
+		Where("id = ? AND status = ? AND (lease_until IS NULL OR lease_until <= ?)", jobID, bulkStatusRunning, now).
+		Update("lease_until", now.Add(bulkJobLease))
+	return result.RowsAffected == 1, result.Error
+}
+
+// runBulkJob acts on the pending items of a job whose lease is held, with at most job.Concurrency items
+// at once. Items that were running when the previous holder of the lease stopped are failed rather than
+// run again, since a rerun may already have been triggered.
+func (h APIHandler) runBulkJob(ctx context.Context, job models.BulkJob) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(bulkJobLease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				h.DB.Model(&models.BulkJob{}).Where("id = ?", job.ID).Update("lease_until", time.Now().Add(bulkJobLease))
+			}
+		}
+	}()
+
+	finishedAt := time.Now().UTC()
+	result := h.DB.Model(&models.BulkJobItem{}).
+		Where("bulk_job_id = ? AND status = ?", job.ID, bulkStatusRunning).
+		Updates(map[string]any{"status": bulkStatusFailed, "message": "interrupted, the replica running the job stopped", "finished_at": finishedAt})
+	if result.Error != nil {
+		log.Printf("ERROR failing interrupted items of bulk job %d: %s", job.ID, result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		h.DB.Model(&models.BulkJob{}).Where("id = ?", job.ID).Update(bulkStatusFailed, gorm.Expr(bulkStatusFailed+" + ?", result.RowsAffected))
+	}
+
+	var items []models.BulkJobItem
+	if result := h.DB.Where("bulk_job_id = ? AND status = ?", job.ID, bulkStatusPending).Order("id").Find(&items); result.Error != nil {
+		log.Printf("ERROR reading items of bulk job %d: %s", job.ID, result.Error)
+		return
+	}
+	semaphore := make(chan struct{}, job.Concurrency)
+	var wg sync.WaitGroup
+	for _, item := range items {
+		if ctx.Err() != nil {
+			break
+		}
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(item models.BulkJobItem) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			h.runBulkJobItem(ctx, job, item)
+		}(item)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	finishedAt = time.Now().UTC()
+	if result := h.DB.Model(&models.BulkJob{}).Where("id = ?", job.ID).Updates(map[string]any{"status": bulkStatusCompleted, "finished_at": finishedAt, "lease_until": nil}); result.Error != nil {
+		log.Printf("ERROR completing bulk job %d: %s", job.ID, result.Error)
+	}
+}
+
+// RunBulkJobs resumes running bulk jobs whose replica stopped, starting right away so jobs interrupted by
+// a restart continue, until the context is done
+func (h APIHandler) RunBulkJobs(ctx context.Context) {
+	if h.DB == nil {
+		return
+	}
+
+	ticker := time.NewTicker(bulkJobInterval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		var jobs []models.BulkJob
+		if result := h.DB.Where("status = ? AND (lease_until IS NULL OR lease_until <= ?)", bulkStatusRunning, now).Find(&jobs); result.Error != nil {
+			log.Printf("ERROR selecting orphaned bulk jobs: %s", result.Error)
+		}
+		for _, job := range jobs {
+			claimed, err := h.claimBulkJob(job.ID, now)
+			if err != nil {
+				log.Printf("ERROR claiming bulk job %d: %s", job.ID, err)
+				continue
+			}
+			if claimed {
+				log.Printf("Resuming bulk job %d", job.ID)
+				go h.runBulkJob(ctx, job)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// previewBulkJob returns the resources a bulk job with the filter in the body would act on
+func (h APIHandler) previewBulkJob(c *gin.Context) {
+	var filter models.BulkJobFilter
+	if err := c.BindJSON(&filter); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	if err := validateBulkFilter(filter); err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, err.Error(), []any{}))
+		return
+	}
+	resources, err := bulkResources(h.DB, filter)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, fmt.Sprintf("%d resource(s) matched", len(resources)), resources))
+}
+
+// addBulkJob starts a bulk job and returns it right away. Send {"action": "rerun", "filter": {...}} and
+// optionally "concurrency". Actions are "rerun", "approve" and "deny". Poll the job for progress.
+func (h APIHandler) addBulkJob(c *gin.Context) {
+	jsonData := struct {
+		Action      string               `json:"action"`
+		Filter      models.BulkJobFilter `json:"filter"`
+		Concurrency int                  `json:"concurrency"`
+	}{}
+	if err := c.BindJSON(&jsonData); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	switch jsonData.Action {
+	case bulkActionRerun, bulkActionApprove, bulkActionDeny:
+	default:
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, fmt.Sprintf("unknown action '%s', use 'rerun', 'approve' or 'deny'", jsonData.Action), []any{}))
+		return
+	}
+	if err := validateBulkFilter(jsonData.Filter); err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, err.Error(), []any{}))
+		return
+	}
+	if jsonData.Concurrency <= 0 {
+		jsonData.Concurrency = DefaultBulkConcurrency
+	}
+	if jsonData.Concurrency > maxBulkConcurrency {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, fmt.Sprintf("concurrency must not be more than %d", maxBulkConcurrency), []any{}))
+		return
+	}
+
+	resources, err := bulkResources(h.DB, jsonData.Filter)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	if len(resources) == 0 {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, "filter did not match any resources", []any{}))
+		return
+	}
+
+	leaseUntil := time.Now().Add(bulkJobLease)
+	job := models.BulkJob{
+		Action:      jsonData.Action,
+		Filter:      jsonData.Filter,
+		Concurrency: jsonData.Concurrency,
+		Status:      bulkStatusRunning,
+		Total:       len(resources),
+		CreatedBy:   username(c),
+		LeaseUntil:  &leaseUntil,
+	}
+	for _, resource := range resources {
+		job.Items = append(job.Items, models.BulkJobItem{
+			Infra3ResourceUUID: resource.UUID,
+			ClusterName:        resource.ClusterName,
+			Namespace:          resource.Namespace,
+			Name:               resource.Name,
+			Status:             bulkStatusPending,
+		})
+	}
+	if result := h.DB.Create(&job); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+
+	go h.runBulkJob(context.Background(), job)
+	c.JSON(http.StatusAccepted, response(http.StatusAccepted, "", []models.BulkJob{job}))
+}
+
+// getBulkJobs lists bulk jobs without their items, newest first
+func (h APIHandler) getBulkJobs(c *gin.Context) {
+	jobs := []models.BulkJob{}
+	if result := h.DB.Order("created_at DESC").Limit(100).Find(&jobs); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", jobs))
+}
+
+// getBulkJob returns the progress of a bulk job with the result of every item. Use the "status" query
+// param to only return items with the status, eg "failed".
+func (h APIHandler) getBulkJob(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("job_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, fmt.Sprintf("job_id must be a number, got '%s'", c.Param("job_id")), []any{}))
+		return
+	}
+	items := func(db *gorm.DB) *gorm.DB {
+		if status := c.Query("status"); status != "" {
+			db = db.Where("status = ?", status)
+		}
+		return db.Order("id")
+	}
+
+	var job models.BulkJob
+	result := h.DB.Preload("Items", items).First(&job, id)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, response(http.StatusNotFound, fmt.Sprintf("bulk job %d not found", id), []any{}))
+		return
+	}
+	if result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", []models.BulkJob{job}))
+}
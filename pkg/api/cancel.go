@@ -0,0 +1,186 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+	infra3v1 "github.com/galleybytes/infrakube/pkg/apis/infra3/v1"
+	infra3clientset "github.com/galleybytes/infrakube/pkg/client/clientset/versioned"
+	"github.com/gin-gonic/gin"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// cancelAnnotation is set on the Tf in the vcluster to signal the controller to stop the workflow. Its value
+// is the workflow it stops, so a new generation or a rerun is not canceled by it.
+const cancelAnnotation = "infra3.galleybytes.com/cancel"
+
+// cancelWorkflow stops the running workflow of a resource. The Tf is annotated so the controller stops the
+// workflow instead of retrying the task, then the pod of the current task is deleted. The resource is
+// marked canceled until a new workflow starts. Send {"reason": "..."} to record why the workflow was
+// canceled.
+func (h APIHandler) cancelWorkflow(c *gin.Context) {
+	clusterName := c.Param("cluster_name")
+	clusterID := h.getClusterID(clusterName)
+	if clusterID == 0 {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, fmt.Sprintf("cluster_name '%s' not found", clusterName), nil))
+		return
+	}
+	name := c.Param("name")
+	namespace := c.Param("namespace")
+
+	jsonData := struct {
+		Reason string `json:"reason"`
+	}{}
+	if err := c.ShouldBindJSON(&jsonData); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+
+	var infra3Resource models.Infra3Resource
+	if result := workflow(h.DB, clusterID, namespace, name).Scan(&infra3Resource); result.Error != nil || infra3Resource.UUID == "" {
+		c.JSON(http.StatusNotFound, response(http.StatusNotFound, fmt.Sprintf("resource '%s/%s' not found", namespace, name), []any{}))
+		return
+	}
+
+	config, err := getVclusterConfig(h.clientset, "internal", clusterName)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	tfClient := infra3clientset.NewForConfigOrDie(config).Infra3V1().Tfs(namespace)
+	tf, err := tfClient.Get(c, name, metav1.GetOptions{})
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	if !IsWorkflowRunning(tf.Status) || tfCanceled(tf) {
+		c.JSON(http.StatusConflict, response(http.StatusConflict, fmt.Sprintf("tf resource '%s/%s' is not running", namespace, name), []any{}))
+		return
+	}
+
+	// Find the task pods the same way LastTaskLog does and only stop the pod of the current task.
+	// Debug and state pods are left alone.
+	clientset := kubernetes.NewForConfigOrDie(config)
+	labelSelector := "tfs.infra3.galleybytes.com/resourceName=" + name
+	pods, err := clientset.CoreV1().Pods(namespace).List(c, metav1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	taskType := tf.Status.Stage.TaskType.String()
+	activePods := []string{}
+	for _, pod := range pods.Items {
+		if pod.Labels["tfs.infra3.galleybytes.com/generation"] != fmt.Sprint(tf.Generation) {
+			continue
+		}
+		if instance := pod.Labels["app.kubernetes.io/instance"]; instance == "debug" || instance == "state" {
+			continue
+		}
+		if pod.Status.Phase != corev1.PodRunning && pod.Status.Phase != corev1.PodPending {
+			continue
+		}
+		if podTaskType(pod) != taskType {
+			continue
+		}
+		activePods = append(activePods, pod.Name)
+	}
+	if len(activePods) == 0 {
+		c.JSON(http.StatusConflict, response(http.StatusConflict, fmt.Sprintf("no active %s task pod of tf resource '%s/%s' found", taskType, namespace, name), []any{}))
+		return
+	}
+
+	// Signal the controller before deleting the pods so it doesn't recreate them
+	patch, _ := json.Marshal(map[string]any{"metadata": map[string]any{"annotations": map[string]string{cancelAnnotation: tfWorkflow(tf)}}})
+	if _, err := tfClient.Patch(c, name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, fmt.Sprintf("failed to signal tf resource '%s/%s' to stop: %s", namespace, name, err), []any{}))
+		return
+	}
+	stoppedPods := []string{}
+	for _, podName := range activePods {
+		if err := clientset.CoreV1().Pods(namespace).Delete(c, podName, metav1.DeleteOptions{}); err != nil && !kerrors.IsNotFound(err) {
+			c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, fmt.Sprintf("failed to delete pod '%s': %s", podName, err), []any{}))
+			return
+		}
+		stoppedPods = append(stoppedPods, podName)
+	}
+
+	cancellation := models.Cancellation{
+		Infra3ResourceUUID: infra3Resource.UUID,
+		Generation:         infra3Resource.CurrentGeneration,
+		CanceledBy:         username(c),
+		Reason:             jsonData.Reason,
+		TaskType:           taskType,
+		StoppedPods:        stoppedPods,
+	}
+	if result := h.DB.Create(&cancellation); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	if result := h.DB.Model(&models.Infra3Resource{}).Where("uuid = ?", infra3Resource.UUID).Update("current_state", models.Canceled); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	h.flushTaskLogs(c, infra3Resource.UUID, "")
+
+	c.JSON(http.StatusOK, response(http.StatusOK, "", []models.Cancellation{cancellation}))
+}
+
+// tfWorkflow identifies the workflow the Tf runs. A new generation or a rerun, which sets a new
+// change-cause, starts a new workflow.
+func tfWorkflow(tf *infra3v1.Tf) string {
+	return fmt.Sprintf("%d/%s", tf.Generation, tf.Labels["kubernetes.io/change-cause"])
+}
+
+// tfCanceled reports if the current workflow of the Tf was canceled
+func tfCanceled(tf *infra3v1.Tf) bool {
+	value, found := tf.Annotations[cancelAnnotation]
+	return found && value == tfWorkflow(tf)
+}
+
+// podTaskType returns the task a pod runs from its I3_TASK env
+func podTaskType(pod corev1.Pod) string {
+	for _, container := range pod.Spec.Containers {
+		for _, envVar := range container.Env {
+			if envVar.Name == "I3_TASK" {
+				return envVar.Value
+			}
+		}
+	}
+	return ""
+}
+
+// workflowCanceled reports if the resource is marked canceled and its Tf still runs the canceled workflow.
+// Status reports of the canceled workflow must not replace the canceled state. Only resources marked
+// canceled look up their Tf.
+func (h APIHandler) workflowCanceled(ctx context.Context, infra3Resource models.Infra3Resource) bool {
+	if infra3Resource.CurrentState != models.Canceled {
+		return false
+	}
+	tf, err := getResource(h.clientset, getClusterName(infra3Resource.ClusterID, h.DB), infra3Resource.Namespace, infra3Resource.Name, ctx)
+	if err != nil {
+		// Keep the canceled state until the workflow of the Tf can be told
+		return true
+	}
+	return tfCanceled(tf)
+}
+
+// getCancellations lists who canceled the workflows of a resource, newest first
+func (h APIHandler) getCancellations(c *gin.Context) {
+	infra3ResourceUUID := c.Param("infra3_resource_uuid")
+
+	cancellations := []models.Cancellation{}
+	if result := h.DB.Where("infra3_resource_uuid = ?", infra3ResourceUUID).Order("created_at DESC").Find(&cancellations); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", cancellations))
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	deliveryMaxAttempts = 8
+
+	// deliveryRetryBackoff doubles after every failed attempt up to deliveryMaxRetryBackoff
+	deliveryRetryBackoff    = 10 * time.Second
+	deliveryMaxRetryBackoff = time.Hour
+
+	// deliveryBatchSize limits how many due deliveries of a queue are attempted per run
+	deliveryBatchSize = 100
+)
+
+// errUndeliverable is returned when a delivery can't be sent however often it is retried
+var errUndeliverable = errors.New("undeliverable")
+
+// deliveryStatuses are the statuses of the rows of a delivery queue
+type deliveryStatuses struct {
+	pending   string
+	delivered string
+	failed    string
+}
+
+// deliveryQueue is a table of outgoing messages, eg webhook deliveries or notifications. Rows are claimed
+// before they are sent so no one else sends them at the same time, and failed attempts are retried with an
+// exponential backoff until the row runs out of attempts.
+type deliveryQueue struct {
+	// name is used in log messages, eg "webhook delivery"
+	name     string
+	model    any
+	statuses deliveryStatuses
+
+	// lease keeps other replicas from sending a row while it is being sent. It must outlast send.
+	lease time.Duration
+
+	// send attempts the claimed row. It returns the attempts of the row, including this one, the columns
+	// of the attempt to save and the error of the attempt. A nil updates means the row could not be read,
+	// it is retried once the lease ends.
+	send func(ctx context.Context, id uint) (int, map[string]any, error)
+}
+
+// deliveryRetryAfter is how long to wait before the next attempt after a failed attempt
+func deliveryRetryAfter(attempts int) time.Duration {
+	backoff := deliveryRetryBackoff
+	for i := 1; i < attempts && backoff < deliveryMaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, deliveryMaxRetryBackoff)
+}
+
+// outcome returns the status of a row after its attempts-th attempt ended with err and when a pending row
+// is attempted next
+func (s deliveryStatuses) outcome(attempts int, err error, now time.Time) (string, time.Time) {
+	switch {
+	case err == nil:
+		return s.delivered, time.Time{}
+	case errors.Is(err, errUndeliverable) || attempts >= deliveryMaxAttempts:
+		return s.failed, time.Time{}
+	default:
+		return s.pending, now.Add(deliveryRetryAfter(attempts))
+	}
+}
+
+// attemptDelivery sends the row of the queue when it is due and records the outcome
+func (h APIHandler) attemptDelivery(ctx context.Context, queue deliveryQueue, id uint) {
+	// Claim the row so no one else sends it at the same time
+	now := time.Now()
+	result := h.DB.Model(queue.model).
+		Where("id = ? AND status = ? AND next_attempt_at <= ?", id, queue.statuses.pending, now).
+		Updates(map[string]any{"next_attempt_at": now.Add(queue.lease), "attempts": gorm.Expr("attempts + 1")})
+	if result.Error != nil {
+		log.Printf("ERROR claiming %s %d: %s", queue.name, id, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		return
+	}
+
+	attempts, updates, err := queue.send(ctx, id)
+	if updates == nil {
+		log.Printf("ERROR reading %s %d: %s", queue.name, id, err)
+		return
+	}
+	updates["last_attempt_at"] = now
+	status, nextAttemptAt := queue.statuses.outcome(attempts, err, time.Now())
+	updates["status"] = status
+	switch status {
+	case queue.statuses.delivered:
+		updates["delivered_at"] = time.Now()
+		updates["error"] = ""
+	case queue.statuses.failed:
+		updates["error"] = err.Error()
+	default:
+		updates["next_attempt_at"] = nextAttemptAt
+		updates["error"] = err.Error()
+	}
+	if result := h.DB.Model(queue.model).Where("id = ?", id).Updates(updates); result.Error != nil {
+		log.Printf("ERROR saving %s %d: %s", queue.name, id, result.Error)
+	}
+}
+
+// runDeliveries attempts the rows of the queue that are due
+func (h APIHandler) runDeliveries(ctx context.Context, queue deliveryQueue) {
+	var ids []uint
+	result := h.DB.Model(queue.model).
+		Where("status = ? AND next_attempt_at <= ?", queue.statuses.pending, time.Now()).
+		Order("next_attempt_at").Limit(deliveryBatchSize).Pluck("id", &ids)
+	if result.Error != nil {
+		log.Printf("ERROR listing pending %ss: %s", queue.name, result.Error)
+		return
+	}
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return
+		}
+		h.attemptDelivery(ctx, queue, id)
+	}
+}
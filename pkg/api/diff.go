@@ -0,0 +1,236 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+	"github.com/galleybytes/infrakube-stella/pkg/util"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	specChangeAdded   = "added"
+	specChangeRemoved = "removed"
+	specChangeChanged = "changed"
+)
+
+// Keys that can be written in a path without quoting
+var plainPathKeyRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// SpecChange is a single difference between two generations. Path is the location of the value, eg
+// "spec.taskOptions[0].env[1].value" or `labels["app.kubernetes.io/name"]`.
+type SpecChange struct {
+	Path string `json:"path"`
+	Op   string `json:"op"`
+	From any    `json:"from,omitempty"`
+	To   any    `json:"to,omitempty"`
+}
+
+// GenerationDiff compares the spec, labels and annotations of two generations of a resource
+type GenerationDiff struct {
+	Infra3ResourceUUID string       `json:"infra3_resource_uuid"`
+	From               string       `json:"from"`
+	To                 string       `json:"to"`
+	Changes            []SpecChange `json:"changes"`
+	Unified            string       `json:"unified"`
+}
+
+func joinPathKey(path, key string) string {
+	if !plainPathKeyRegex.MatchString(key) {
+		return fmt.Sprintf("%s[%s]", path, strconv.Quote(key))
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// diffValues appends the differences between two decoded json values to changes
+func diffValues(path string, from, to any, changes []SpecChange) []SpecChange {
+	fromMap, fromIsMap := from.(map[string]any)
+	toMap, toIsMap := to.(map[string]any)
+	if fromIsMap && toIsMap {
+		keys := []string{}
+		for key := range fromMap {
+			keys = append(keys, key)
+		}
+		for key := range toMap {
+			if _, found := fromMap[key]; !found {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fromValue, inFrom := fromMap[key]
+			toValue, inTo := toMap[key]
+			switch {
+			case !inFrom:
+				changes = append(changes, SpecChange{Path: joinPathKey(path, key), Op: specChangeAdded, To: toValue})
+			case !inTo:
+				changes = append(changes, SpecChange{Path: joinPathKey(path, key), Op: specChangeRemoved, From: fromValue})
+			default:
+				changes = diffValues(joinPathKey(path, key), fromValue, toValue, changes)
+			}
+		}
+		return changes
+	}
+
+	fromList, fromIsList := from.([]any)
+	toList, toIsList := to.([]any)
+	if fromIsList && toIsList {
+		for i := 0; i < max(len(fromList), len(toList)); i++ {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(fromList):
+				changes = append(changes, SpecChange{Path: itemPath, Op: specChangeAdded, To: toList[i]})
+			case i >= len(toList):
+				changes = append(changes, SpecChange{Path: itemPath, Op: specChangeRemoved, From: fromList[i]})
+			default:
+				changes = diffValues(itemPath, fromList[i], toList[i], changes)
+			}
+		}
+		return changes
+	}
+
+	if !reflect.DeepEqual(from, to) {
+		changes = append(changes, SpecChange{Path: path, Op: specChangeChanged, From: from, To: to})
+	}
+	return changes
+}
+
+// decodeSpecSection decodes a json column of the resource spec. Empty columns are empty objects.
+func decodeSpecSection(section, value string) (any, error) {
+	var decoded any = map[string]any{}
+	if strings.TrimSpace(value) == "" {
+		return decoded, nil
+	}
+	if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+		return nil, fmt.Errorf("%s is not valid json: %s", section, err)
+	}
+	if decoded == nil {
+		decoded = map[string]any{}
+	}
+	return decoded, nil
+}
+
+// specSectionText renders a decoded section as yaml which is easier to read in a text diff than json
+func specSectionText(decoded any) string {
+	if m, ok := decoded.(map[string]any); ok && len(m) == 0 {
+		return ""
+	}
+	b, err := yaml.Marshal(decoded)
+	if err != nil {
+		return fmt.Sprintf("%v\n", decoded)
+	}
+	return string(b)
+}
+
+// diffGenerations compares the spec, labels and annotations of two resource specs
+func diffGenerations(from, to *models.Infra3ResourceSpec) (*GenerationDiff, error) {
+	diff := GenerationDiff{
+		Infra3ResourceUUID: to.Infra3ResourceUUID,
+		From:               from.Generation,
+		To:                 to.Generation,
+		Changes:            []SpecChange{},
+	}
+	sections := []struct {
+		name     string
+		from, to string
+	}{
+		{"spec", from.ResourceSpec, to.ResourceSpec},
+		{"labels", from.Labels, to.Labels},
+		{"annotations", from.Annotations, to.Annotations},
+	}
+	for _, section := range sections {
+		fromValue, err := decodeSpecSection(section.name, section.from)
+		if err != nil {
+			return nil, fmt.Errorf("generation %s %s", from.Generation, err)
+		}
+		toValue, err := decodeSpecSection(section.name, section.to)
+		if err != nil {
+			return nil, fmt.Errorf("generation %s %s", to.Generation, err)
+		}
+		diff.Changes = diffValues(section.name, fromValue, toValue, diff.Changes)
+		diff.Unified += util.UnifiedDiff(
+			fmt.Sprintf("generation/%s/%s", from.Generation, section.name),
+			fmt.Sprintf("generation/%s/%s", to.Generation, section.name),
+			specSectionText(fromValue),
+			specSectionText(toValue),
+			3,
+		)
+	}
+	return &diff, nil
+}
+
+// previousGeneration returns the highest generation of the resource before the given one
+func (h APIHandler) previousGeneration(infra3ResourceUUID, generation string) string {
+	var previous string
+	h.DB.Raw(`
+		SELECT generation FROM infra3_resource_specs
+		WHERE infra3_resource_uuid = ? AND deleted_at IS NULL AND CAST(generation AS integer) < CAST(? AS integer)
+		ORDER BY CAST(generation AS integer) DESC
+		LIMIT 1
+	`, infra3ResourceUUID, generation).Scan(&previous)
+	return previous
+}
+
+// getGenerationDiff compares two generations of a resource. The "to" query param defaults to the latest
+// generation and "from" defaults to the generation before "to". Use "format=text" to get only the
+// unified diff as text.
+func (h APIHandler) getGenerationDiff(c *gin.Context) {
+	infra3ResourceUUID := c.Param("infra3_resource_uuid")
+	to := c.DefaultQuery("to", "latest")
+	if to == "latest" {
+		to = h.LatestGeneration(infra3ResourceUUID)
+		if to == "" {
+			c.JSON(http.StatusNotFound, response(http.StatusNotFound, fmt.Sprintf("resource '%s' has no generations", infra3ResourceUUID), []any{}))
+			return
+		}
+	}
+	if _, err := strconv.Atoi(to); err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, fmt.Sprintf("to must be a generation, got '%s'", to), []any{}))
+		return
+	}
+	from := c.Query("from")
+	if from == "" {
+		from = h.previousGeneration(infra3ResourceUUID, to)
+		if from == "" {
+			c.JSON(http.StatusNotFound, response(http.StatusNotFound, fmt.Sprintf("no generation before %s", to), []any{}))
+			return
+		}
+	}
+	if _, err := strconv.Atoi(from); err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, fmt.Sprintf("from must be a generation, got '%s'", from), []any{}))
+		return
+	}
+
+	fromSpec := h.LookupResourceSpec(from, infra3ResourceUUID)
+	if fromSpec == nil {
+		c.JSON(http.StatusNotFound, response(http.StatusNotFound, fmt.Sprintf("generation %s not found", from), []any{}))
+		return
+	}
+	toSpec := h.LookupResourceSpec(to, infra3ResourceUUID)
+	if toSpec == nil {
+		c.JSON(http.StatusNotFound, response(http.StatusNotFound, fmt.Sprintf("generation %s not found", to), []any{}))
+		return
+	}
+
+	diff, err := diffGenerations(fromSpec, toSpec)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	if c.Query("format") == "text" {
+		c.Data(http.StatusOK, "text/x-diff; charset=utf-8", []byte(diff.Unified))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, fmt.Sprintf("%d change(s)", len(diff.Changes)), []GenerationDiff{*diff}))
+}
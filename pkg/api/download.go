@@ -0,0 +1,192 @@
+package api
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/logstore"
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// logArchiveManifestItem describes a single task log file inside of a log archive
+type logArchiveManifestItem struct {
+	File                string    `json:"file"`
+	TaskType            string    `json:"task_type"`
+	TaskPodUUID         string    `json:"task_pod_uuid"`
+	Rerun               int       `json:"rerun"`
+	InClusterGeneration string    `json:"in_cluster_generation"`
+	Size                int       `json:"size"`
+	SHA256              string    `json:"sha256"`
+	CreatedAt           time.Time `json:"created_at"`
+	UpdatedAt           time.Time `json:"updated_at"`
+}
+
+type logArchiveManifest struct {
+	Infra3ResourceUUID string                   `json:"infra3_resource_uuid"`
+	Name               string                   `json:"name"`
+	Namespace          string                   `json:"namespace"`
+	Generation         string                   `json:"generation"`
+	StripANSI          bool                     `json:"strip_ansi"`
+	GeneratedAt        time.Time                `json:"generated_at"`
+	Files              []logArchiveManifestItem `json:"files"`
+}
+
+// downloadLogs returns the logs of a generation as a single attachment. The "format" query selects
+// between a plain text concatenation of the latest tasks ("text", the default) or a gzipped tarball
+// that contains every task and rerun of the generation along with a manifest.json ("tar.gz").
+// Set "strip_ansi=true" to remove terminal color codes from the logs.
+func (h APIHandler) downloadLogs(c *gin.Context) {
+	infra3ResourceUUID := c.Param("infra3_resource_uuid")
+	generation := c.Param("generation")
+	format := c.DefaultQuery("format", "text")
+	stripANSI, _ := strconv.ParseBool(c.Query("strip_ansi"))
+
+	var infra3Resource models.Infra3Resource
+	if result := h.DB.Unscoped().First(&infra3Resource, "uuid = ?", infra3ResourceUUID); result.Error != nil {
+		c.JSON(http.StatusNotFound, response(http.StatusNotFound, result.Error.Error(), []any{}))
+		return
+	}
+	if generation == "latest" || generation == "" {
+		generation = infra3Resource.CurrentGeneration
+	}
+	filename := fmt.Sprintf("%s-%s-gen%s-logs", infra3Resource.Namespace, infra3Resource.Name, generation)
+
+	switch format {
+	case "text", "txt":
+		taskLogs, err := logs(h.DB, h.LogStore, infra3ResourceUUID, generation)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+			return
+		}
+		var buf bytes.Buffer
+		for _, taskLog := range taskLogs {
+			message := taskLog.Message
+			if stripANSI {
+				message = ansiColorRegex.ReplaceAllString(message, "")
+			}
+			fmt.Fprintf(&buf, "==> %s (rerun %d) %s <==\n", taskLog.TaskType, taskLog.Rerun, taskLog.UUID)
+			buf.WriteString(message)
+			if len(message) > 0 && message[len(message)-1] != '\n' {
+				buf.WriteString("\n")
+			}
+			buf.WriteString("\n")
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.txt"`, filename))
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", buf.Bytes())
+	case "tar.gz", "tgz":
+		manifest := logArchiveManifest{
+			Infra3ResourceUUID: infra3ResourceUUID,
+			Name:               infra3Resource.Name,
+			Namespace:          infra3Resource.Namespace,
+			Generation:         generation,
+			StripANSI:          stripANSI,
+			GeneratedAt:        time.Now().UTC(),
+			Files:              []logArchiveManifestItem{},
+		}
+		b, err := logArchive(h.DB, h.LogStore, &manifest, filename)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.tar.gz"`, filename))
+		c.Data(http.StatusOK, "application/gzip", b)
+	default:
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, fmt.Sprintf("unsupported format '%s', use 'text' or 'tar.gz'", format), []any{}))
+	}
+}
+
+// logArchive writes every task log of the generation described by the manifest into a tarball. The
+// manifest is filled in as files are added and is written last as manifest.json.
+func logArchive(db *gorm.DB, store logstore.LogStore, manifest *logArchiveManifest, dirname string) ([]byte, error) {
+	tasks := []models.TaskPod{}
+	if result := allTasksGeneratedForResource(db, manifest.Infra3ResourceUUID, manifest.Generation).Scan(&tasks); result.Error != nil {
+		return nil, result.Error
+	}
+	sort.SliceStable(tasks, func(i, j int) bool {
+		if tasks[i].Rerun != tasks[j].Rerun {
+			return tasks[i].Rerun < tasks[j].Rerun
+		}
+		return taskTypeID(tasks[i].TaskType) < taskTypeID(tasks[j].TaskType)
+	})
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	addFile := func(name string, data []byte, modTime time.Time) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    dirname + "/" + name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: modTime,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	}
+
+	filenames := map[string]bool{}
+	for _, task := range tasks {
+		var log models.Infra3TaskLog
+		if result := resourceLog(db, task.UUID).Scan(&log); result.Error != nil {
+			return nil, result.Error
+		}
+		message, err := taskLogMessage(context.TODO(), store, log)
+		if err != nil {
+			return nil, err
+		}
+		if manifest.StripANSI {
+			message = ansiColorRegex.ReplaceAllString(message, "")
+		}
+		file := fmt.Sprintf("%02d-%s-rerun-%d", taskTypeID(task.TaskType), task.TaskType, task.Rerun)
+		if filenames[file] {
+			// The same task and rerun can run more than once when the in-cluster generation changes
+			file += "-" + task.UUID
+		}
+		filenames[file] = true
+		sum := sha256.Sum256([]byte(message))
+		item := logArchiveManifestItem{
+			File:                file + ".log",
+			TaskType:            task.TaskType,
+			TaskPodUUID:         task.UUID,
+			Rerun:               task.Rerun,
+			InClusterGeneration: task.InClusterGeneration,
+			Size:                len(message),
+			SHA256:              hex.EncodeToString(sum[:]),
+			CreatedAt:           log.CreatedAt,
+			UpdatedAt:           log.UpdatedAt,
+		}
+		if err := addFile(item.File, []byte(message), log.UpdatedAt); err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, item)
+	}
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := addFile("manifest.json", b, manifest.GeneratedAt); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
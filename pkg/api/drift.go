@@ -0,0 +1,362 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+)
+
+const (
+	// DefaultDriftDetectionInterval is how often pending drift checks are looked at
+	DefaultDriftDetectionInterval = time.Minute
+
+	// driftCheckTimeout fails a drift check whose plan did not complete in time
+	driftCheckTimeout = time.Hour
+
+	driftChangeCause = "drift-detection"
+
+	// driftApprover is the approver recorded when a drift check denies a plan without changes
+	driftApprover = systemApproverPrefix + driftChangeCause
+)
+
+// errDriftCheckConflict is returned when a drift check can't start because the workflow is busy
+var errDriftCheckConflict = errors.New("conflict")
+
+// requiresApproval reports if the latest resource spec holds the apply until the plan is approved. Drift
+// detection reruns the whole workflow, so only these resources can be checked without applying.
+func (h APIHandler) requiresApproval(infra3ResourceUUID string) (bool, error) {
+	return h.generationRequiresApproval("latest", infra3ResourceUUID)
+}
+
+// generationRequiresApproval reports if the resource spec of the generation holds the apply until the plan
+// is approved
+func (h APIHandler) generationRequiresApproval(generation, infra3ResourceUUID string) (bool, error) {
+	infra3ResourceSpec := h.LookupResourceSpec(generation, infra3ResourceUUID)
+	if infra3ResourceSpec == nil {
+		return false, fmt.Errorf("resource spec of '%s' at generation %s not found", infra3ResourceUUID, generation)
+	}
+	spec := struct {
+		RequireApproval bool `yaml:"requireApproval"`
+	}{}
+	if err := yaml.Unmarshal([]byte(infra3ResourceSpec.ResourceSpec), &spec); err != nil {
+		return false, err
+	}
+	return spec.RequireApproval, nil
+}
+
+// startDriftCheck reruns the workflow of the resource with a drift-detection change-cause. The plan of
+// the rerun is picked up by evaluateDriftCheck.
+func (h APIHandler) startDriftCheck(ctx context.Context, infra3ResourceUUID, triggeredBy string) (*models.DriftCheck, error) {
+	var infra3Resource models.Infra3Resource
+	if result := h.DB.First(&infra3Resource, "uuid = ?", infra3ResourceUUID); result.Error != nil {
+		return nil, result.Error
+	}
+	if infra3Resource.CurrentState == models.Running {
+		return nil, fmt.Errorf("%w: workflow of '%s/%s' is running", errDriftCheckConflict, infra3Resource.Namespace, infra3Resource.Name)
+	}
+	var pending int64
+	if result := h.DB.Model(&models.DriftCheck{}).Where("infra3_resource_uuid = ? AND status = ?", infra3ResourceUUID, models.DriftPending).Count(&pending); result.Error != nil {
+		return nil, result.Error
+	}
+	if pending > 0 {
+		return nil, fmt.Errorf("%w: a drift check of '%s/%s' is already pending", errDriftCheckConflict, infra3Resource.Namespace, infra3Resource.Name)
+	}
+	requireApproval, err := h.requiresApproval(infra3ResourceUUID)
+	if err != nil {
+		return nil, err
+	}
+	if !requireApproval {
+		return nil, fmt.Errorf("drift detection requires requireApproval so the apply does not run, '%s/%s' does not set it", infra3Resource.Namespace, infra3Resource.Name)
+	}
+
+	clusterName := getClusterName(infra3Resource.ClusterID, h.DB)
+	changeCause, err := rerun(h.clientset, clusterName, infra3Resource.Namespace, infra3Resource.Name, driftChangeCause, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to trigger rerun: %s", err)
+	}
+
+	check := models.DriftCheck{
+		Infra3ResourceUUID: infra3ResourceUUID,
+		TriggeredBy:        triggeredBy,
+		ChangeCause:        changeCause,
+		Status:             models.DriftPending,
+	}
+	if result := h.DB.Create(&check); result.Error != nil {
+		return nil, result.Error
+	}
+	return &check, nil
+}
+
+// driftPlan reports if the plan was started by a drift check: it is the plan of a drift check, it started
+// while a drift check is pending or the Tf reruns with the drift-detection change-cause
+func (h APIHandler) driftPlan(ctx context.Context, taskPod models.TaskPod) (bool, error) {
+	var checks int64
+	result := h.DB.Model(&models.DriftCheck{}).
+		Where("infra3_resource_uuid = ?", taskPod.Infra3ResourceUUID).
+		Where("plan_task_pod_uuid = ? OR (status = ? AND created_at <= ?)", taskPod.UUID, models.DriftPending, taskPod.CreatedAt).
+		Count(&checks)
+	if result.Error != nil || checks > 0 {
+		return checks > 0, result.Error
+	}
+
+	var infra3Resource models.Infra3Resource
+	if result := h.DB.First(&infra3Resource, "uuid = ?", taskPod.Infra3ResourceUUID); result.Error != nil {
+		return false, result.Error
+	}
+	tf, err := getResource(h.clientset, getClusterName(infra3Resource.ClusterID, h.DB), infra3Resource.Namespace, infra3Resource.Name, ctx)
+	if err != nil {
+		return false, err
+	}
+	return strings.HasPrefix(tf.Labels["kubernetes.io/change-cause"], driftChangeCause+"-"), nil
+}
+
+// planFinished reports if the plan task completed. The plan is complete once its log has the totals or
+// the no changes line, or once the task posted the "terraform show -json" summary of its plan file.
+func planFinished(summary *models.PlanSummary) bool {
+	if summary == nil {
+		return false
+	}
+	return summary.Source == planSummarySourceJSON || summary.FromTotals || summary.NoChanges
+}
+
+// evaluateDriftCheck looks for the plan of a pending drift check. Once the plan finished, plans without
+// changes are denied right away so the workflow stops. Plans with changes are left for an approver.
+func (h APIHandler) evaluateDriftCheck(ctx context.Context, check *models.DriftCheck) error {
+	var infra3Resource models.Infra3Resource
+	if result := h.DB.First(&infra3Resource, "uuid = ?", check.Infra3ResourceUUID); result.Error != nil {
+		return result.Error
+	}
+	stopped := (infra3Resource.CurrentState == models.Failed || infra3Resource.CurrentState == models.Canceled) && infra3Resource.UpdatedAt.After(check.CreatedAt)
+	timedOut := time.Since(check.CreatedAt) > driftCheckTimeout
+
+	var plan models.TaskPod
+	if result := h.DB.Where("infra3_resource_uuid = ? AND task_type = 'plan' AND created_at >= ?", check.Infra3ResourceUUID, check.CreatedAt).Order("created_at").Limit(1).Find(&plan); result.Error != nil {
+		return result.Error
+	}
+
+	var summary *models.PlanSummary
+	if plan.UUID != "" {
+		check.PlanTaskPodUUID = plan.UUID
+		check.Generation = plan.Generation
+		var err error
+		if summary, err = planSummary(ctx, h.DB, h.LogStore, plan); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case planFinished(summary):
+		check.Add = summary.Add
+		check.Change = summary.Change
+		check.Destroy = summary.Destroy
+		if summary.Add+summary.Change+summary.Destroy > 0 {
+			check.Status = models.Drifted
+			break
+		}
+		check.Status = models.NoDrift
+		_, err := h.castSystemApprovalVote(plan.UUID, models.ApprovalVote{Approver: driftApprover, IsApproved: false, Comment: "no drift"})
+		if err != nil && !errors.Is(err, errApprovalDecided) {
+			return err
+		}
+	case stopped:
+		check.Status = models.DriftError
+		check.Error = fmt.Sprintf("workflow %s before the plan completed", infra3Resource.CurrentState)
+	case timedOut:
+		check.Status = models.DriftError
+		check.Error = fmt.Sprintf("plan did not complete within %s", driftCheckTimeout)
+	}
+
+	if check.Status != models.DriftPending {
+		completedAt := time.Now().UTC()
+		check.CompletedAt = &completedAt
+	}
+	if result := h.DB.Save(check); result.Error != nil {
+		return result.Error
+	}
+	if check.Status == models.Drifted {
+		h.publishTaskPodEvent(EventDriftDetected, plan, map[string]any{
+			"drift_check_id": check.ID,
+			"triggered_by":   check.TriggeredBy,
+			"add":            check.Add,
+			"change":         check.Change,
+			"destroy":        check.Destroy,
+		}, fmt.Sprintf("%s/%d", EventDriftDetected, check.ID))
+	}
+	return nil
+}
+
+func (h APIHandler) runDriftDetection(ctx context.Context) {
+	var checks []models.DriftCheck
+	if result := h.DB.Where("status = ?", models.DriftPending).Find(&checks); result.Error != nil {
+		log.Printf("ERROR selecting pending drift checks: %s", result.Error)
+		return
+	}
+	for i := range checks {
+		if err := h.evaluateDriftCheck(ctx, &checks[i]); err != nil {
+			log.Printf("ERROR evaluating drift check %d of %s: %s", checks[i].ID, checks[i].Infra3ResourceUUID, err)
+		}
+	}
+}
+
+// RunDriftDetection records the result of the plans of pending drift checks until the context is
+// canceled. Drift schedules are run by RunSchedules.
+func (h APIHandler) RunDriftDetection(ctx context.Context) {
+	if h.DB == nil || h.DriftDetectionInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(h.DriftDetectionInterval)
+	defer ticker.Stop()
+	for {
+		h.runDriftDetection(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// driftSchedule returns the drift schedule of a resource, nil when the resource has none
+func (h APIHandler) driftSchedule(infra3ResourceUUID string) (*models.Schedule, error) {
+	var schedule models.Schedule
+	result := h.DB.Where("infra3_resource_uuid = ? AND kind = ?", infra3ResourceUUID, scheduleKindDrift).Order("id").Limit(1).Find(&schedule)
+	if result.Error != nil || schedule.ID == 0 {
+		return nil, result.Error
+	}
+	return &schedule, nil
+}
+
+// putDriftSchedule creates or replaces the drift schedule of a resource, a schedule of the "drift" kind.
+// Send {"cron": "0 6 * * *"} and optionally "timezone" and "enabled".
+func (h APIHandler) putDriftSchedule(c *gin.Context) {
+	infra3ResourceUUID := c.Param("infra3_resource_uuid")
+
+	var jsonData scheduleRequest
+	if err := c.BindJSON(&jsonData); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	jsonData.Kind = scheduleKindDrift
+	if jsonData.Name == "" {
+		jsonData.Name = driftChangeCause
+	}
+
+	schedule, err := h.driftSchedule(infra3ResourceUUID)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	if schedule == nil {
+		schedule = &models.Schedule{Infra3ResourceUUID: infra3ResourceUUID, CreatedBy: username(c)}
+	}
+	if err := jsonData.apply(schedule); err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, err.Error(), []any{}))
+		return
+	}
+	if !h.driftScheduleAllowed(c, *schedule) {
+		return
+	}
+	schedule.UpdatedBy = username(c)
+	if result := h.DB.Save(schedule); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", []models.Schedule{*schedule}))
+}
+
+func (h APIHandler) getDriftSchedule(c *gin.Context) {
+	schedule, err := h.driftSchedule(c.Param("infra3_resource_uuid"))
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	if schedule == nil {
+		c.JSON(http.StatusNotFound, response(http.StatusNotFound, "drift schedule not found", []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", []models.Schedule{*schedule}))
+}
+
+func (h APIHandler) deleteDriftSchedule(c *gin.Context) {
+	if result := h.DB.Unscoped().Where("infra3_resource_uuid = ? AND kind = ?", c.Param("infra3_resource_uuid"), scheduleKindDrift).Delete(&models.Schedule{}); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// triggerDriftCheck starts a drift check outside of the schedule
+func (h APIHandler) triggerDriftCheck(c *gin.Context) {
+	check, err := h.startDriftCheck(c, c.Param("infra3_resource_uuid"), username(c))
+	if err != nil {
+		status := http.StatusUnprocessableEntity
+		if errors.Is(err, errDriftCheckConflict) {
+			status = http.StatusConflict
+		} else if errors.Is(err, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, response(int64(status), err.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusAccepted, response(http.StatusAccepted, "", []models.DriftCheck{*check}))
+}
+
+// getDriftStatus returns the drift checks of a resource, newest first. The message is the status of the
+// latest check.
+func (h APIHandler) getDriftStatus(c *gin.Context) {
+	checks := []models.DriftCheck{}
+	if result := h.DB.Where("infra3_resource_uuid = ?", c.Param("infra3_resource_uuid")).Order("created_at DESC").Limit(50).Find(&checks); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	status := ""
+	if len(checks) > 0 {
+		status = string(checks[0].Status)
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, status, checks))
+}
+
+// DriftedResource is the latest drift check of a resource with the resource's location
+type DriftedResource struct {
+	models.DriftCheck `json:",inline"`
+	ClusterName       string `json:"cluster_name"`
+	Namespace         string `json:"namespace"`
+	Name              string `json:"name"`
+}
+
+// getDriftedResources lists the resources whose latest completed drift check has the status in the
+// "status" query param, "drift" by default
+func (h APIHandler) getDriftedResources(c *gin.Context) {
+	status := c.DefaultQuery("status", string(models.Drifted))
+
+	drifted := []DriftedResource{}
+	result := h.DB.Raw(`
+		SELECT latest.*, clusters.name AS cluster_name, infra3_resources.namespace, infra3_resources.name
+		FROM (
+			SELECT DISTINCT ON (infra3_resource_uuid) *
+			FROM drift_checks
+			WHERE deleted_at IS NULL AND status <> ?
+			ORDER BY infra3_resource_uuid, created_at DESC
+		) AS latest
+		JOIN infra3_resources ON infra3_resources.uuid = latest.infra3_resource_uuid AND infra3_resources.deleted_at IS NULL
+		JOIN clusters ON clusters.id = infra3_resources.cluster_id
+		WHERE latest.status = ?
+		ORDER BY latest.created_at DESC
+	`, models.DriftPending, status).Scan(&drifted)
+	if result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", drifted))
+}
@@ -0,0 +1,301 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+)
+
+const (
+	notificationEmail = "email"
+
+	// notifyAnnotation lists the email addresses notified about a resource, eg
+	// "alice@example.com, bob@example.com"
+	notifyAnnotation = "infra3-stella.galleybytes.com/notify"
+
+	// smtpTimeout limits how long sending an email may take
+	smtpTimeout = 30 * time.Second
+)
+
+// SMTPConfig is the mail server that sends the emails of email notification channels. Username and
+// Password are only sent over TLS, unless the server runs on localhost.
+type SMTPConfig struct {
+	// Addr is the host:port of the server
+	Addr     string
+	From     string
+	Username string
+	Password string
+
+	// NotifyDomains are the domains the notifyAnnotation may send to, eg "example.com". Anyone who can
+	// change a resource sets its annotations, so without it they can send emails to any address.
+	NotifyDomains []string
+}
+
+// allowsNotifyAddress reports if the notifyAnnotation may send to the address. Every address is allowed
+// when no NotifyDomains are set.
+func (s SMTPConfig) allowsNotifyAddress(address string) bool {
+	if len(s.NotifyDomains) == 0 {
+		return true
+	}
+	domain := address[strings.LastIndex(address, "@")+1:]
+	for _, allowed := range s.NotifyDomains {
+		if strings.EqualFold(domain, strings.TrimSpace(allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyAddresses returns the addresses of the notifyAnnotation value that the smtp config allows. A typo
+// in one address shouldn't silence the others, so invalid addresses are skipped.
+func (s SMTPConfig) notifyAddresses(annotation string) []string {
+	addresses := []string{}
+	for _, value := range strings.Split(annotation, ",") {
+		address, err := mail.ParseAddress(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+		if !s.allowsNotifyAddress(address.Address) {
+			log.Printf("WARNING skipping '%s' of the %s annotation, its domain is not allowed", address.Address, notifyAnnotation)
+			continue
+		}
+		addresses = append(addresses, address.Address)
+	}
+	return addresses
+}
+
+// emailData is rendered by the email templates
+type emailData struct {
+	notificationMessage
+	Channel string
+}
+
+var emailTextTemplate = texttemplate.Must(texttemplate.New("email-text").Parse(`{{.Title}}
+
+{{with .Text}}{{.}}
+
+{{end}}{{range .Facts}}{{if index . 1}}{{index . 0}}: {{index . 1}}
+{{end}}{{end}}{{with .Log}}
+Last lines of the task log:
+
+{{.}}
+{{end}}{{with .ApproveURL}}
+Approve the plan: {{.}}
+{{end}}{{with .DenyURL}}Deny the plan: {{.}}
+{{end}}{{with .URL}}
+Open the dashboard: {{.}}
+{{end}}
+--
+Sent by infra3-stella because you are listed in the notify annotation of the resource or are a recipient
+of the '{{.Channel}}' notification channel.
+`))
+
+var emailHTMLTemplate = template.Must(template.New("email-html").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; color: #1f2328;">
+  <h2>{{.Title}}</h2>
+  {{with .Text}}<p>{{.}}</p>{{end}}
+  <table style="border-collapse: collapse;">
+  {{range .Facts}}{{if index . 1}}
+    <tr><th style="text-align: left; padding: 2px 12px 2px 0;">{{index . 0}}</th><td>{{index . 1}}</td></tr>
+  {{end}}{{end}}
+  </table>
+  {{with .Log}}
+  <p>Last lines of the task log:</p>
+  <pre style="background: #f6f8fa; padding: 8px; white-space: pre-wrap;">{{.}}</pre>
+  {{end}}
+  {{if .ApproveURL}}<p><a href="{{.ApproveURL}}">Approve the plan</a> | <a href="{{.DenyURL}}">Deny the plan</a></p>{{end}}
+  {{with .URL}}<p><a href="{{.}}">Open the dashboard</a></p>{{end}}
+  <p style="color: #656d76; font-size: small;">Sent by infra3-stella because you are listed in the notify annotation of the
+  resource or are a recipient of the '{{.Channel}}' notification channel.</p>
+</body>
+</html>
+`))
+
+// parseRecipients splits a comma separated list of email addresses
+func parseRecipients(list string) ([]string, error) {
+	recipients := []string{}
+	for _, value := range strings.Split(list, ",") {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		address, err := mail.ParseAddress(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not an email address: %s", strings.TrimSpace(value), err)
+		}
+		recipients = append(recipients, address.Address)
+	}
+	return recipients, nil
+}
+
+// emailRecipients returns the recipients of the channel and the addresses in the notifyAnnotation of the
+// resource at the generation of the event, without duplicates
+func (h APIHandler) emailRecipients(channel models.NotificationChannel, event models.Event) []string {
+	recipients := []string{}
+	add := func(addresses []string) {
+		for _, address := range addresses {
+			known := false
+			for _, recipient := range recipients {
+				known = known || strings.EqualFold(recipient, address)
+			}
+			if !known {
+				recipients = append(recipients, address)
+			}
+		}
+	}
+	add(channel.Recipients)
+
+	// The approval links of the channel's approver must not reach anyone else
+	if event.Infra3ResourceUUID == "" || channel.Approver != "" {
+		return recipients
+	}
+	infra3ResourceSpec := h.LookupResourceSpec(event.Generation, event.Infra3ResourceUUID)
+	if infra3ResourceSpec == nil || infra3ResourceSpec.Annotations == "" {
+		return recipients
+	}
+	annotations := map[string]string{}
+	json.Unmarshal([]byte(infra3ResourceSpec.Annotations), &annotations)
+	add(h.SMTP.notifyAddresses(annotations[notifyAnnotation]))
+	return recipients
+}
+
+// buildEmail renders the message as a multipart email with a text and an HTML body
+func buildEmail(from string, to []string, channelName string, msg notificationMessage) ([]byte, error) {
+	data := emailData{notificationMessage: msg, Channel: channelName}
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		render      func(*bytes.Buffer) error
+	}{
+		{"text/plain; charset=utf-8", func(b *bytes.Buffer) error { return emailTextTemplate.Execute(b, data) }},
+		{"text/html; charset=utf-8", func(b *bytes.Buffer) error { return emailHTMLTemplate.Execute(b, data) }},
+	} {
+		var rendered bytes.Buffer
+		if err := part.render(&rendered); err != nil {
+			return nil, err
+		}
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		qp.Write(rendered.Bytes())
+		qp.Close()
+	}
+	parts.Close()
+
+	var email bytes.Buffer
+	fmt.Fprintf(&email, "From: %s\r\n", from)
+	fmt.Fprintf(&email, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&email, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "[infra3] "+msg.Title))
+	fmt.Fprintf(&email, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&email, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&email, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", parts.Boundary())
+	email.Write(body.Bytes())
+	return email.Bytes(), nil
+}
+
+// sendEmail sends the email through the SMTP server and returns the recipients the server accepted.
+// Recipients the server rejects, eg a mailbox that no longer exists, are skipped; the email only fails
+// when no recipient is accepted. STARTTLS is used when the server offers it.
+func (s SMTPConfig) sendEmail(ctx context.Context, to []string, email []byte) ([]string, error) {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("smtp address '%s' is invalid: %s", s.Addr, err)
+	}
+	dialer := net.Dialer{Timeout: smtpTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return nil, err
+		}
+	}
+	if s.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return nil, err
+		}
+	}
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		return nil, fmt.Errorf("smtp sender '%s' is invalid: %s", s.From, err)
+	}
+	if err := client.Mail(from.Address); err != nil {
+		return nil, err
+	}
+	accepted := []string{}
+	rejected := []string{}
+	for _, recipient := range to {
+		if err := client.Rcpt(recipient); err != nil {
+			log.Printf("WARNING smtp server rejected recipient %s: %s", recipient, err)
+			rejected = append(rejected, fmt.Sprintf("%s: %s", recipient, err))
+			continue
+		}
+		accepted = append(accepted, recipient)
+	}
+	if len(accepted) == 0 {
+		return nil, fmt.Errorf("every recipient was rejected, %s", strings.Join(rejected, ", "))
+	}
+	w, err := client.Data()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(email); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return accepted, client.Quit()
+}
+
+// sendEmailNotification emails the event to the recipients of the channel and the resource. It returns who
+// the email was sent to, without the recipients the smtp server rejected.
+func (h APIHandler) sendEmailNotification(ctx context.Context, channel models.NotificationChannel, event models.Event, msg notificationMessage) ([]string, error) {
+	if h.SMTP.Addr == "" || h.SMTP.From == "" {
+		return nil, fmt.Errorf("%w: the smtp server is not configured", errUndeliverable)
+	}
+	to := h.emailRecipients(channel, event)
+	if len(to) == 0 {
+		return nil, fmt.Errorf("%w: no recipients, set the '%s' annotation on the resource or the recipients of the channel", errUndeliverable, notifyAnnotation)
+	}
+	email, err := buildEmail(h.SMTP.From, to, channel.Name, msg)
+	if err != nil {
+		return to, err
+	}
+	accepted, err := h.SMTP.sendEmail(ctx, to, email)
+	if err != nil {
+		return to, err
+	}
+	return accepted, nil
+}
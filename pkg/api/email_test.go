@@ -0,0 +1,167 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// smtpSink is a local SMTP server that rejects the reject mailboxes and records the emails it accepts
+type smtpSink struct {
+	listener net.Listener
+	reject   map[string]bool
+
+	mu         sync.Mutex
+	recipients [][]string
+	emails     []string
+}
+
+func newSMTPSink(t *testing.T, reject ...string) *smtpSink {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &smtpSink{listener: listener, reject: map[string]bool{}}
+	for _, address := range reject {
+		sink.reject[address] = true
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go sink.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return sink
+}
+
+// received returns the recipients and content of the accepted emails
+func (s *smtpSink) received() ([][]string, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.recipients, s.emails
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost sink")
+	recipients := []string{}
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			text.PrintfLine("250 localhost")
+		case "MAIL":
+			text.PrintfLine("250 ok")
+		case "RCPT":
+			address := strings.Trim(line[strings.Index(line, ":")+1:], "<> ")
+			if s.reject[address] {
+				text.PrintfLine("550 mailbox unavailable")
+				continue
+			}
+			recipients = append(recipients, address)
+			text.PrintfLine("250 ok")
+		case "DATA":
+			text.PrintfLine("354 send the email")
+			b, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.recipients = append(s.recipients, recipients)
+			s.emails = append(s.emails, string(b))
+			s.mu.Unlock()
+			text.PrintfLine("250 queued")
+		case "RSET", "NOOP":
+			text.PrintfLine("250 ok")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+// TestSendEmailRejectedRecipient checks that a rejected recipient doesn't keep the others from getting
+// the email
+func TestSendEmailRejectedRecipient(t *testing.T) {
+	sink := newSMTPSink(t, "gone@example.com")
+	config := SMTPConfig{Addr: sink.listener.Addr().String(), From: "Infra3 <infra3@example.com>"}
+	to := []string{"alice@example.com", "gone@example.com", "bob@example.com"}
+	email, err := buildEmail(config.From, to, "approvers", notificationMessage{Title: "Plan of default/vpc requires approval"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted, err := config.sendEmail(context.Background(), to, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"alice@example.com", "bob@example.com"}
+	if !reflect.DeepEqual(accepted, want) {
+		t.Errorf("accepted recipients are %v, want %v", accepted, want)
+	}
+	recipients, emails := sink.received()
+	if len(emails) != 1 || !reflect.DeepEqual(recipients[0], want) {
+		t.Fatalf("sink got %d emails to %v, want 1 email to %v", len(emails), recipients, want)
+	}
+	headers, err := textproto.NewReader(bufio.NewReader(strings.NewReader(emails[0]))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := headers.Get("Subject"); got != "[infra3] Plan of default/vpc requires approval" {
+		t.Errorf("subject is %q, want the title", got)
+	}
+}
+
+// TestSendEmailNoRecipientAccepted checks that the email fails when every recipient is rejected
+func TestSendEmailNoRecipientAccepted(t *testing.T) {
+	sink := newSMTPSink(t, "gone@example.com", "left@example.com")
+	config := SMTPConfig{Addr: sink.listener.Addr().String(), From: "infra3@example.com"}
+	to := []string{"gone@example.com", "left@example.com"}
+
+	accepted, err := config.sendEmail(context.Background(), to, []byte("Subject: test\r\n\r\ntest\r\n"))
+	if err == nil {
+		t.Fatalf("email to rejected recipients was accepted by %v", accepted)
+	}
+	if !strings.Contains(err.Error(), "gone@example.com") || !strings.Contains(err.Error(), "left@example.com") {
+		t.Errorf("error %q doesn't name the rejected recipients", err)
+	}
+	if _, emails := sink.received(); len(emails) != 0 {
+		t.Errorf("sink got %d emails, want none", len(emails))
+	}
+}
+
+// TestNotifyAddresses checks that the notify annotation only sends to allowed domains
+func TestNotifyAddresses(t *testing.T) {
+	annotation := "alice@example.com, Bob <bob@Example.org>, not an address, eve@attacker.example"
+	for _, test := range []struct {
+		domains []string
+		want    []string
+	}{
+		{nil, []string{"alice@example.com", "bob@Example.org", "eve@attacker.example"}},
+		{[]string{"example.com", "example.org"}, []string{"alice@example.com", "bob@Example.org"}},
+		{[]string{"EXAMPLE.COM"}, []string{"alice@example.com"}},
+		// Subdomains are not allowed by their parent domain
+		{[]string{"example"}, []string{}},
+	} {
+		got := SMTPConfig{NotifyDomains: test.domains}.notifyAddresses(annotation)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("notifyAddresses with domains %v = %v, want %v", test.domains, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"log"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+	"gorm.io/gorm/clause"
+)
+
+// Types of the events published to webhooks
+const (
+	EventResourceCreated   = "resource.created"
+	EventGenerationCreated = "generation.created"
+	EventTaskStarted       = "task.started"
+	EventApprovalRequired  = "approval.required"
+	EventApprovalDecided   = "approval.decided"
+	EventWorkflowCompleted = "workflow.completed"
+	EventWorkflowFailed    = "workflow.failed"
+	EventDriftDetected     = "drift.detected"
+
+	// EventPing is only sent by webhook tests
+	EventPing = "ping"
+
+	// EventApprovalLink is only sent to the notification channels of the approver a link was requested for
+	EventApprovalLink = "approval.link"
+)
+
+// internalEventTypes are not published to webhooks and feeds
+var internalEventTypes = []string{EventPing, EventApprovalLink}
+
+// EventTypes lists the types webhooks can subscribe to
+var EventTypes = []string{
+	EventResourceCreated,
+	EventGenerationCreated,
+	EventTaskStarted,
+	EventApprovalRequired,
+	EventApprovalDecided,
+	EventWorkflowCompleted,
+	EventWorkflowFailed,
+	EventDriftDetected,
+}
+
+// resourceEvent returns an event of the resource at its current generation
+func (h APIHandler) resourceEvent(eventType string, infra3Resource models.Infra3Resource, data map[string]any) models.Event {
+	return models.Event{
+		Type:               eventType,
+		Infra3ResourceUUID: infra3Resource.UUID,
+		ClusterName:        getClusterName(infra3Resource.ClusterID, h.DB),
+		Namespace:          infra3Resource.Namespace,
+		Name:               infra3Resource.Name,
+		Generation:         infra3Resource.CurrentGeneration,
+		Data:               data,
+	}
+}
+
+// publishTaskPodEvent publishes an event of the resource and generation of the task
+func (h APIHandler) publishTaskPodEvent(eventType string, taskPod models.TaskPod, data map[string]any, dedupKey string) {
+	var infra3Resource models.Infra3Resource
+	if result := h.DB.Unscoped().First(&infra3Resource, "uuid = ?", taskPod.Infra3ResourceUUID); result.Error != nil {
+		log.Printf("ERROR publishing %s event of task %s: %s", eventType, taskPod.UUID, result.Error)
+		return
+	}
+	event := h.resourceEvent(eventType, infra3Resource, data)
+	event.Generation = taskPod.Generation
+	event.TaskPodUUID = taskPod.UUID
+	event.DedupKey = dedupKey
+	h.publishEvent(event)
+}
+
+// publishApprovalDecided publishes the decision on the plan
+func (h APIHandler) publishApprovalDecided(taskPod models.TaskPod, approval models.Approval) {
+	h.publishTaskPodEvent(EventApprovalDecided, taskPod, map[string]any{
+		"is_approved":           approval.IsApproved,
+		"approver":              approval.Approver,
+		"comment":               approval.Comment,
+		"ticket_url":            approval.TicketURL,
+		"auto_approval_rule_id": approval.AutoApprovalRuleID,
+	}, "")
+}
+
+// publishApprovalRequired publishes that the plan waits for approvals when the spec of its generation
+// requires approval. It is published when the plan task starts; the dedup key publishes it once per plan.
+func (h APIHandler) publishApprovalRequired(taskPod models.TaskPod) {
+	if taskPod.TaskType != "plan" {
+		return
+	}
+	requireApproval, err := h.generationRequiresApproval(taskPod.Generation, taskPod.Infra3ResourceUUID)
+	if err != nil {
+		log.Printf("ERROR publishing %s event of task %s: %s", EventApprovalRequired, taskPod.UUID, err)
+		return
+	}
+	if !requireApproval {
+		return
+	}
+	quorum, err := h.approvalQuorum(taskPod)
+	if err != nil {
+		log.Printf("ERROR publishing %s event of task %s: %s", EventApprovalRequired, taskPod.UUID, err)
+		return
+	}
+	h.publishTaskPodEvent(EventApprovalRequired, taskPod, map[string]any{
+		"required":  quorum.Required,
+		"approvals": quorum.Approvals,
+		"group":     quorum.Group,
+	}, EventApprovalRequired+"/"+taskPod.UUID)
+}
+
+// publishEvent records the event and queues a delivery for every webhook and notification channel
+// subscribed to it. An event whose DedupKey was already recorded is dropped. Errors are logged since
+// events never fail the request that caused them.
+func (h APIHandler) publishEvent(event models.Event) {
+	if h.DB == nil {
+		return
+	}
+	result := h.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&event)
+	if result.Error != nil {
+		log.Printf("ERROR saving %s event of '%s/%s': %s", event.Type, event.Namespace, event.Name, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		return
+	}
+	h.enqueueWebhookDeliveries(event)
+	h.enqueueNotifications(event)
+}
@@ -0,0 +1,344 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// maxFeedLimit limits the page size of the feed
+	maxFeedLimit = 100
+
+	// maxSubscriptions limits the subscriptions of a user, which are all checked for every feed request
+	maxSubscriptions = 100
+)
+
+// FeedItem is an event of the feed
+type FeedItem struct {
+	models.Event
+	Unread bool `json:"unread"`
+}
+
+// Feed is a page of the events of the resources the user subscribed to, newest first. Unread counts every
+// unread event, not only the ones in the page.
+type Feed struct {
+	Unread          int64      `json:"unread"`
+	LastReadEventID uint       `json:"last_read_event_id"`
+	Offset          int        `json:"offset"`
+	Limit           int        `json:"limit"`
+	Items           []FeedItem `json:"items"`
+}
+
+// globToLike converts a glob pattern to a LIKE pattern. Character classes have no LIKE equivalent.
+func globToLike(pattern string) (string, error) {
+	if strings.ContainsAny(pattern, "[]") {
+		return "", fmt.Errorf("pattern '%s' is invalid: character classes are not supported", pattern)
+	}
+	var b strings.Builder
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			escaped = false
+			if r == '%' || r == '_' || r == '\\' {
+				b.WriteRune('\\')
+			}
+			b.WriteRune(r)
+		case r == '\\':
+			escaped = true
+		case r == '*':
+			b.WriteRune('%')
+		case r == '?':
+			b.WriteRune('_')
+		case r == '%' || r == '_':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if escaped {
+		return "", fmt.Errorf("pattern '%s' is invalid: it ends with an escape", pattern)
+	}
+	return b.String(), nil
+}
+
+// subscribedEvents selects the events matching any of the subscriptions
+func subscribedEvents(db *gorm.DB, subscriptions []models.Subscription) (*gorm.DB, error) {
+	conditions := []string{}
+	args := []any{}
+	for _, subscription := range subscriptions {
+		condition := []string{}
+		if subscription.Infra3ResourceUUID != "" {
+			condition = append(condition, "infra3_resource_uuid = ?")
+			args = append(args, subscription.Infra3ResourceUUID)
+		}
+		for column, pattern := range map[string]string{"cluster_name": subscription.Cluster, "namespace": subscription.Namespace, "name": subscription.Name} {
+			like, err := globToLike(pattern)
+			if err != nil {
+				return nil, err
+			}
+			if like != "%" {
+				condition = append(condition, column+" LIKE ?")
+				args = append(args, like)
+			}
+		}
+		if len(subscription.EventTypes) > 0 {
+			types := []string{}
+			for _, pattern := range subscription.EventTypes {
+				like, err := globToLike(pattern)
+				if err != nil {
+					return nil, err
+				}
+				types = append(types, "type LIKE ?")
+				args = append(args, like)
+			}
+			condition = append(condition, "("+strings.Join(types, " OR ")+")")
+		}
+		if len(condition) == 0 {
+			condition = append(condition, "TRUE")
+		}
+		conditions = append(conditions, "("+strings.Join(condition, " AND ")+")")
+	}
+	if len(conditions) == 0 {
+		conditions = append(conditions, "FALSE")
+	}
+	return db.Model(&models.Event{}).Where("type NOT IN ?", internalEventTypes).Where(strings.Join(conditions, " OR "), args...), nil
+}
+
+// feedUser returns the user of the request and responds with an error when the request has no user
+func feedUser(c *gin.Context) (string, bool) {
+	user := username(c)
+	if user == "" {
+		c.JSON(http.StatusForbidden, response(http.StatusForbidden, "the feed requires a user identity", []any{}))
+		return "", false
+	}
+	return user, true
+}
+
+// lastReadEventID returns the read marker of the user
+func (h APIHandler) lastReadEventID(user string) (uint, error) {
+	var marker models.FeedReadMarker
+	if result := h.DB.Where("username = ?", user).Limit(1).Find(&marker); result.Error != nil {
+		return 0, result.Error
+	}
+	return marker.LastReadEventID, nil
+}
+
+// getFeed lists the events of the resources the caller subscribed to, newest first. Send "unread=true" to
+// only list unread events and page with "offset" and "limit".
+func (h APIHandler) getFeed(c *gin.Context) {
+	user, ok := feedUser(c)
+	if !ok {
+		return
+	}
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 {
+		limit = 20
+	}
+	limit = min(limit, maxFeedLimit)
+	offset = max(offset, 0)
+
+	var subscriptions []models.Subscription
+	if result := h.DB.Where("username = ?", user).Find(&subscriptions); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	lastRead, err := h.lastReadEventID(user)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	events, err := subscribedEvents(h.DB, subscriptions)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+
+	feed := Feed{LastReadEventID: lastRead, Offset: offset, Limit: limit, Items: []FeedItem{}}
+	if result := events.Session(&gorm.Session{}).Where("id > ?", lastRead).Count(&feed.Unread); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	if c.Query("unread") == "true" {
+		events = events.Where("id > ?", lastRead)
+	}
+	var page []models.Event
+	if result := events.Order("id DESC").Offset(offset).Limit(limit).Find(&page); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	for _, event := range page {
+		feed.Items = append(feed.Items, FeedItem{Event: event, Unread: event.ID > lastRead})
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, fmt.Sprintf("%d unread event(s)", feed.Unread), []Feed{feed}))
+}
+
+// markFeedRead marks the events of the feed up to {"event_id": 42} as read, or every event when no id is
+// sent. The marker never moves back.
+func (h APIHandler) markFeedRead(c *gin.Context) {
+	user, ok := feedUser(c)
+	if !ok {
+		return
+	}
+	jsonData := struct {
+		EventID uint `json:"event_id"`
+	}{}
+	if c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&jsonData); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+			return
+		}
+	}
+	if jsonData.EventID == 0 {
+		var newest models.Event
+		if result := h.DB.Order("id DESC").Limit(1).Find(&newest); result.Error != nil {
+			c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+			return
+		}
+		jsonData.EventID = newest.ID
+	}
+
+	marker := models.FeedReadMarker{Username: user, LastReadEventID: jsonData.EventID}
+	result := h.DB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "username"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"last_read_event_id": gorm.Expr("GREATEST(feed_read_markers.last_read_event_id, excluded.last_read_event_id)"),
+			"updated_at":         gorm.Expr("excluded.updated_at"),
+		}),
+	}).Create(&marker)
+	if result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	lastRead, err := h.lastReadEventID(user)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	marker.LastReadEventID = lastRead
+	c.JSON(http.StatusOK, response(http.StatusOK, "", []models.FeedReadMarker{marker}))
+}
+
+// subscriptionRequest is the body of create subscription requests
+type subscriptionRequest struct {
+	Infra3ResourceUUID string   `json:"infra3_resource_uuid"`
+	Cluster            string   `json:"cluster"`
+	Namespace          string   `json:"namespace"`
+	Name               string   `json:"name"`
+	EventTypes         []string `json:"event_types"`
+}
+
+// apply validates the request and sets it on the subscription. Empty patterns match everything, but a
+// subscription must name a resource or narrow down the cluster, namespace or name.
+func (r subscriptionRequest) apply(subscription *models.Subscription) error {
+	if r.Cluster == "" {
+		r.Cluster = "*"
+	}
+	if r.Namespace == "" {
+		r.Namespace = "*"
+	}
+	if r.Name == "" {
+		r.Name = "*"
+	}
+	if r.Infra3ResourceUUID == "" && r.Cluster == "*" && r.Namespace == "*" && r.Name == "*" {
+		return fmt.Errorf("subscription must set infra3_resource_uuid or at least one of cluster, namespace or name")
+	}
+	for _, pattern := range append([]string{r.Cluster, r.Namespace, r.Name}, r.EventTypes...) {
+		if _, err := globToLike(pattern); err != nil {
+			return err
+		}
+	}
+	if err := validateEventPatterns(r.EventTypes, r.Cluster, r.Namespace); err != nil {
+		return err
+	}
+	subscription.Infra3ResourceUUID = r.Infra3ResourceUUID
+	subscription.Cluster = r.Cluster
+	subscription.Namespace = r.Namespace
+	subscription.Name = r.Name
+	subscription.EventTypes = r.EventTypes
+	return nil
+}
+
+func (h APIHandler) getSubscriptions(c *gin.Context) {
+	user, ok := feedUser(c)
+	if !ok {
+		return
+	}
+	subscriptions := []models.Subscription{}
+	if result := h.DB.Where("username = ?", user).Order("id").Find(&subscriptions); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", subscriptions))
+}
+
+// addSubscription subscribes the caller to a resource, eg {"infra3_resource_uuid": "..."}, or to patterns,
+// eg {"cluster": "prod-*", "namespace": "payments", "event_types": ["approval.*", "workflow.failed"]}
+func (h APIHandler) addSubscription(c *gin.Context) {
+	user, ok := feedUser(c)
+	if !ok {
+		return
+	}
+	var jsonData subscriptionRequest
+	if err := c.BindJSON(&jsonData); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	subscription := models.Subscription{Username: user}
+	if err := jsonData.apply(&subscription); err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, err.Error(), []any{}))
+		return
+	}
+	if subscription.Infra3ResourceUUID != "" {
+		if result := h.DB.First(&models.Infra3Resource{}, "uuid = ?", subscription.Infra3ResourceUUID); result.Error != nil {
+			c.JSON(http.StatusNotFound, response(http.StatusNotFound, fmt.Sprintf("infra3_resource '%s' not found", subscription.Infra3ResourceUUID), []any{}))
+			return
+		}
+	}
+	var count int64
+	if result := h.DB.Model(&models.Subscription{}).Where("username = ?", user).Count(&count); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	if count >= maxSubscriptions {
+		c.JSON(http.StatusConflict, response(http.StatusConflict, fmt.Sprintf("users can have at most %d subscriptions", maxSubscriptions), []any{}))
+		return
+	}
+	if result := h.DB.Create(&subscription); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusCreated, response(http.StatusCreated, "", []models.Subscription{subscription}))
+}
+
+// deleteSubscription unsubscribes the caller. Users can only remove their own subscriptions.
+func (h APIHandler) deleteSubscription(c *gin.Context) {
+	user, ok := feedUser(c)
+	if !ok {
+		return
+	}
+	var subscription models.Subscription
+	if result := h.DB.First(&subscription, "id = ? AND username = ?", c.Param("subscription_id"), user); result.Error != nil {
+		status := http.StatusUnprocessableEntity
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, response(int64(status), fmt.Sprintf("subscription %s: %s", c.Param("subscription_id"), result.Error), []any{}))
+		return
+	}
+	if result := h.DB.Delete(&subscription); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
@@ -334,10 +334,14 @@ func (h APIHandler) ResourceLogs(generationFilter, rerunFilter, taskTypeFilter,
 	for _, taskPod := range taskPodsOfHighestRerun {
 		for _, log := range infra3TaskLogs {
 			if log.TaskPodUUID == taskPod.UUID {
+				message, err := liveTaskLogMessage(context.TODO(), h.LogStore, log)
+				if err != nil {
+					return logs, err
+				}
 				// TODO does the size need to be sent?
 				logs = append(logs, ResourceLog{
 					ID:         log.ID,
-					LogMessage: log.Message,
+					LogMessage: message,
 					Rerun:      taskPod.Rerun,
 					TaskType:   taskPod.TaskType,
 				})
@@ -358,6 +362,14 @@ func (h APIHandler) GetInfra3TaskLogsViaTask(c *gin.Context) {
 		c.JSON(http.StatusOK, response(http.StatusOK, "TaskPod "+result.Error.Error(), emptyResponse))
 		return
 	}
+	for i := range infra3TaskLogs {
+		message, err := taskLogMessage(c, h.LogStore, infra3TaskLogs[i])
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), emptyResponse))
+			return
+		}
+		infra3TaskLogs[i].Message = message
+	}
 
 	c.JSON(http.StatusOK, response(http.StatusOK, "", infra3TaskLogs))
 }
@@ -419,7 +431,19 @@ func (h APIHandler) GetTaskPod(c *gin.Context) {
 
 type approvalResponse struct {
 	models.Approval `json:",inline"`
-	Status          string `json:"status"`
+	Status          string              `json:"status"`
+	PlanSummary     *models.PlanSummary `json:"plan_summary,omitempty"`
+	Quorum          *ApprovalQuorum     `json:"quorum,omitempty"`
+}
+
+// decidedApprovalResponse returns the approval of the plan with its status. An approval that expired or
+// was invalidated is reported as not approved, so a task only reading is_approved doesn't apply it.
+func decidedApprovalResponse(db *gorm.DB, approval models.Approval, taskPod models.TaskPod) approvalResponse {
+	status := approvalStatus(db, approval, taskPod)
+	if status != "complete" {
+		approval.IsApproved = false
+	}
+	return approvalResponse{Approval: approval, Status: status}
 }
 
 func (h APIHandler) AllApprovals(c *gin.Context) {
@@ -445,23 +469,21 @@ func (h APIHandler) GetApprovalStatusViaTaskPodUUID(c *gin.Context) {
 
 	approvals := []models.Approval{}
 	if result := h.DB.Where("task_pod_uuid = ?", &taskPod.UUID).First(&approvals); result.Error != nil {
+		// The approval is only saved once the quorum of the approval policy is reached
+		quorum, _ := h.approvalQuorum(taskPod)
 		c.JSON(http.StatusOK, response(http.StatusOK, "Approval "+result.Error.Error(), []approvalResponse{
 			{
 				Status: "nodata",
 				Approval: models.Approval{
 					TaskPodUUID: taskPodUUID,
 				},
+				Quorum: quorum,
 			},
 		}))
 		return
 	}
 
-	c.JSON(http.StatusOK, response(http.StatusOK, "", []approvalResponse{
-		{
-			Approval: approvals[0],
-			Status:   "complete",
-		},
-	}))
+	c.JSON(http.StatusOK, response(http.StatusOK, "", []approvalResponse{decidedApprovalResponse(h.DB, approvals[0], taskPod)}))
 }
 
 // GetApprovalStatus only looks at the latest resource spec by getting the TFOResource's 'LatestGeneration'.
@@ -509,35 +531,42 @@ func (h APIHandler) GetApprovalStatus(c *gin.Context) {
 		return
 	}
 	taskPod, _ := highestRerun(taskPods, taskType, 0)
+	summary, err := planSummary(c, h.DB, h.LogStore, taskPod)
+	if err != nil {
+		log.Printf("ERROR summarizing plan %s: %s", taskPod.UUID, err)
+	}
 
 	// status := -1
 	approvals := []models.Approval{}
 	if result := h.DB.Where("task_pod_uuid = ?", &taskPod.UUID).First(&approvals); result.Error != nil {
+		quorum, _ := h.approvalQuorum(taskPod)
 		c.JSON(http.StatusOK, response(http.StatusOK, "Approval "+result.Error.Error(), []approvalResponse{
 			{
 				Status: "nodata",
 				Approval: models.Approval{
 					TaskPodUUID: taskPod.UUID,
 				},
+				PlanSummary: summary,
+				Quorum:      quorum,
 			},
 		}))
 		return
 	}
 
-	c.JSON(http.StatusOK, response(http.StatusOK, "", []approvalResponse{
-		{
-			Approval: approvals[0],
-			Status:   "complete",
-		},
-	}))
+	decided := decidedApprovalResponse(h.DB, approvals[0], taskPod)
+	decided.PlanSummary = summary
+	c.JSON(http.StatusOK, response(http.StatusOK, planSummaryMessage(summary), []approvalResponse{decided}))
 }
 
-// UpdateApproval takes the uuid and a JSON data param and create a row in the approval table.
+// UpdateApproval takes the uuid and a JSON data param and votes on the plan. The row in the approval table
+// is created once the votes reach the quorum of the approval policy.
 func (h APIHandler) UpdateApproval(c *gin.Context) {
 	uuid := c.Param("task_pod_uuid")
 
 	type Approval struct {
-		IsApproved bool `json:"is_approved"`
+		IsApproved bool   `json:"is_approved"`
+		Comment    string `json:"comment"`
+		TicketURL  string `json:"ticket_url"`
 	}
 	approvalData := new(Approval)
 	err := c.BindJSON(approvalData)
@@ -549,28 +578,25 @@ func (h APIHandler) UpdateApproval(c *gin.Context) {
 
 	log.Print(approvalData)
 
-	approval := models.Approval{}
-	if result := h.DB.Where("task_pod_uuid = ?", &uuid).First(&approval); result.Error == nil {
-		// TODO Approval is already set, user should be informed
-		c.JSON(http.StatusNoContent, nil)
+	vote := models.ApprovalVote{
+		Approver:   username(c),
+		IsApproved: approvalData.IsApproved,
+		Comment:    approvalData.Comment,
+		TicketURL:  approvalData.TicketURL,
+	}
+	if err := validateApprovalVote(vote); err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, err.Error(), []any{}))
 		return
-	} else {
-		if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			// TODO Something unexpected happened
-			c.JSON(http.StatusBadRequest, nil)
-			return
-		}
 	}
 
-	approval = models.Approval{
-		IsApproved:  approvalData.IsApproved,
-		TaskPodUUID: uuid,
+	quorum, err := h.castApprovalVote(uuid, vote)
+	if err != nil {
+		status := approvalVoteStatus(err)
+		c.JSON(status, response(int64(status), err.Error(), []any{}))
+		return
 	}
-
-	createResult := h.DB.Create(&approval)
-	if createResult.Error != nil {
-		// TODO Something unexpected happened
-		c.JSON(http.StatusBadRequest, nil)
+	if !quorum.Decided {
+		c.JSON(http.StatusAccepted, response(http.StatusAccepted, fmt.Sprintf("%d of %d approvals", quorum.Approvals, quorum.Required), []ApprovalQuorum{*quorum}))
 		return
 	}
 
@@ -578,6 +604,26 @@ func (h APIHandler) UpdateApproval(c *gin.Context) {
 
 }
 
+// RevokeApproval withdraws the vote of the caller on the plan. Privileged users can revoke the vote of
+// another approver with the "approver" query param. A decided approval can only be revoked until the
+// next task of the workflow starts.
+func (h APIHandler) RevokeApproval(c *gin.Context) {
+	approver := username(c)
+	if other := c.Query("approver"); other != "" && other != approver {
+		if !h.requireRole(c, RolePrivileged) {
+			return
+		}
+		approver = other
+	}
+	quorum, err := h.revokeApprovalVote(c.Param("task_pod_uuid"), approver, username(c))
+	if err != nil {
+		status := approvalVoteStatus(err)
+		c.JSON(status, response(int64(status), err.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, fmt.Sprintf("%d of %d approvals", quorum.Approvals, quorum.Required), []ApprovalQuorum{*quorum}))
+}
+
 type SocketListener struct {
 	Connection  *websocket.Conn
 	IsListening bool
@@ -827,7 +873,7 @@ func (h APIHandler) UnlockTerraform(c *gin.Context) {
 		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, fmt.Sprintf("terraform unlock failed: %s", err), nil))
 		return
 	}
-	err = rerun(h.clientset, clusterName, namespace, name, "unlock-terraform-triggered-rerun", c)
+	_, err = rerun(h.clientset, clusterName, namespace, name, "unlock-terraform-triggered-rerun", c)
 	if err != nil {
 		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, fmt.Sprintf("Failed to trigger rerun: %s", err), []any{}))
 		return
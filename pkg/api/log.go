@@ -1,12 +1,15 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/galleybytes/infrakube-stella/pkg/common/logstore"
 	"github.com/galleybytes/infrakube-stella/pkg/common/models"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -64,6 +67,11 @@ func (h APIHandler) AddTaskPod(c *gin.Context) {
 		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), nil))
 		return
 	}
+	if result.RowsAffected == 1 {
+		h.flushTaskLogs(c, taskPod.Infra3ResourceUUID, taskPod.UUID)
+		h.publishTaskPodEvent(EventTaskStarted, taskPod, map[string]any{"task_type": taskPod.TaskType, "rerun": taskPod.Rerun}, "")
+		h.publishApprovalRequired(taskPod)
+	}
 
 	if jsonData.Content == "" {
 		c.JSON(http.StatusOK, response(http.StatusOK, "", []models.TaskPod{taskPod}))
@@ -71,7 +79,7 @@ func (h APIHandler) AddTaskPod(c *gin.Context) {
 	}
 
 	// Task calls will generally contain content. Save the message to the database.
-	err = saveTaskLog(h.DB, taskPod.UUID, jsonData.Content)
+	err = h.saveTaskLog(c, taskPod, jsonData.Content)
 	if err != nil {
 		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), nil))
 		return
@@ -83,36 +91,155 @@ func (h APIHandler) AddTaskPod(c *gin.Context) {
 
 }
 
-// Write or update logs in database
-func saveTaskLog(db *gorm.DB, taskUUID, content string) error {
+// Write or update logs in database. Secrets are masked before the content is saved. Masks are the same
+// length as the secret so the size of the sent log always matches the size of the saved log. The trailing
+// line is only saved once it ends so a secret split between two updates is masked as a whole.
+func (h APIHandler) saveTaskLog(ctx context.Context, taskPod models.TaskPod, content string) error {
 	now := time.Now().UTC()
 	taskLog := models.Infra3TaskLog{
 		Model: gorm.Model{
 			CreatedAt: now,
 			UpdatedAt: now,
 		},
-		TaskPodUUID: taskUUID,
-		Message:     content,
-		Size:        uint64(len([]byte(content))),
+		TaskPodUUID: taskPod.UUID,
+		Size:        0,
 	}
 
-	if result := db.Where("task_pod_uuid = ?", &taskLog.TaskPodUUID).FirstOrCreate(&taskLog); result.Error != nil {
+	if result := h.DB.Where("task_pod_uuid = ?", &taskLog.TaskPodUUID).FirstOrCreate(&taskLog); result.Error != nil {
 		return fmt.Errorf("failed to save task log: %+v, %+v", taskLog, result.Error)
 	}
 
-	if taskLog.Size != uint64(len([]byte(content))) {
-		if taskLog.Size > uint64(len([]byte(content))) {
-			return fmt.Errorf("sent log's size was smaller than earlier recorded log")
+	if taskLog.Size+uint64(len(taskLog.Pending)) == uint64(len([]byte(content))) {
+		return nil
+	}
+	if taskLog.Size > uint64(len([]byte(content))) {
+		return fmt.Errorf("sent log's size was smaller than earlier recorded log")
+	}
+	// The content has been updated. Read the bytes after what has already been written to preserve the
+	// original content. We don't want to allow logs in the database to be changed once they are written.
+	chunk, pending, saved := h.Redactor.redactLogUpdate(content, int(taskLog.Size), h.secretEnvValues(ctx, taskPod.Infra3ResourceUUID, taskPod.Generation))
+	taskLog.Pending = pending
+	if err := h.appendTaskLog(ctx, taskPod, &taskLog, chunk); err != nil {
+		return err
+	}
+	if len(saved) > 0 {
+		saveRedactionAudit(h.DB, "task_log", taskPod.Infra3ResourceUUID, taskPod.Generation, taskPod.UUID, saved)
+	}
+	return nil
+}
+
+// appendTaskLog appends the redacted chunk to the task log and saves it. Only the content written since
+// the last offloaded chunk is kept in the message; once it outgrows the threshold it is written to the log
+// store as the next chunk, so appending never reads or rewrites what was offloaded before. The summary of
+// a plan is updated from the chunk as well.
+func (h APIHandler) appendTaskLog(ctx context.Context, taskPod models.TaskPod, taskLog *models.Infra3TaskLog, chunk string) error {
+	taskLog.UpdatedAt = time.Now().UTC()
+	taskLog.Size += uint64(len([]byte(chunk)))
+	taskLog.Message += chunk
+
+	// A log stays in the store it was first offloaded to
+	offload := h.LogStore != nil && h.LogStoreThreshold > 0 && len(taskLog.Message) > h.LogStoreThreshold &&
+		(taskLog.Store == "" || taskLog.Store == h.LogStore.Name())
+	if offload {
+		if taskLog.StoreKey == "" {
+			taskLog.StoreKey = logStoreKey(taskPod)
 		}
-		// The content has been updated. Read the bytes after what has already been written to preserve the
-		// original content. We don't want to allow logs in the database to be changed once they are written.
-		taskLog.UpdatedAt = now
-		taskLog.Message += string([]byte(content)[taskLog.Size:])
-		taskLog.Size = uint64(len([]byte(taskLog.Message)))
-		if result := db.Save(&taskLog); result.Error != nil {
-			return result.Error
+		n := taskLogChunks(*taskLog)
+		if err := h.LogStore.Write(ctx, logChunkKey(taskLog.StoreKey, n), []byte(taskLog.Message)); err != nil {
+			return fmt.Errorf("failed to write task log to the %s log store: %s", h.LogStore.Name(), err)
 		}
+		taskLog.Store = h.LogStore.Name()
+		taskLog.StoreChunks = n + 1
+		taskLog.Message = ""
+	}
+	if result := h.DB.Save(taskLog); result.Error != nil {
+		return result.Error
+	}
+	if err := updatePlanSummary(h.DB, taskPod, chunk, taskLog.Size); err != nil {
+		return fmt.Errorf("failed to save the plan summary: %s", err)
 	}
-
 	return nil
 }
+
+// flushTaskLogs saves the held back trailing line of the logs of the resource's tasks other than except.
+// It is called once the tasks are done, ie when the next task starts or the workflow reports its state.
+func (h APIHandler) flushTaskLogs(ctx context.Context, infra3ResourceUUID, except string) {
+	var taskLogs []models.Infra3TaskLog
+	result := h.DB.Joins("JOIN task_pods ON task_pods.uuid = infra3_task_logs.task_pod_uuid").
+		Where("task_pods.infra3_resource_uuid = ? AND task_pods.uuid <> ? AND infra3_task_logs.pending <> ''", infra3ResourceUUID, except).
+		Preload("TaskPod").
+		Find(&taskLogs)
+	if result.Error != nil {
+		log.Printf("ERROR selecting task logs of %s to flush: %s", infra3ResourceUUID, result.Error)
+		return
+	}
+	for _, taskLog := range taskLogs {
+		chunk := taskLog.Pending
+		taskLog.Pending = ""
+		if err := h.appendTaskLog(ctx, taskLog.TaskPod, &taskLog, chunk); err != nil {
+			log.Printf("ERROR flushing task log of %s: %s", taskLog.TaskPodUUID, err)
+		}
+	}
+}
+
+func logStoreKey(taskPod models.TaskPod) string {
+	return fmt.Sprintf("%s/%s/%s.log", taskPod.Infra3ResourceUUID, taskPod.Generation, taskPod.UUID)
+}
+
+// taskLogChunks returns how many chunks of the task log are in the log store. Logs offloaded before logs
+// were chunked are a single object.
+func taskLogChunks(taskLog models.Infra3TaskLog) int {
+	if taskLog.Store != "" && taskLog.StoreChunks == 0 {
+		return 1
+	}
+	return taskLog.StoreChunks
+}
+
+// logChunkKey returns the key of the n-th chunk of an offloaded log. The first chunk is saved at the key
+// of the log itself.
+func logChunkKey(key string, n int) string {
+	if n == 0 {
+		return key
+	}
+	return fmt.Sprintf("%s.%d", key, n)
+}
+
+// logChunkKeys returns the keys of every chunk of the offloaded task log
+func logChunkKeys(taskLog models.Infra3TaskLog) []string {
+	keys := []string{}
+	for n := range taskLogChunks(taskLog) {
+		keys = append(keys, logChunkKey(taskLog.StoreKey, n))
+	}
+	return keys
+}
+
+// liveTaskLogMessage returns the message of the task log followed by the trailing line that is held back
+// until it ends, so the log of a running task shows output that doesn't end with a newline, eg a prompt.
+func liveTaskLogMessage(ctx context.Context, store logstore.LogStore, taskLog models.Infra3TaskLog) (string, error) {
+	message, err := taskLogMessage(ctx, store, taskLog)
+	if err != nil {
+		return "", err
+	}
+	return message + maskUnterminatedBlock(taskLog.Pending), nil
+}
+
+// taskLogMessage returns the message of the task log. The chunks of logs that were offloaded are read from
+// the log store.
+func taskLogMessage(ctx context.Context, store logstore.LogStore, taskLog models.Infra3TaskLog) (string, error) {
+	if taskLog.Store == "" {
+		return taskLog.Message, nil
+	}
+	if store == nil || store.Name() != taskLog.Store {
+		return "", fmt.Errorf("task log of %s was saved to the %s log store which is not configured", taskLog.TaskPodUUID, taskLog.Store)
+	}
+	var message strings.Builder
+	for _, key := range logChunkKeys(taskLog) {
+		b, err := store.Read(ctx, key)
+		if err != nil {
+			return "", fmt.Errorf("failed to read task log of %s: %s", taskLog.TaskPodUUID, err)
+		}
+		message.Write(b)
+	}
+	message.WriteString(taskLog.Message)
+	return message.String(), nil
+}
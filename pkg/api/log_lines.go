@@ -0,0 +1,161 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// LogLine is a single line of a task log. Logs are append-only so the number of a line never changes
+// once it is written, which makes "line 842 of the plan" a stable reference.
+type LogLine struct {
+	LineNo int    `json:"line_no"`
+	Text   string `json:"text"`
+}
+
+// logLines splits a message into numbered lines and returns the lines between from and to, inclusive.
+// A bound of zero is open. The total number of lines in the message is returned as well.
+func logLines(message string, from, to int) ([]LogLine, int) {
+	message = strings.TrimSuffix(message, "\n")
+	if message == "" {
+		return []LogLine{}, 0
+	}
+	split := strings.Split(message, "\n")
+	total := len(split)
+	if from < 1 {
+		from = 1
+	}
+	if to < 1 || to > total {
+		to = total
+	}
+
+	lines := []LogLine{}
+	for lineNo := from; lineNo <= to; lineNo++ {
+		lines = append(lines, LogLine{
+			LineNo: lineNo,
+			Text:   strings.TrimSuffix(split[lineNo-1], "\r"),
+		})
+	}
+	return lines, total
+}
+
+// lineRange reads the "from_line" and "to_line" query params. Line numbers start at 1 and zero means the
+// bound is not set.
+func lineRange(c *gin.Context) (int, int, error) {
+	bounds := []int{0, 0}
+	for i, param := range []string{"from_line", "to_line"} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return 0, 0, fmt.Errorf("%s must be a line number greater than 0, got '%s'", param, value)
+		}
+		bounds[i] = n
+	}
+	if bounds[1] > 0 && bounds[0] > bounds[1] {
+		return 0, 0, fmt.Errorf("from_line %d is after to_line %d", bounds[0], bounds[1])
+	}
+	return bounds[0], bounds[1], nil
+}
+
+// splitLines reports if the client asked for line split logs with "split=lines" or a line range
+func splitLines(c *gin.Context) bool {
+	return c.Query("split") == "lines" || c.Query("from_line") != "" || c.Query("to_line") != ""
+}
+
+// splitTaskLogs replaces the message of each task log with its lines when the client asked for line
+// split logs
+func splitTaskLogs(c *gin.Context, taskLogs []TaskLog) error {
+	if !splitLines(c) {
+		return nil
+	}
+	from, to, err := lineRange(c)
+	if err != nil {
+		return err
+	}
+	for i := range taskLogs {
+		taskLogs[i].Lines, taskLogs[i].TotalLines = logLines(taskLogs[i].Message, from, to)
+		taskLogs[i].Message = ""
+	}
+	return nil
+}
+
+// getTaskLogLines returns the lines of a single task log. The "from_line" and "to_line" query params
+// select a range of lines.
+func (h APIHandler) getTaskLogLines(c *gin.Context) {
+	from, to, err := lineRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, err.Error(), []any{}))
+		return
+	}
+	h.taskLogLines(c, from, to, 0)
+}
+
+// getTaskLogLine is the permalink of a line in a task log. Use the "context" query param to include the
+// given number of lines before and after the linked line.
+func (h APIHandler) getTaskLogLine(c *gin.Context) {
+	lineNo, err := strconv.Atoi(c.Param("line_no"))
+	if err != nil || lineNo < 1 {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, fmt.Sprintf("line_no must be a line number greater than 0, got '%s'", c.Param("line_no")), []any{}))
+		return
+	}
+	context := 0
+	if value := c.Query("context"); value != "" {
+		context, err = strconv.Atoi(value)
+		if err != nil || context < 0 {
+			c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, fmt.Sprintf("context must be a positive number of lines, got '%s'", value), []any{}))
+			return
+		}
+	}
+	h.taskLogLines(c, max(lineNo-context, 1), lineNo+context, lineNo)
+}
+
+// taskLogLines responds with the lines of a task log between from and to. When linked is set, the line
+// must exist in the log.
+func (h APIHandler) taskLogLines(c *gin.Context, from, to, linked int) {
+	infra3ResourceUUID := c.Param("infra3_resource_uuid")
+	taskPodUUID := c.Param("task_pod_uuid")
+
+	var taskPod models.TaskPod
+	if result := h.DB.First(&taskPod, "uuid = ? AND infra3_resource_uuid = ?", taskPodUUID, infra3ResourceUUID); result.Error != nil {
+		c.JSON(http.StatusNotFound, response(http.StatusNotFound, result.Error.Error(), []any{}))
+		return
+	}
+
+	var taskLog models.Infra3TaskLog
+	result := h.DB.Where("task_pod_uuid = ?", taskPodUUID).First(&taskLog)
+	if result.Error != nil && !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	message, err := liveTaskLogMessage(c, h.LogStore, taskLog)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+
+	lines, total := logLines(message, from, to)
+	if linked > total {
+		c.JSON(http.StatusNotFound, response(http.StatusNotFound, fmt.Sprintf("line %d not found, the %s log has %d lines", linked, taskPod.TaskType, total), []any{}))
+		return
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, "", []TaskLog{{
+		TaskType:   taskPod.TaskType,
+		UUID:       taskPod.UUID,
+		Rerun:      taskPod.Rerun,
+		TaskID:     taskTypeID(taskPod.TaskType),
+		Lines:      lines,
+		TotalLines: total,
+		CreatedAt:  taskLog.CreatedAt,
+		UpdatedAt:  taskLog.UpdatedAt,
+	}}))
+}
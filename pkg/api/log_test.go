@@ -0,0 +1,46 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/logstore"
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+)
+
+func TestTaskLogMessageChunks(t *testing.T) {
+	ctx := context.Background()
+	store := &logstore.Filesystem{Dir: t.TempDir()}
+	key := "uuid/1/task.log"
+	for n, chunk := range []string{"first\n", "second\n", "third\n"} {
+		if err := store.Write(ctx, logChunkKey(key, n), []byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		taskLog models.Infra3TaskLog
+		want    string
+	}{
+		{"not offloaded", models.Infra3TaskLog{Message: "tail\n"}, "tail\n"},
+		{"offloaded before chunking", models.Infra3TaskLog{Store: "filesystem", StoreKey: key}, "first\n"},
+		{"chunks and tail", models.Infra3TaskLog{Store: "filesystem", StoreKey: key, StoreChunks: 3, Message: "tail\n"}, "first\nsecond\nthird\ntail\n"},
+	} {
+		got, err := taskLogMessage(ctx, store, tc.taskLog)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	if _, err := taskLogMessage(ctx, store, models.Infra3TaskLog{Store: "filesystem", StoreKey: key, StoreChunks: 4}); err == nil {
+		t.Error("a missing chunk must be an error")
+	}
+	if _, err := taskLogMessage(ctx, nil, models.Infra3TaskLog{Store: "s3", StoreKey: key}); err == nil {
+		t.Error("a log in a store that is not configured must be an error")
+	}
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/galleybytes/infrakube-stella/pkg/common/models"
@@ -12,7 +13,7 @@ import (
 
 func resourceLog(db *gorm.DB, taskUUID string) *gorm.DB {
 	return db.Table("infra3_task_logs").
-		Select("message, updated_at, created_at").
+		Select("task_pod_uuid, message, pending, store, store_key, store_chunks, updated_at, created_at").
 		Where("task_pod_uuid = ?", taskUUID)
 }
 
@@ -164,6 +165,52 @@ func (h APIHandler) TotalFailedResources(c *gin.Context) {
 	c.JSON(http.StatusOK, response(http.StatusOK, "", []int64{count}))
 }
 
+// RetentionMetrics returns the totals reclaimed by the retention job and the most recent runs
+func (h APIHandler) RetentionMetrics(c *gin.Context) {
+	var totals struct {
+		Runs           int64 `json:"runs"`
+		TaskLogs       int64 `json:"task_logs"`
+		TaskPods       int64 `json:"task_pods"`
+		ResourceSpecs  int64 `json:"resource_specs"`
+		RefreshTokens  int64 `json:"refresh_tokens"`
+		Resources      int64 `json:"resources"`
+		BytesReclaimed int64 `json:"bytes_reclaimed"`
+	}
+	result := h.DB.Model(&models.RetentionRun{}).
+		Select(`
+			COUNT(*) AS runs,
+			COALESCE(SUM(task_logs), 0) AS task_logs,
+			COALESCE(SUM(task_pods), 0) AS task_pods,
+			COALESCE(SUM(resource_specs), 0) AS resource_specs,
+			COALESCE(SUM(refresh_tokens), 0) AS refresh_tokens,
+			COALESCE(SUM(resources), 0) AS resources,
+			COALESCE(SUM(bytes_reclaimed), 0) AS bytes_reclaimed
+		`).
+		Where("dry_run = false AND error = ''").
+		Scan(&totals)
+	if result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit == 0 {
+		limit = 10
+	}
+	runs := []models.RetentionRun{}
+	h.DB.Order("id desc").Limit(limit).Find(&runs)
+
+	c.JSON(http.StatusOK, response(http.StatusOK, "", []any{
+		struct {
+			Totals any                   `json:"totals"`
+			Runs   []models.RetentionRun `json:"runs"`
+		}{
+			Totals: totals,
+			Runs:   runs,
+		},
+	}))
+}
+
 func (h APIHandler) dashboardRedirect(c *gin.Context) {
 	if h.dashboard == nil {
 		c.JSON(http.StatusNotFound, response(http.StatusNotFound, "--dashboard not configured", []any{}))
@@ -0,0 +1,713 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	notificationSlack = "slack"
+	notificationTeams = "teams"
+
+	notificationPending   = "pending"
+	notificationDelivered = "delivered"
+	notificationFailed    = "failed"
+
+	// notificationSuppressed is the status of a notification that repeats a recent notification
+	notificationSuppressed = "suppressed"
+
+	// defaultNotificationDedupWindow is how long repeated failures are suppressed when the channel does
+	// not set a window
+	defaultNotificationDedupWindow = time.Hour
+
+	// notificationLogTailLines and notificationLogTailSize limit the task log shown in failure messages
+	notificationLogTailLines = 20
+	notificationLogTailSize  = 2500
+
+	quietHoursLayout = "15:04"
+
+	// notificationApprovalLinkTTL is how long the approval links in notifications are valid
+	notificationApprovalLinkTTL = 4 * time.Hour
+
+	// notificationLinkMinter mints the approval links of approval required notifications
+	notificationLinkMinter = systemApproverPrefix + "notifications"
+)
+
+// notificationKinds lists the supported notification channel kinds
+var notificationKinds = []string{notificationSlack, notificationTeams, notificationEmail}
+
+// notificationStatuses are the statuses of notifications that are sent
+var notificationStatuses = deliveryStatuses{
+	pending:   notificationPending,
+	delivered: notificationDelivered,
+	failed:    notificationFailed,
+}
+
+// notificationMessage is the content of a notification before it is formatted for a channel. ApproveURL
+// and DenyURL are the approval links of the approver of the channel.
+type notificationMessage struct {
+	Title      string
+	Text       string
+	Facts      [][2]string
+	Log        string
+	URL        string
+	ApproveURL string
+	DenyURL    string
+}
+
+// quietHoursEnd reports if now is within the quiet hours of the channel and returns when they end
+func quietHoursEnd(channel models.NotificationChannel, now time.Time) (time.Time, bool) {
+	if channel.QuietHoursStart == "" || channel.QuietHoursEnd == "" {
+		return time.Time{}, false
+	}
+	location := time.UTC
+	if channel.Timezone != "" {
+		if l, err := time.LoadLocation(channel.Timezone); err == nil {
+			location = l
+		}
+	}
+	start, err := time.Parse(quietHoursLayout, channel.QuietHoursStart)
+	if err != nil {
+		return time.Time{}, false
+	}
+	end, err := time.Parse(quietHoursLayout, channel.QuietHoursEnd)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	now = now.In(location)
+	minute := now.Hour()*60 + now.Minute()
+	startMinute := start.Hour()*60 + start.Minute()
+	endMinute := end.Hour()*60 + end.Minute()
+	quiet := minute >= startMinute && minute < endMinute
+	if startMinute > endMinute {
+		// Quiet hours span midnight, eg 22:00 to 07:00
+		quiet = minute >= startMinute || minute < endMinute
+	}
+	if !quiet {
+		return time.Time{}, false
+	}
+	endsAt := time.Date(now.Year(), now.Month(), now.Day(), end.Hour(), end.Minute(), 0, 0, location)
+	if !endsAt.After(now) {
+		endsAt = endsAt.AddDate(0, 0, 1)
+	}
+	return endsAt, true
+}
+
+// notificationDedupWindow is how long repeats of a notification are suppressed in the channel
+func notificationDedupWindow(channel models.NotificationChannel) time.Duration {
+	if channel.DedupWindow == "" {
+		return defaultNotificationDedupWindow
+	}
+	window, err := time.ParseDuration(channel.DedupWindow)
+	if err != nil {
+		return defaultNotificationDedupWindow
+	}
+	return window
+}
+
+// notificationDedupKey identifies repeats of the event. Only failures of the same generation are treated
+// as repeats, so every approval and completion is notified.
+func notificationDedupKey(event models.Event) string {
+	if event.Type != EventWorkflowFailed {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s/%s", event.Type, event.Infra3ResourceUUID, event.Generation)
+}
+
+// enqueueNotifications creates a notification of the event for every enabled channel routed to it. Repeats
+// are saved as suppressed and notifications during quiet hours wait until the quiet hours end.
+func (h APIHandler) enqueueNotifications(event models.Event) {
+	var channels []models.NotificationChannel
+	if result := h.DB.Where("enabled").Find(&channels); result.Error != nil {
+		log.Printf("ERROR listing notification channels for %s event: %s", event.Type, result.Error)
+		return
+	}
+	now := time.Now()
+	for _, channel := range channels {
+		if !eventMatches(channel.EventTypes, channel.Cluster, channel.Namespace, event) {
+			continue
+		}
+		notification := models.Notification{
+			ChannelID:     channel.ID,
+			EventID:       event.ID,
+			EventType:     event.Type,
+			DedupKey:      notificationDedupKey(event),
+			Status:        notificationPending,
+			NextAttemptAt: now,
+		}
+		if window := notificationDedupWindow(channel); notification.DedupKey != "" && window > 0 {
+			var previous models.Notification
+			result := h.DB.Where("channel_id = ? AND dedup_key = ? AND status <> ? AND created_at > ?", channel.ID, notification.DedupKey, notificationSuppressed, now.Add(-window)).
+				Order("id DESC").Limit(1).Find(&previous)
+			if result.Error == nil && previous.ID != 0 {
+				notification.Status = notificationSuppressed
+				notification.DuplicateOf = &previous.ID
+			}
+		}
+		endsAt, quiet := quietHoursEnd(channel, now)
+		if quiet {
+			notification.NextAttemptAt = endsAt
+		}
+		if result := h.DB.Create(&notification); result.Error != nil {
+			log.Printf("ERROR queueing %s notification for channel '%s': %s", event.Type, channel.Name, result.Error)
+			continue
+		}
+		if notification.Status == notificationPending && !quiet {
+			go h.attemptNotification(context.Background(), notification.ID)
+		}
+	}
+}
+
+// taskLogTail returns the type of the newest task of the event's generation and the end of its log
+func (h APIHandler) taskLogTail(ctx context.Context, event models.Event) (string, string) {
+	var taskPod models.TaskPod
+	query := h.DB.Where("infra3_resource_uuid = ? AND generation = ?", event.Infra3ResourceUUID, event.Generation)
+	if event.TaskPodUUID != "" {
+		query = h.DB.Where("uuid = ?", event.TaskPodUUID)
+	}
+	if result := query.Order("created_at DESC").Limit(1).Find(&taskPod); result.Error != nil || taskPod.UUID == "" {
+		return "", ""
+	}
+	var taskLog models.Infra3TaskLog
+	if result := h.DB.Where("task_pod_uuid = ?", taskPod.UUID).Limit(1).Find(&taskLog); result.Error != nil || taskLog.ID == 0 {
+		return taskPod.TaskType, ""
+	}
+	message, err := taskLogMessage(ctx, h.LogStore, taskLog)
+	if err != nil {
+		return taskPod.TaskType, ""
+	}
+	lines := strings.Split(strings.TrimRight(ansiColorRegex.ReplaceAllString(message, ""), "\n"), "\n")
+	if len(lines) > notificationLogTailLines {
+		lines = lines[len(lines)-notificationLogTailLines:]
+	}
+	tail := strings.Join(lines, "\n")
+	if len(tail) > notificationLogTailSize {
+		tail = "..." + tail[len(tail)-notificationLogTailSize:]
+	}
+	return taskPod.TaskType, tail
+}
+
+// notificationMessage describes the event for people
+func (h APIHandler) notificationMessage(ctx context.Context, event models.Event) notificationMessage {
+	resource := event.Namespace + "/" + event.Name
+	msg := notificationMessage{
+		Facts: [][2]string{
+			{"Cluster", event.ClusterName},
+			{"Namespace", event.Namespace},
+			{"Resource", event.Name},
+			{"Generation", event.Generation},
+		},
+	}
+	if event.TaskPodUUID != "" {
+		msg.Facts = append(msg.Facts, [2]string{"Task", event.TaskPodUUID})
+	}
+	if h.dashboard != nil && *h.dashboard != "" {
+		msg.URL = *h.dashboard
+	}
+
+	switch event.Type {
+	case EventApprovalRequired:
+		msg.Title = fmt.Sprintf("Approval required for %s", resource)
+		msg.Text = fmt.Sprintf("The plan of generation %s on %s is waiting for %v approval(s).", event.Generation, event.ClusterName, event.Data["required"])
+	case EventApprovalDecided:
+		decision := "denied"
+		if approved, _ := event.Data["is_approved"].(bool); approved {
+			decision = "approved"
+		}
+		msg.Title = fmt.Sprintf("Plan of %s %s", resource, decision)
+		msg.Text = fmt.Sprintf("The plan of generation %s was %s by %v.", event.Generation, decision, event.Data["approver"])
+		if comment, _ := event.Data["comment"].(string); comment != "" {
+			msg.Facts = append(msg.Facts, [2]string{"Comment", comment})
+		}
+		if ticketURL, _ := event.Data["ticket_url"].(string); ticketURL != "" {
+			msg.Facts = append(msg.Facts, [2]string{"Ticket", ticketURL})
+		}
+	case EventWorkflowFailed:
+		msg.Title = fmt.Sprintf("Workflow of %s failed", resource)
+		taskType, tail := h.taskLogTail(ctx, event)
+		msg.Text = fmt.Sprintf("Generation %s failed on %s.", event.Generation, event.ClusterName)
+		if taskType != "" {
+			msg.Text = fmt.Sprintf("The %s task of generation %s failed on %s.", taskType, event.Generation, event.ClusterName)
+		}
+		msg.Log = tail
+	case EventWorkflowCompleted:
+		msg.Title = fmt.Sprintf("Workflow of %s completed", resource)
+		msg.Text = fmt.Sprintf("Generation %s completed on %s.", event.Generation, event.ClusterName)
+	case EventDriftDetected:
+		msg.Title = fmt.Sprintf("Drift detected on %s", resource)
+		msg.Text = fmt.Sprintf("A drift check of generation %s on %s planned %v to add, %v to change and %v to destroy. The plan waits for approval.",
+			event.Generation, event.ClusterName, event.Data["add"], event.Data["change"], event.Data["destroy"])
+	case EventApprovalLink:
+		msg.Title = fmt.Sprintf("Approval links for %s", resource)
+		msg.Text = fmt.Sprintf("%v requested links for %v to approve or deny the plan of generation %s on %s.", event.Data["created_by"], event.Data["approver"], event.Generation, event.ClusterName)
+	case EventPing:
+		msg.Title = "Test notification from infra3-stella"
+		msg.Text = fmt.Sprintf("Sent by %v.", event.Data["sent_by"])
+		msg.Facts = nil
+	default:
+		msg.Title = fmt.Sprintf("%s: %s", event.Type, resource)
+	}
+	return msg
+}
+
+// notificationApprovalLinks mints approve and deny links for the approver of the channel when the event
+// asks for a decision on a plan. Links of approval required events are minted by the server, links of
+// approval link events by the user that requested them.
+func (h APIHandler) notificationApprovalLinks(msg *notificationMessage, channel models.NotificationChannel, event models.Event) error {
+	if channel.Approver == "" || event.TaskPodUUID == "" {
+		return nil
+	}
+	createdBy := notificationLinkMinter
+	baseURL := h.ApprovalLinkBaseURL
+	ttl := notificationApprovalLinkTTL
+	switch event.Type {
+	case EventApprovalRequired:
+		if baseURL == "" {
+			return fmt.Errorf("approval links in notifications require --approval-link-base-url")
+		}
+	case EventApprovalLink:
+		if approver, _ := event.Data["approver"].(string); approver != channel.Approver {
+			return fmt.Errorf("%w: the links were requested for '%v'", errUndeliverable, event.Data["approver"])
+		}
+		createdBy, _ = event.Data["created_by"].(string)
+		baseURL, _ = event.Data["base_url"].(string)
+		if s, _ := event.Data["ttl"].(string); s != "" {
+			ttl, _ = time.ParseDuration(s)
+		}
+	default:
+		return nil
+	}
+	links, err := h.mintApprovalLinks(event.TaskPodUUID, channel.Approver, createdBy, baseURL, ttl)
+	if err != nil {
+		return err
+	}
+	msg.ApproveURL = links.ApproveURL
+	msg.DenyURL = links.DenyURL
+	msg.Facts = append(msg.Facts, [2]string{"Approver", channel.Approver}, [2]string{"Links expire", links.ExpiresAt.UTC().Format(time.RFC1123)})
+	return nil
+}
+
+// slackEscape escapes the characters Slack uses for links and mentions
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// slackPayload formats the message with Slack Block Kit
+func slackPayload(msg notificationMessage) map[string]any {
+	title := msg.Title
+	if len(title) > 150 {
+		title = title[:147] + "..."
+	}
+	blocks := []map[string]any{
+		{"type": "header", "text": map[string]any{"type": "plain_text", "text": title}},
+	}
+	if msg.Text != "" {
+		blocks = append(blocks, map[string]any{"type": "section", "text": map[string]any{"type": "mrkdwn", "text": slackEscape(msg.Text)}})
+	}
+	fields := []map[string]any{}
+	for _, fact := range msg.Facts {
+		if fact[1] == "" || len(fields) == 10 {
+			continue
+		}
+		fields = append(fields, map[string]any{"type": "mrkdwn", "text": fmt.Sprintf("*%s*\n%s", fact[0], slackEscape(fact[1]))})
+	}
+	if len(fields) > 0 {
+		blocks = append(blocks, map[string]any{"type": "section", "fields": fields})
+	}
+	if msg.Log != "" {
+		text := "```" + slackEscape(strings.ReplaceAll(msg.Log, "```", "'''")) + "```"
+		blocks = append(blocks, map[string]any{"type": "section", "text": map[string]any{"type": "mrkdwn", "text": text}})
+	}
+	buttons := []map[string]any{}
+	if msg.ApproveURL != "" {
+		buttons = append(buttons,
+			map[string]any{"type": "button", "text": map[string]any{"type": "plain_text", "text": "Approve"}, "url": msg.ApproveURL, "style": "primary"},
+			map[string]any{"type": "button", "text": map[string]any{"type": "plain_text", "text": "Deny"}, "url": msg.DenyURL, "style": "danger"},
+		)
+	}
+	if msg.URL != "" {
+		buttons = append(buttons, map[string]any{"type": "button", "text": map[string]any{"type": "plain_text", "text": "Open dashboard"}, "url": msg.URL})
+	}
+	if len(buttons) > 0 {
+		blocks = append(blocks, map[string]any{"type": "actions", "elements": buttons})
+	}
+	return map[string]any{"text": msg.Title, "blocks": blocks}
+}
+
+// teamsPayload formats the message as a Teams adaptive card
+func teamsPayload(msg notificationMessage) map[string]any {
+	body := []map[string]any{
+		{"type": "TextBlock", "text": msg.Title, "weight": "Bolder", "size": "Medium", "wrap": true},
+	}
+	if msg.Text != "" {
+		body = append(body, map[string]any{"type": "TextBlock", "text": msg.Text, "wrap": true})
+	}
+	facts := []map[string]any{}
+	for _, fact := range msg.Facts {
+		if fact[1] != "" {
+			facts = append(facts, map[string]any{"title": fact[0], "value": fact[1]})
+		}
+	}
+	if len(facts) > 0 {
+		body = append(body, map[string]any{"type": "FactSet", "facts": facts})
+	}
+	if msg.Log != "" {
+		body = append(body, map[string]any{"type": "TextBlock", "text": msg.Log, "fontType": "Monospace", "wrap": true})
+	}
+	card := map[string]any{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body":    body,
+	}
+	actions := []map[string]any{}
+	if msg.ApproveURL != "" {
+		actions = append(actions,
+			map[string]any{"type": "Action.OpenUrl", "title": "Approve", "url": msg.ApproveURL},
+			map[string]any{"type": "Action.OpenUrl", "title": "Deny", "url": msg.DenyURL},
+		)
+	}
+	if msg.URL != "" {
+		actions = append(actions, map[string]any{"type": "Action.OpenUrl", "title": "Open dashboard", "url": msg.URL})
+	}
+	if len(actions) > 0 {
+		card["actions"] = actions
+	}
+	return map[string]any{
+		"type": "message",
+		"attachments": []map[string]any{
+			{"contentType": "application/vnd.microsoft.card.adaptive", "content": card},
+		},
+	}
+}
+
+// sendNotification formats the event for the kind of channel and sends it. It returns the status code of
+// chats and the recipients of emails.
+func (h APIHandler) sendNotification(ctx context.Context, channel models.NotificationChannel, event models.Event) (int, []string, error) {
+	msg := h.notificationMessage(ctx, event)
+	if err := h.notificationApprovalLinks(&msg, channel, event); err != nil {
+		// The links are what an approval link event is about, other messages are still worth sending
+		if event.Type == EventApprovalLink {
+			return 0, nil, err
+		}
+		log.Printf("ERROR minting approval links for notification channel '%s': %s", channel.Name, err)
+	}
+	var payload map[string]any
+	switch channel.Kind {
+	case notificationSlack:
+		payload = slackPayload(msg)
+	case notificationTeams:
+		payload = teamsPayload(msg)
+	case notificationEmail:
+		recipients, err := h.sendEmailNotification(ctx, channel, event, msg)
+		return 0, recipients, err
+	default:
+		return 0, nil, fmt.Errorf("%w: notification channel kind '%s' is not supported", errUndeliverable, channel.Kind)
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	statusCode, body, err := postJSON(ctx, channel.URL, b, nil)
+	if err != nil && body != "" {
+		err = fmt.Errorf("%s: %s", err, strings.TrimSpace(body))
+	}
+	return statusCode, nil, err
+}
+
+// notificationQueue sends notifications. Email notifications take the longest to send.
+func (h APIHandler) notificationQueue() deliveryQueue {
+	return deliveryQueue{
+		name:     "notification",
+		model:    &models.Notification{},
+		statuses: notificationStatuses,
+		lease:    2 * max(webhookTimeout, smtpTimeout),
+		send:     h.sendQueuedNotification,
+	}
+}
+
+// sendQueuedNotification sends the event of the notification to its channel
+func (h APIHandler) sendQueuedNotification(ctx context.Context, notificationID uint) (int, map[string]any, error) {
+	var notification models.Notification
+	if result := h.DB.First(&notification, notificationID); result.Error != nil {
+		return 0, nil, result.Error
+	}
+	var channel models.NotificationChannel
+	var event models.Event
+	if result := h.DB.Unscoped().First(&channel, notification.ChannelID); result.Error != nil {
+		return notification.Attempts, map[string]any{}, fmt.Errorf("%w: error reading notification channel: %s", errUndeliverable, result.Error)
+	}
+	if channel.DeletedAt.Valid {
+		return notification.Attempts, map[string]any{}, fmt.Errorf("%w: notification channel was deleted", errUndeliverable)
+	}
+	if result := h.DB.First(&event, notification.EventID); result.Error != nil {
+		return notification.Attempts, map[string]any{}, fmt.Errorf("%w: error reading event: %s", errUndeliverable, result.Error)
+	}
+	statusCode, recipients, err := h.sendNotification(ctx, channel, event)
+	if recipients != nil {
+		h.DB.Model(&notification).Select("Recipients").Updates(models.Notification{Recipients: recipients})
+	}
+	return notification.Attempts, map[string]any{"status_code": statusCode}, err
+}
+
+// attemptNotification sends the notification when it is due and records the outcome
+func (h APIHandler) attemptNotification(ctx context.Context, notificationID uint) {
+	h.attemptDelivery(ctx, h.notificationQueue(), notificationID)
+}
+
+// notificationChannelRequest is the body of create and update notification channel requests
+type notificationChannelRequest struct {
+	Name            string   `json:"name"`
+	Kind            string   `json:"kind"`
+	URL             *string  `json:"url"`
+	Recipients      []string `json:"recipients"`
+	EventTypes      []string `json:"event_types"`
+	Cluster         string   `json:"cluster"`
+	Namespace       string   `json:"namespace"`
+	QuietHoursStart string   `json:"quiet_hours_start"`
+	QuietHoursEnd   string   `json:"quiet_hours_end"`
+	Timezone        string   `json:"timezone"`
+	DedupWindow     string   `json:"dedup_window"`
+	Enabled         *bool    `json:"enabled"`
+	Approver        string   `json:"approver"`
+}
+
+// apply validates the request and sets it on the channel. The url is kept when it is not sent since it
+// is a secret of the chat. Empty patterns match everything and channels are enabled unless "enabled" is
+// false.
+func (r notificationChannelRequest) apply(channel *models.NotificationChannel) error {
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	known := false
+	for _, kind := range notificationKinds {
+		known = known || r.Kind == kind
+	}
+	if !known {
+		return fmt.Errorf("kind must be one of %s, got '%s'", strings.Join(notificationKinds, ", "), r.Kind)
+	}
+	if r.URL != nil {
+		channel.URL = *r.URL
+	}
+	if r.Kind == notificationEmail {
+		recipients, err := parseRecipients(strings.Join(r.Recipients, ","))
+		if err != nil {
+			return err
+		}
+		r.Recipients = recipients
+		if r.Approver != "" && len(r.Recipients) == 0 {
+			return fmt.Errorf("an email channel with an approver needs the recipients that reach the approver")
+		}
+	} else if u, err := url.Parse(channel.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an http or https url")
+	}
+	if r.Cluster == "" {
+		r.Cluster = "*"
+	}
+	if r.Namespace == "" {
+		r.Namespace = "*"
+	}
+	if err := validateEventPatterns(r.EventTypes, r.Cluster, r.Namespace); err != nil {
+		return err
+	}
+	if (r.QuietHoursStart == "") != (r.QuietHoursEnd == "") {
+		return fmt.Errorf("quiet_hours_start and quiet_hours_end must be set together")
+	}
+	for _, t := range []string{r.QuietHoursStart, r.QuietHoursEnd} {
+		if _, err := time.Parse(quietHoursLayout, t); t != "" && err != nil {
+			return fmt.Errorf("quiet hours must be formatted as HH:MM, got '%s'", t)
+		}
+	}
+	if _, err := time.LoadLocation(r.Timezone); err != nil {
+		return fmt.Errorf("timezone '%s' is invalid: %s", r.Timezone, err)
+	}
+	if r.DedupWindow != "" {
+		if window, err := time.ParseDuration(r.DedupWindow); err != nil || window < 0 {
+			return fmt.Errorf("dedup_window must be a duration like '1h', got '%s'", r.DedupWindow)
+		}
+	}
+	channel.Name = r.Name
+	channel.Kind = r.Kind
+	channel.Recipients = r.Recipients
+	channel.EventTypes = r.EventTypes
+	channel.Cluster = r.Cluster
+	channel.Namespace = r.Namespace
+	channel.QuietHoursStart = r.QuietHoursStart
+	channel.QuietHoursEnd = r.QuietHoursEnd
+	channel.Timezone = r.Timezone
+	channel.DedupWindow = r.DedupWindow
+	channel.Enabled = r.Enabled == nil || *r.Enabled
+	channel.Approver = r.Approver
+	return nil
+}
+
+func (h APIHandler) getNotificationChannels(c *gin.Context) {
+	channels := []models.NotificationChannel{}
+	if result := h.DB.Order("id").Find(&channels); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", channels))
+}
+
+// addNotificationChannel creates a channel, eg {"name": "team-a", "kind": "slack", "url":
+// "https://hooks.slack.com/services/...", "event_types": ["approval.required", "workflow.failed"],
+// "cluster": "prod-*", "namespace": "team-a-*", "quiet_hours_start": "22:00", "quiet_hours_end": "07:00",
+// "timezone": "Europe/Berlin"}. Only privileged users can manage channels.
+func (h APIHandler) addNotificationChannel(c *gin.Context) {
+	if !h.requireRole(c, RolePrivileged) {
+		return
+	}
+	var jsonData notificationChannelRequest
+	if err := c.BindJSON(&jsonData); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	channel := models.NotificationChannel{CreatedBy: username(c), UpdatedBy: username(c)}
+	if err := jsonData.apply(&channel); err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, err.Error(), []any{}))
+		return
+	}
+	if result := h.DB.Create(&channel); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusCreated, response(http.StatusCreated, "", []models.NotificationChannel{channel}))
+}
+
+// notificationChannelFromParam finds the channel in the url params and responds with an error when it does
+// not exist
+func (h APIHandler) notificationChannelFromParam(c *gin.Context) (*models.NotificationChannel, bool) {
+	id, err := strconv.ParseUint(c.Param("channel_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, fmt.Sprintf("channel_id must be a number, got '%s'", c.Param("channel_id")), []any{}))
+		return nil, false
+	}
+	var channel models.NotificationChannel
+	if result := h.DB.First(&channel, id); result.Error != nil {
+		status := http.StatusUnprocessableEntity
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, response(int64(status), fmt.Sprintf("notification channel %d: %s", id, result.Error), []any{}))
+		return nil, false
+	}
+	return &channel, true
+}
+
+func (h APIHandler) updateNotificationChannel(c *gin.Context) {
+	if !h.requireRole(c, RolePrivileged) {
+		return
+	}
+	channel, found := h.notificationChannelFromParam(c)
+	if !found {
+		return
+	}
+	var jsonData notificationChannelRequest
+	if err := c.BindJSON(&jsonData); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	if err := jsonData.apply(channel); err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, err.Error(), []any{}))
+		return
+	}
+	channel.UpdatedBy = username(c)
+	if result := h.DB.Save(channel); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", []models.NotificationChannel{*channel}))
+}
+
+func (h APIHandler) deleteNotificationChannel(c *gin.Context) {
+	if !h.requireRole(c, RolePrivileged) {
+		return
+	}
+	channel, found := h.notificationChannelFromParam(c)
+	if !found {
+		return
+	}
+	if result := h.DB.Delete(channel); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// getNotifications lists the newest notifications of the channel. Filter with "status" and "event_type"
+// and page with "offset" and "limit".
+func (h APIHandler) getNotifications(c *gin.Context) {
+	channel, found := h.notificationChannelFromParam(c)
+	if !found {
+		return
+	}
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 {
+		limit = 50
+	}
+	limit = min(limit, maxWebhookDeliveriesLimit)
+	offset = max(offset, 0)
+	query := h.DB.Where("channel_id = ?", channel.ID)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if eventType := c.Query("event_type"); eventType != "" {
+		query = query.Where("event_type = ?", eventType)
+	}
+	notifications := []models.Notification{}
+	if result := query.Order("id DESC").Offset(offset).Limit(limit).Find(&notifications); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", notifications))
+}
+
+// testNotificationChannel posts a test message to the channel right away, even during quiet hours, and
+// responds with the notification
+func (h APIHandler) testNotificationChannel(c *gin.Context) {
+	if !h.requireRole(c, RolePrivileged) {
+		return
+	}
+	channel, found := h.notificationChannelFromParam(c)
+	if !found {
+		return
+	}
+	event := models.Event{
+		Type: EventPing,
+		Data: map[string]any{"channel_id": channel.ID, "sent_by": username(c)},
+	}
+	if result := h.DB.Create(&event); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	notification := models.Notification{
+		ChannelID:     channel.ID,
+		EventID:       event.ID,
+		EventType:     event.Type,
+		Status:        notificationPending,
+		NextAttemptAt: time.Now(),
+	}
+	if result := h.DB.Create(&notification); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	h.attemptNotification(c, notification.ID)
+	h.DB.Model(&models.Notification{}).Where("id = ? AND status = ?", notification.ID, notificationPending).Update("status", notificationFailed)
+	h.DB.First(&notification, notification.ID)
+	c.JSON(http.StatusOK, response(http.StatusOK, notification.Error, []models.Notification{notification}))
+}
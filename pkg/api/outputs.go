@@ -0,0 +1,137 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ResourceOutput is a single value of "terraform output -json"
+type ResourceOutput struct {
+	Sensitive bool            `json:"sensitive"`
+	Type      json.RawMessage `json:"type,omitempty"`
+	Value     json.RawMessage `json:"value"`
+	Masked    bool            `json:"masked,omitempty"`
+}
+
+// ResourceOutputs are the outputs captured by a task of a generation
+type ResourceOutputs struct {
+	Infra3ResourceUUID string                    `json:"infra3_resource_uuid"`
+	Generation         string                    `json:"generation"`
+	TaskPodUUID        string                    `json:"task_pod_uuid"`
+	TaskType           string                    `json:"task_type"`
+	SHA256             string                    `json:"sha256"`
+	CapturedAt         time.Time                 `json:"captured_at"`
+	Outputs            map[string]ResourceOutput `json:"outputs"`
+}
+
+// outputArtifacts selects the "outputs" artifacts of the resource, newest first. Outputs of the current
+// generation are skipped while the resource is failed since the apply may not have completed.
+func outputArtifacts(db *gorm.DB, infra3ResourceUUID string) *gorm.DB {
+	return db.Table("task_artifacts").
+		Select("task_artifacts.*").
+		Joins("JOIN task_pods ON task_pods.uuid = task_artifacts.task_pod_uuid").
+		Joins("JOIN infra3_resources ON infra3_resources.uuid = task_artifacts.infra3_resource_uuid").
+		Where("task_artifacts.infra3_resource_uuid = ? AND task_artifacts.kind = 'outputs' AND task_artifacts.deleted_at IS NULL", infra3ResourceUUID).
+		Where("task_pods.task_type IN ('apply', 'postapply')").
+		Where("NOT (infra3_resources.current_state = ? AND task_artifacts.generation = infra3_resources.current_generation)", models.Failed).
+		Order("task_artifacts.created_at DESC")
+}
+
+// resourceOutputs reads an outputs artifact and masks sensitive values unless showSensitive is set
+func (h APIHandler) resourceOutputs(c *gin.Context, artifact models.TaskArtifact, showSensitive bool) (*ResourceOutputs, error) {
+	if h.LogStore == nil || h.LogStore.Name() != artifact.Store {
+		return nil, fmt.Errorf("outputs were saved to the %s log store which is not configured", artifact.Store)
+	}
+	b, err := h.LogStore.Read(c, artifact.StoreKey)
+	if err != nil {
+		return nil, err
+	}
+
+	outputs := map[string]ResourceOutput{}
+	if err := json.Unmarshal(b, &outputs); err != nil {
+		return nil, fmt.Errorf("outputs of %s are not 'terraform output -json' output: %s", artifact.TaskPodUUID, err)
+	}
+	for name, output := range outputs {
+		if output.Sensitive && !showSensitive {
+			output.Value = json.RawMessage(`"` + redactionMarker + `"`)
+			output.Masked = true
+			outputs[name] = output
+		}
+	}
+
+	var taskPod models.TaskPod
+	h.DB.Select("task_type").First(&taskPod, "uuid = ?", artifact.TaskPodUUID)
+	return &ResourceOutputs{
+		Infra3ResourceUUID: artifact.Infra3ResourceUUID,
+		Generation:         artifact.Generation,
+		TaskPodUUID:        artifact.TaskPodUUID,
+		TaskType:           taskPod.TaskType,
+		SHA256:             artifact.SHA256,
+		CapturedAt:         artifact.CreatedAt,
+		Outputs:            outputs,
+	}, nil
+}
+
+// getResourceOutputs returns the outputs captured after the last completed apply. Pass a "generation"
+// param to get the outputs of an older generation. Sensitive values are masked unless the caller has the
+// privileged role.
+func (h APIHandler) getResourceOutputs(c *gin.Context) {
+	infra3ResourceUUID := c.Param("infra3_resource_uuid")
+	generation := c.Param("generation")
+
+	query := outputArtifacts(h.DB, infra3ResourceUUID)
+	if generation != "" {
+		query = query.Where("task_artifacts.generation = ?", generation)
+	}
+	var artifacts []models.TaskArtifact
+	if result := query.Limit(1).Scan(&artifacts); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	if len(artifacts) == 0 {
+		c.JSON(http.StatusNotFound, response(http.StatusNotFound, "outputs not found", []any{}))
+		return
+	}
+
+	outputs, err := h.resourceOutputs(c, artifacts[0], h.hasRole(c, RolePrivileged))
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", []ResourceOutputs{*outputs}))
+}
+
+// getResourceOutputsHistory lists the outputs of every generation that captured them, newest first
+func (h APIHandler) getResourceOutputsHistory(c *gin.Context) {
+	infra3ResourceUUID := c.Param("infra3_resource_uuid")
+
+	var artifacts []models.TaskArtifact
+	if result := outputArtifacts(h.DB, infra3ResourceUUID).Scan(&artifacts); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+
+	showSensitive := h.hasRole(c, RolePrivileged)
+	history := []ResourceOutputs{}
+	seen := map[string]bool{}
+	for _, artifact := range artifacts {
+		// Only the newest outputs of a generation are returned, eg when the apply was rerun
+		if seen[artifact.Generation] {
+			continue
+		}
+		seen[artifact.Generation] = true
+		outputs, err := h.resourceOutputs(c, artifact, showSensitive)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+			return
+		}
+		history = append(history, *outputs)
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", history))
+}
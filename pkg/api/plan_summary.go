@@ -0,0 +1,290 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/logstore"
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	planSummarySourceLog  = "log"
+	planSummarySourceJSON = "json"
+
+	// maxPlanJSONSize limits the size of a "terraform show -json" document posted by a plan task
+	maxPlanJSONSize = 64 << 20
+)
+
+var (
+	// Matches the resource headers of a human readable plan, eg "# aws_instance.web[0] will be created"
+	planResourceRegex = regexp.MustCompile(`(?m)^\s*# (.+?) (?:will be (created|updated in-place|destroyed)|must be (replaced)|is tainted, so must be (replaced))\s*$`)
+	planTotalsRegex   = regexp.MustCompile(`Plan: (\d+) to add, (\d+) to change, (\d+) to destroy`)
+	planNoChanges     = regexp.MustCompile(`No changes\.`)
+)
+
+// isPlanTask reports if the task type produces a plan that can be summarized
+func isPlanTask(taskType string) bool {
+	return taskType == "plan" || taskType == "plan-delete"
+}
+
+// parsePlanLog summarizes the human readable output of "terraform plan"
+func parsePlanLog(message string) models.PlanSummary {
+	summary := models.PlanSummary{Source: planSummarySourceLog}
+	addPlanLog(&summary, message)
+	return summary
+}
+
+// addPlanLog adds lines that were appended to a plan log to the summary of the log. The totals line is
+// preferred for the counts once the log contains one.
+func addPlanLog(summary *models.PlanSummary, lines string) {
+	lines = ansiColorRegex.ReplaceAllString(lines, "")
+	seen := map[string]bool{}
+	for action, addresses := range map[string][]string{
+		"created":          summary.ToAdd,
+		"updated in-place": summary.ToChange,
+		"replaced":         summary.ToReplace,
+		"destroyed":        summary.ToDestroy,
+	} {
+		for _, address := range addresses {
+			seen[action+address] = true
+		}
+	}
+	for _, match := range planResourceRegex.FindAllStringSubmatch(lines, -1) {
+		address := match[1]
+		action := match[2] + match[3] + match[4]
+		if seen[action+address] {
+			continue
+		}
+		seen[action+address] = true
+		switch action {
+		case "created":
+			summary.ToAdd = append(summary.ToAdd, address)
+		case "updated in-place":
+			summary.ToChange = append(summary.ToChange, address)
+		case "replaced":
+			summary.ToReplace = append(summary.ToReplace, address)
+		case "destroyed":
+			summary.ToDestroy = append(summary.ToDestroy, address)
+		}
+	}
+
+	if totals := planTotalsRegex.FindAllStringSubmatch(lines, -1); len(totals) > 0 {
+		last := totals[len(totals)-1]
+		summary.Add, _ = strconv.Atoi(last[1])
+		summary.Change, _ = strconv.Atoi(last[2])
+		summary.Destroy, _ = strconv.Atoi(last[3])
+		summary.Replace = len(summary.ToReplace)
+		summary.FromTotals = true
+	} else if !summary.FromTotals {
+		countPlanAddresses(summary)
+	}
+	summary.HasDestroy = summary.Destroy > 0
+	summary.NoChanges = (summary.NoChanges || planNoChanges.MatchString(lines)) && summary.Add+summary.Change+summary.Destroy == 0
+}
+
+// parsePlanJSON summarizes the output of "terraform show -json <planfile>"
+func parsePlanJSON(b []byte) (models.PlanSummary, error) {
+	plan := struct {
+		FormatVersion   string `json:"format_version"`
+		ResourceChanges []struct {
+			Address string `json:"address"`
+			Change  struct {
+				Actions []string `json:"actions"`
+			} `json:"change"`
+		} `json:"resource_changes"`
+	}{}
+	if err := json.Unmarshal(b, &plan); err != nil {
+		return models.PlanSummary{}, fmt.Errorf("plan is not valid 'terraform show -json' output: %s", err)
+	}
+	if plan.FormatVersion == "" {
+		return models.PlanSummary{}, fmt.Errorf("plan is missing format_version, expected 'terraform show -json' output")
+	}
+
+	summary := models.PlanSummary{Source: planSummarySourceJSON}
+	for _, resourceChange := range plan.ResourceChanges {
+		switch strings.Join(resourceChange.Change.Actions, ",") {
+		case "create":
+			summary.ToAdd = append(summary.ToAdd, resourceChange.Address)
+		case "update":
+			summary.ToChange = append(summary.ToChange, resourceChange.Address)
+		case "delete,create", "create,delete":
+			summary.ToReplace = append(summary.ToReplace, resourceChange.Address)
+		case "delete":
+			summary.ToDestroy = append(summary.ToDestroy, resourceChange.Address)
+		}
+	}
+	countPlanAddresses(&summary)
+	summary.HasDestroy = summary.Destroy > 0
+	summary.NoChanges = summary.Add+summary.Change+summary.Destroy == 0
+	return summary, nil
+}
+
+// planSummary returns the summary of a plan task. Summaries are saved as the plan logs and posts its
+// plan, this only reads them. Plans logged before summaries were saved are parsed without saving.
+func planSummary(ctx context.Context, db *gorm.DB, store logstore.LogStore, taskPod models.TaskPod) (*models.PlanSummary, error) {
+	if !isPlanTask(taskPod.TaskType) {
+		return nil, nil
+	}
+
+	var summary models.PlanSummary
+	result := db.Where("task_pod_uuid = ?", taskPod.UUID).First(&summary)
+	if result.Error == nil {
+		return &summary, nil
+	}
+	if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, result.Error
+	}
+
+	var taskLog models.Infra3TaskLog
+	if result := resourceLog(db, taskPod.UUID).Scan(&taskLog); result.Error != nil {
+		return nil, result.Error
+	}
+	if taskLog.TaskPodUUID == "" {
+		// The plan has not logged anything yet
+		return nil, nil
+	}
+	message, err := taskLogMessage(ctx, store, taskLog)
+	if err != nil {
+		return nil, err
+	}
+	parsed := parsePlanLog(message)
+	parsed.TaskPodUUID = taskPod.UUID
+	parsed.Infra3ResourceUUID = taskPod.Infra3ResourceUUID
+	parsed.Generation = taskPod.Generation
+	parsed.LogSize = taskLog.Size
+	return &parsed, nil
+}
+
+// updatePlanSummary adds the lines appended to the log of a plan task to the summary of the plan. A
+// summary posted by the task is kept as it is.
+func updatePlanSummary(db *gorm.DB, taskPod models.TaskPod, lines string, logSize uint64) error {
+	if !isPlanTask(taskPod.TaskType) {
+		return nil
+	}
+	summary := models.PlanSummary{Source: planSummarySourceLog}
+	result := db.Where("task_pod_uuid = ?", taskPod.UUID).Limit(1).Find(&summary)
+	if result.Error != nil {
+		return result.Error
+	}
+	if summary.Source == planSummarySourceJSON {
+		return nil
+	}
+	addPlanLog(&summary, lines)
+	summary.LogSize = logSize
+	return savePlanSummary(db, taskPod, &summary)
+}
+
+// savePlanSummary creates or replaces the summary of the plan task
+func savePlanSummary(db *gorm.DB, taskPod models.TaskPod, summary *models.PlanSummary) error {
+	var existing models.PlanSummary
+	if result := db.Where("task_pod_uuid = ?", taskPod.UUID).First(&existing); result.Error == nil {
+		summary.ID = existing.ID
+		summary.CreatedAt = existing.CreatedAt
+	}
+	summary.TaskPodUUID = taskPod.UUID
+	summary.Infra3ResourceUUID = taskPod.Infra3ResourceUUID
+	summary.Generation = taskPod.Generation
+	return db.Save(summary).Error
+}
+
+// countPlanAddresses counts the addresses of the summary. A replaced resource counts as an add and a
+// destroy just like it does in the plan totals.
+func countPlanAddresses(summary *models.PlanSummary) {
+	summary.Replace = len(summary.ToReplace)
+	summary.Add = len(summary.ToAdd) + summary.Replace
+	summary.Change = len(summary.ToChange)
+	summary.Destroy = len(summary.ToDestroy) + summary.Replace
+}
+
+// planSummaryMessage highlights plans that destroy resources so approvers don't miss them
+func planSummaryMessage(summary *models.PlanSummary) string {
+	if summary == nil || !summary.HasDestroy {
+		return ""
+	}
+	return fmt.Sprintf("WARNING: plan will destroy %d resource(s)", summary.Destroy)
+}
+
+// latestPlanSummary returns the summary of the plan that requires approval in the generation
+func (h APIHandler) latestPlanSummary(ctx context.Context, infra3ResourceUUID, generation string) (*models.PlanSummary, error) {
+	var taskPod models.TaskPod
+	result := h.DB.Where("uuid IN (?)", requiredApprovalPodUUID(h.DB, infra3ResourceUUID, generation)).Limit(1).Find(&taskPod)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if taskPod.UUID == "" {
+		return nil, nil
+	}
+	return planSummary(ctx, h.DB, h.LogStore, taskPod)
+}
+
+func (h APIHandler) getPlanSummary(c *gin.Context) {
+	infra3ResourceUUID := c.Param("infra3_resource_uuid")
+	generation := c.Param("generation")
+	if generation == "latest" {
+		generation = h.LatestGeneration(infra3ResourceUUID)
+	}
+
+	summary, err := h.latestPlanSummary(c, infra3ResourceUUID, generation)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	if summary == nil {
+		c.JSON(http.StatusOK, response(http.StatusOK, "plan not found", []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, planSummaryMessage(summary), []models.PlanSummary{*summary}))
+}
+
+// AddPlanJSONViaTask saves the summary of a "terraform show -json" document posted by a plan task. The
+// summary takes precedence over the one parsed from the plan log.
+func (h APIHandler) AddPlanJSONViaTask(c *gin.Context) {
+	token, err := taskJWT(c.Request.Header["Token"][0])
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), nil))
+		return
+	}
+	claims := taskJWTClaims(token)
+	taskPodUUID := c.Param("task_pod_uuid")
+
+	var taskPod models.TaskPod
+	if result := h.DB.First(&taskPod, "uuid = ? AND infra3_resource_uuid = ?", taskPodUUID, claims["resourceUUID"]); result.Error != nil {
+		c.JSON(http.StatusNotFound, response(http.StatusNotFound, result.Error.Error(), []any{}))
+		return
+	}
+	if !isPlanTask(taskPod.TaskType) {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, fmt.Sprintf("plans are for plan types, but uuid was for %s type", taskPod.TaskType), []any{}))
+		return
+	}
+
+	b, err := io.ReadAll(io.LimitReader(c.Request.Body, maxPlanJSONSize+1))
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	if len(b) > maxPlanJSONSize {
+		c.JSON(http.StatusRequestEntityTooLarge, response(http.StatusRequestEntityTooLarge, fmt.Sprintf("plan is larger than %d bytes", maxPlanJSONSize), []any{}))
+		return
+	}
+	summary, err := parsePlanJSON(b)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	if err := savePlanSummary(h.DB, taskPod, &summary); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	h.evaluateAutoApproval(c, taskPod)
+	c.JSON(http.StatusOK, response(http.StatusOK, planSummaryMessage(&summary), []models.PlanSummary{summary}))
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+)
+
+const testPlanLog = `Terraform will perform the following actions:
+
+  # aws_instance.web[0] will be created
+  # aws_s3_bucket.logs will be updated in-place
+  # aws_iam_role.ci must be replaced
+  # aws_security_group.old will be destroyed
+
+Plan: 2 to add, 1 to change, 2 to destroy.
+`
+
+// TestAddPlanLog checks that a summary updated line by line as the plan logs matches the summary of the
+// whole log
+func TestAddPlanLog(t *testing.T) {
+	whole := parsePlanLog(testPlanLog)
+	if whole.Add != 2 || whole.Change != 1 || whole.Destroy != 2 || whole.Replace != 1 || !whole.HasDestroy || whole.NoChanges {
+		t.Errorf("unexpected summary %+v", whole)
+	}
+
+	incremental := parsePlanLog("")
+	for _, line := range strings.SplitAfter(testPlanLog, "\n") {
+		addPlanLog(&incremental, line)
+		// A chunk that is logged again must not count its resources twice
+		addPlanLog(&incremental, line)
+	}
+	if !reflect.DeepEqual(whole, incremental) {
+		t.Errorf("incremental summary %+v, want %+v", incremental, whole)
+	}
+
+	noChanges := parsePlanLog("")
+	for _, line := range []string{"Refreshing state...\n", "No changes. Your infrastructure matches the configuration.\n"} {
+		addPlanLog(&noChanges, line)
+	}
+	if !noChanges.NoChanges {
+		t.Errorf("expected no changes, got %+v", noChanges)
+	}
+}
+
+// TestPlanFinished checks that a plan is complete once its log has a totals or no changes line
+func TestPlanFinished(t *testing.T) {
+	headers := parsePlanLog("  # aws_instance.web[0] will be created\n")
+	totals := parsePlanLog(testPlanLog)
+	noChanges := parsePlanLog("No changes. Your infrastructure matches the configuration.\n")
+	for _, tc := range []struct {
+		name    string
+		summary *models.PlanSummary
+		want    bool
+	}{
+		{"no summary", nil, false},
+		{"resource headers only", &headers, false},
+		{"totals line", &totals, true},
+		{"no changes", &noChanges, true},
+		{"plan json", &models.PlanSummary{Source: planSummarySourceJSON, Add: 1}, true},
+	} {
+		if got := planFinished(tc.summary); got != tc.want {
+			t.Errorf("%s: got %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+	"github.com/galleybytes/infrakube-stella/pkg/util"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// redactionMarker starts every mask that is long enough to hold it. Masks always have the same length as
+// the value they replace so byte offsets into stored logs never move.
+const redactionMarker = "[REDACTED]"
+
+// redactionLookbehind is how many bytes before already stored log content are re-scanned so that
+// secrets split between two log updates are still matched.
+const redactionLookbehind = 8192
+
+// minimumSecretLength ignores secret values too short to be masked without masking unrelated output
+const minimumSecretLength = 6
+
+var defaultRedactionKeywords = []string{
+	"password",
+	"passwd",
+	"secret",
+	"token",
+	"api_key",
+	"apikey",
+	"access_key",
+	"private_key",
+	"credential",
+}
+
+var defaultRedactionRules = []RedactionRule{
+	{Name: "aws-access-key-id", Regex: `\b(?:AKIA|ASIA|AIDA|AROA)[0-9A-Z]{16}\b`},
+	{Name: "aws-secret-access-key", Regex: `(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})`},
+	{Name: "private-key", Regex: `-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`},
+	{Name: "github-token", Regex: `\bgh[pousr]_[A-Za-z0-9]{36,}\b`},
+	{Name: "slack-token", Regex: `\bxox[abprs]-[A-Za-z0-9-]{10,}\b`},
+	{Name: "google-api-key", Regex: `\bAIza[0-9A-Za-z_-]{35}\b`},
+	{Name: "jwt", Regex: `\beyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`},
+	{Name: "bearer-token", Regex: `(?i)\bbearer\s+([A-Za-z0-9._~+/-]{20,}=*)`},
+}
+
+// RedactionRule masks every match of Regex. When the regex has a capture group, only the first group
+// is masked.
+type RedactionRule struct {
+	Name  string `yaml:"name"`
+	Regex string `yaml:"regex"`
+
+	re *regexp.Regexp
+
+	// keyword rules capture the key in the first group and the value in the second
+	keyword bool
+}
+
+// RedactionConfig is the file format of --redaction-config
+type RedactionConfig struct {
+	// DisableDefaults removes the built-in keywords and known-secret rules
+	DisableDefaults bool `yaml:"disableDefaults"`
+
+	// Keywords mask the value assigned to any key that contains the keyword, eg "password: hunter2"
+	Keywords []string `yaml:"keywords"`
+
+	Rules []RedactionRule `yaml:"rules"`
+}
+
+// Redactor masks secrets in task logs and resource specs before they are written to the database
+type Redactor struct {
+	keywords []string
+	rules    []RedactionRule
+}
+
+// redaction is a single masked range in the redacted content
+type redaction struct {
+	rule  string
+	start int
+	end   int
+}
+
+// NewRedactor reads the redaction config file. An empty filename returns the default redactor.
+func NewRedactor(filename string) (*Redactor, error) {
+	config := RedactionConfig{}
+	if filename != "" {
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("could not read redaction config: %s", err)
+		}
+		if err := yaml.Unmarshal(b, &config); err != nil {
+			return nil, fmt.Errorf("could not parse redaction config: %s", err)
+		}
+	}
+
+	redactor := Redactor{}
+	if !config.DisableDefaults {
+		redactor.keywords = append(redactor.keywords, defaultRedactionKeywords...)
+		redactor.rules = append(redactor.rules, defaultRedactionRules...)
+	}
+	redactor.keywords = append(redactor.keywords, config.Keywords...)
+	redactor.rules = append(redactor.rules, config.Rules...)
+
+	for _, keyword := range redactor.keywords {
+		redactor.rules = append(redactor.rules, RedactionRule{
+			Name:    "keyword-" + keyword,
+			Regex:   `(?i)\b([\w.-]*` + regexp.QuoteMeta(keyword) + `[\w.-]*)["']?\s*[:=]\s*["']?([^\s"',}]{` + fmt.Sprint(minimumSecretLength) + `,})`,
+			keyword: true,
+		})
+	}
+	for i := range redactor.rules {
+		re, err := regexp.Compile(redactor.rules[i].Regex)
+		if err != nil {
+			return nil, fmt.Errorf("redaction rule '%s' is not a valid regex: %s", redactor.rules[i].Name, err)
+		}
+		redactor.rules[i].re = re
+	}
+	return &redactor, nil
+}
+
+func mask(n int) string {
+	if n >= len(redactionMarker) {
+		return redactionMarker + strings.Repeat("*", n-len(redactionMarker))
+	}
+	return strings.Repeat("*", n)
+}
+
+// Redact masks every rule match and every literal secret value in content
+func (r *Redactor) Redact(content string, literals []string) (string, []redaction) {
+	if r == nil {
+		return content, nil
+	}
+	b := []byte(content)
+	redactions := []redaction{}
+	apply := func(rule string, start, end int) {
+		if start >= end {
+			return
+		}
+		copy(b[start:end], mask(end-start))
+		redactions = append(redactions, redaction{rule: rule, start: start, end: end})
+	}
+
+	for _, rule := range r.rules {
+		for _, match := range rule.re.FindAllSubmatchIndex(b, -1) {
+			if rule.keyword {
+				if !isReferenceKey(string(b[match[2]:match[3]])) {
+					apply(rule.Name, match[4], match[5])
+				}
+			} else if len(match) >= 4 && match[2] >= 0 {
+				apply(rule.Name, match[2], match[3])
+			} else {
+				apply(rule.Name, match[0], match[1])
+			}
+		}
+	}
+
+	for _, literal := range literals {
+		if len(literal) < minimumSecretLength {
+			continue
+		}
+		offset := 0
+		for {
+			i := strings.Index(string(b[offset:]), literal)
+			if i < 0 {
+				break
+			}
+			apply("secret-env", offset+i, offset+i+len(literal))
+			offset += i + len(literal)
+		}
+	}
+	return string(b), redactions
+}
+
+// redactAppend redacts content that will be appended after the first "size" bytes that are already
+// stored. Only the tail of the stored content is re-scanned and only redactions that touch the new
+// content are returned. The returned string has the same length as content.
+func (r *Redactor) redactAppend(content string, size int, literals []string) (string, []redaction) {
+	start := size - redactionLookbehind
+	if start < 0 {
+		start = 0
+	}
+	redacted, all := r.Redact(content[start:], literals)
+	redactions := []redaction{}
+	for _, item := range all {
+		if start+item.end > size {
+			item.start += start
+			item.end += start
+			redactions = append(redactions, item)
+		}
+	}
+	return content[:start] + redacted, redactions
+}
+
+// redactionSafeLength returns how many bytes at the start of content can be saved. The trailing line is
+// held back until it ends, as is an unterminated private key block, because the rest of a secret may still
+// be coming. Content that would hold back more than redactionLookbehind bytes is saved as it is.
+func redactionSafeLength(content string) int {
+	end := strings.LastIndexByte(content, '\n') + 1
+	if begin := strings.LastIndex(content, "-----BEGIN "); begin >= 0 && begin < end {
+		if !strings.Contains(content[begin:], "-----END ") {
+			end = begin
+		}
+	}
+	if len(content)-end > redactionLookbehind {
+		return len(content)
+	}
+	return end
+}
+
+// redactLogUpdate redacts the log content of a task of which the first "size" bytes are already stored. It
+// returns the chunk that can be stored, the trailing content that is held back until it is safe to store
+// and the redactions of the chunk. The held back content is redacted as far as it has been received.
+func (r *Redactor) redactLogUpdate(content string, size int, literals []string) (string, string, []redaction) {
+	redacted, redactions := r.redactAppend(content, size, literals)
+	safeLength := max(redactionSafeLength(content), size)
+	saved := []redaction{}
+	for _, item := range redactions {
+		if item.start < safeLength {
+			saved = append(saved, item)
+		}
+	}
+	return redacted[size:safeLength], redacted[safeLength:], saved
+}
+
+// maskUnterminatedBlock masks a private key block at the end of held back content that has not ended yet,
+// which the private-key rule can't match until its end is received
+func maskUnterminatedBlock(content string) string {
+	begin := strings.LastIndex(content, "-----BEGIN ")
+	if begin < 0 || strings.Contains(content[begin:], "-----END ") {
+		return content
+	}
+	return content[:begin] + mask(len(content)-begin)
+}
+
+// redactJSON masks values in a JSON document. Keys that match a keyword are masked entirely as are
+// "value" fields of {"name": ..., "value": ...} objects (eg env vars) whose name matches a keyword. Every
+// other string is passed through the redaction rules. The document is returned unchanged when it is not
+// valid JSON.
+func (r *Redactor) redactJSON(document string) (string, []redaction) {
+	if r == nil {
+		return document, nil
+	}
+	var data any
+	if err := json.Unmarshal([]byte(document), &data); err != nil {
+		return document, nil
+	}
+	redactions := []redaction{}
+	var walk func(any) any
+	walk = func(v any) any {
+		switch item := v.(type) {
+		case map[string]any:
+			name, _ := item["name"].(string)
+			for key, value := range item {
+				s, isString := value.(string)
+				if isString && (r.isSensitiveKey(key) || (key == "value" && r.isSensitiveKey(name))) && len(s) > 0 {
+					item[key] = mask(len(s))
+					redactions = append(redactions, redaction{rule: "keyword", end: len(s)})
+					continue
+				}
+				item[key] = walk(value)
+			}
+			return item
+		case []any:
+			for i := range item {
+				item[i] = walk(item[i])
+			}
+			return item
+		case string:
+			redacted, found := r.Redact(item, nil)
+			redactions = append(redactions, found...)
+			return redacted
+		default:
+			return v
+		}
+	}
+	data = walk(data)
+	if len(redactions) == 0 {
+		return document, nil
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return document, nil
+	}
+	return string(b), redactions
+}
+
+func (r *Redactor) isSensitiveKey(key string) bool {
+	if isReferenceKey(key) {
+		return false
+	}
+	key = strings.ToLower(key)
+	for _, keyword := range r.keywords {
+		if strings.Contains(key, strings.ToLower(keyword)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isReferenceKey is true for keys that name or point to a secret rather than hold one, eg "secretName"
+func isReferenceKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, suffix := range []string{"name", "ref", "path", "file", "arn", "id"} {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactResourceSpec masks secrets in the spec, annotations and labels before the spec is saved
+func (r *Redactor) redactResourceSpec(infra3ResourceSpec *models.Infra3ResourceSpec) []redaction {
+	redactions := []redaction{}
+	var found []redaction
+	infra3ResourceSpec.ResourceSpec, found = r.redactJSON(infra3ResourceSpec.ResourceSpec)
+	redactions = append(redactions, found...)
+	infra3ResourceSpec.Annotations, found = r.redactJSON(infra3ResourceSpec.Annotations)
+	redactions = append(redactions, found...)
+	infra3ResourceSpec.Labels, found = r.redactJSON(infra3ResourceSpec.Labels)
+	redactions = append(redactions, found...)
+	return redactions
+}
+
+// saveRedactionAudit adds the number of redactions per rule to the audit counts of the source
+func saveRedactionAudit(db *gorm.DB, source, infra3ResourceUUID, generation, taskPodUUID string, redactions []redaction) {
+	counts := map[string]int64{}
+	for _, item := range redactions {
+		counts[item.rule]++
+	}
+	for rule, count := range counts {
+		audit := models.RedactionAudit{
+			Source:             source,
+			Infra3ResourceUUID: infra3ResourceUUID,
+			Generation:         generation,
+			TaskPodUUID:        taskPodUUID,
+			Rule:               rule,
+		}
+		result := db.Where(audit).FirstOrCreate(&audit)
+		if result.Error == nil {
+			result = db.Model(&audit).UpdateColumn("count", gorm.Expr("count + ?", count))
+		}
+		if result.Error != nil {
+			log.Printf("ERROR saving redaction audit for %s %s: %s", source, infra3ResourceUUID, result.Error)
+		}
+	}
+}
+
+// secretEnvValues returns the values of secrets that the tf resource exposes to its tasks via env,
+// envFrom or credentials. Values are cached per resource and generation so task log updates don't each
+// query the vcluster. A failed lookup is only cached briefly so it is retried soon.
+func (h APIHandler) secretEnvValues(ctx context.Context, infra3ResourceUUID, generation string) []string {
+	if h.Redactor == nil {
+		return nil
+	}
+	cacheKey := "redaction-secret-values/" + infra3ResourceUUID + "/" + generation
+	if cached, found := h.Cache.Get(cacheKey); found {
+		return cached.([]string)
+	}
+	values := []string{}
+	ttl := 30 * time.Second
+	defer func() { h.Cache.Set(cacheKey, values, ttl) }()
+
+	infra3Resource := models.Infra3Resource{}
+	if result := h.DB.Where("uuid = ?", infra3ResourceUUID).First(&infra3Resource); result.Error != nil {
+		return values
+	}
+	clusterName := getClusterName(infra3Resource.ClusterID, h.DB)
+	tf, err := getResource(h.clientset, clusterName, infra3Resource.Namespace, infra3Resource.Name, ctx)
+	if err != nil {
+		log.Printf("Could not lookup secrets to redact for %s/%s: %s", infra3Resource.Namespace, infra3Resource.Name, err)
+		return values
+	}
+
+	secretKeys := map[string][]string{} // secret name -> keys, an empty list means all keys
+	for _, taskOption := range tf.Spec.TaskOptions {
+		for _, env := range taskOption.Env {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+				ref := env.ValueFrom.SecretKeyRef
+				if keys, found := secretKeys[ref.Name]; !found || len(keys) > 0 {
+					secretKeys[ref.Name] = append(secretKeys[ref.Name], ref.Key)
+				}
+			}
+		}
+		for _, envFrom := range taskOption.EnvFrom {
+			if envFrom.SecretRef != nil {
+				secretKeys[envFrom.SecretRef.Name] = []string{}
+			}
+		}
+	}
+	for _, credentials := range tf.Spec.Credentials {
+		if credentials.SecretNameRef.Name != "" {
+			secretKeys[credentials.SecretNameRef.Name] = []string{}
+		}
+	}
+	if len(secretKeys) == 0 {
+		return values
+	}
+
+	config, err := getVclusterConfig(h.clientset, "internal", clusterName)
+	if err != nil {
+		return values
+	}
+	clientset := kubernetes.NewForConfigOrDie(config)
+	for name, keys := range secretKeys {
+		secret, err := clientset.CoreV1().Secrets(infra3Resource.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			continue
+		}
+		values = append(values, secretValues(secret, keys)...)
+	}
+	ttl = time.Hour
+	// Mask longer values first so a value that contains another value is fully masked
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	return values
+}
+
+func secretValues(secret *corev1.Secret, keys []string) []string {
+	values := []string{}
+	for key, value := range secret.Data {
+		if len(keys) > 0 && !util.Contains(keys, key) {
+			continue
+		}
+		for _, line := range strings.Split(string(value), "\n") {
+			line = strings.TrimSpace(line)
+			if len(line) >= minimumSecretLength {
+				values = append(values, line)
+			}
+		}
+	}
+	return values
+}
+
+// getRedactions returns the redaction audit counts of a resource
+func (h APIHandler) getRedactions(c *gin.Context) {
+	infra3ResourceUUID := c.Param("infra3_resource_uuid")
+	audits := []models.RedactionAudit{}
+	if result := h.DB.Where("infra3_resource_uuid = ?", infra3ResourceUUID).Order("generation, source, rule").Find(&audits); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", audits))
+}
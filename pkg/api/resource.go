@@ -16,6 +16,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/galleybytes/infrakube-stella/pkg/common/logstore"
 	"github.com/galleybytes/infrakube-stella/pkg/common/models"
 	"github.com/galleybytes/infrakube-stella/pkg/util"
 	infra3v1 "github.com/galleybytes/infrakube/pkg/apis/infra3/v1"
@@ -41,6 +42,9 @@ import (
 
 var VCLUSTER_DEBUG_HOST string = os.Getenv("I3_API_VCLUSTER_DEBUG_HOST")
 
+// ansiColorRegex matches terminal color codes that are stripped from logs returned in plain text
+var ansiColorRegex = regexp.MustCompile(`\x1b\[[0-9;]*[a-zA-Z]`)
+
 //go:embed manifests/vcluster.tpl.yaml
 var defaultVirtualClusterManifestTemplate string
 
@@ -117,9 +121,11 @@ func (r resource) Parse(clusterID uint) (*models.Infra3Resource, *models.Infra3R
 	infra3ResourceSpec := models.Infra3ResourceSpec{
 		Infra3ResourceUUID: uuid,
 		Generation:         currentGeneration,
+		OriginGeneration:   currentGeneration,
 		ResourceSpec:       spec,
 		Annotations:        annotations,
 		Labels:             labels,
+		Author:             r.Annotations[authorAnnotation],
 	}
 
 	return &infra3Resource, &infra3ResourceSpec, nil
@@ -350,7 +356,7 @@ func (h APIHandler) rerunWorkflow(c *gin.Context) {
 	name := c.Param("name")
 	namespace := c.Param("namespace")
 
-	err := rerun(h.clientset, clusterName, namespace, name, "api-triggered-rerun", c)
+	_, err := rerun(h.clientset, clusterName, namespace, name, "api-triggered-rerun", c)
 	if err != nil {
 		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, fmt.Sprintf("Failed to trigger rerun: %s", err), []any{}))
 		return
@@ -358,27 +364,31 @@ func (h APIHandler) rerunWorkflow(c *gin.Context) {
 	c.JSON(http.StatusNoContent, nil)
 }
 
-func rerun(parentClientset kubernetes.Interface, clusterName, namespace, name, rerunLabelValue string, ctx context.Context) error {
+// rerun sets a new change-cause label on the Tf which makes the controller run the workflow again. The
+// label value is returned.
+func rerun(parentClientset kubernetes.Interface, clusterName, namespace, name, rerunLabelValue string, ctx context.Context) (string, error) {
 	config, err := getVclusterConfig(parentClientset, "internal", clusterName)
 	if err != nil {
-		return err
+		return "", err
 	}
 	infra3Clientset := infra3clientset.NewForConfigOrDie(config)
 	resource, err := infra3Clientset.Infra3V1().Tfs(namespace).Get(ctx, name, metav1.GetOptions{})
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	if resource.Labels == nil {
 		resource.Labels = map[string]string{}
 	}
 
-	resource.Labels["kubernetes.io/change-cause"] = fmt.Sprintf("%s-%s", rerunLabelValue, time.Now().Format("20060102150405"))
+	changeCause := fmt.Sprintf("%s-%s", rerunLabelValue, time.Now().Format("20060102150405"))
+	resource.Labels["kubernetes.io/change-cause"] = changeCause
+	delete(resource.Annotations, cancelAnnotation)
 	_, err = infra3Clientset.Infra3V1().Tfs(namespace).Update(ctx, resource, metav1.UpdateOptions{})
 	if err != nil {
-		return err
+		return "", err
 	}
-	return nil
+	return changeCause, nil
 }
 
 type StatusCheckResponse struct {
@@ -399,7 +409,7 @@ func (h APIHandler) ResourceStatusCheck(c *gin.Context) {
 	name := c.Param("name")
 	namespace := c.Param("namespace")
 
-	statusCheckAndUpdate(c, h.DB, h.clientset, clusterName, namespace, name)
+	h.statusCheckAndUpdate(c, clusterName, namespace, name)
 }
 
 func (h APIHandler) ResourceStatusCheckViaTask(c *gin.Context) {
@@ -424,11 +434,11 @@ func (h APIHandler) ResourceStatusCheckViaTask(c *gin.Context) {
 	namespace := infra3ResourceFromDatabase.Namespace
 	name := infra3ResourceFromDatabase.Name
 
-	statusCheckAndUpdate(c, h.DB, h.clientset, clusterName, namespace, name)
+	h.statusCheckAndUpdate(c, clusterName, namespace, name)
 }
 
-func statusCheckAndUpdate(c *gin.Context, db *gorm.DB, clientset kubernetes.Interface, clusterName, namespace, name string) {
-	resource, err := getResource(clientset, clusterName, namespace, name, c)
+func (h APIHandler) statusCheckAndUpdate(c *gin.Context, clusterName, namespace, name string) {
+	resource, err := getResource(h.clientset, clusterName, namespace, name, c)
 	if err != nil {
 		if kerrors.IsNotFound(err) {
 			c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, fmt.Sprintf("tf resource '%s/%s' not found", namespace, name), nil))
@@ -459,10 +469,18 @@ OptLoop:
 	}
 	if uuid != "" {
 		infra3ResourceFromDatabase := models.Infra3Resource{}
-		result := db.Where("uuid = ?", uuid).First(&infra3ResourceFromDatabase)
+		result := h.DB.Where("uuid = ?", uuid).First(&infra3ResourceFromDatabase)
 		if result.Error == nil {
-			infra3ResourceFromDatabase.CurrentState = models.ResourceState(responseJSONData[0].CurrentState)
-			db.Save(infra3ResourceFromDatabase)
+			if tfCanceled(resource) {
+				// The stopped task fails, which must not replace the canceled state
+				responseJSONData[0].CurrentState = string(models.Canceled)
+			} else {
+				previousState := infra3ResourceFromDatabase.CurrentState
+				infra3ResourceFromDatabase.CurrentState = models.ResourceState(responseJSONData[0].CurrentState)
+				if result := h.DB.Save(infra3ResourceFromDatabase); result.Error == nil {
+					h.publishWorkflowState(c, infra3ResourceFromDatabase, previousState)
+				}
+			}
 		}
 	}
 
@@ -496,6 +514,13 @@ func (h APIHandler) UpdateResourceStatusViaTask(c *gin.Context) {
 		return
 	}
 
+	if h.workflowCanceled(c, infra3ResourceFromDatabase) {
+		// Status reports of the canceled workflow must not replace the canceled state
+		c.JSON(http.StatusNoContent, nil)
+		return
+	}
+
+	previousState := infra3ResourceFromDatabase.CurrentState
 	infra3ResourceFromDatabase.CurrentState = models.ResourceState(jsonData.Status)
 
 	result = h.DB.Save(infra3ResourceFromDatabase)
@@ -504,9 +529,29 @@ func (h APIHandler) UpdateResourceStatusViaTask(c *gin.Context) {
 		return
 	}
 
+	h.publishWorkflowState(c, infra3ResourceFromDatabase, previousState)
+
 	c.JSON(http.StatusNoContent, nil)
 }
 
+// publishWorkflowState publishes the end of the workflow when the state of the resource changed to
+// completed or failed. The state is reported by the task and read from the cluster by status checks, so
+// both call it after saving the state.
+func (h APIHandler) publishWorkflowState(ctx context.Context, infra3Resource models.Infra3Resource, previousState models.ResourceState) {
+	if previousState == infra3Resource.CurrentState {
+		return
+	}
+	data := map[string]any{"previous_state": previousState, "state": infra3Resource.CurrentState}
+	switch infra3Resource.CurrentState {
+	case models.Completed:
+		h.flushTaskLogs(ctx, infra3Resource.UUID, "")
+		h.publishEvent(h.resourceEvent(EventWorkflowCompleted, infra3Resource, data))
+	case models.Failed:
+		h.flushTaskLogs(ctx, infra3Resource.UUID, "")
+		h.publishEvent(h.resourceEvent(EventWorkflowFailed, infra3Resource, data))
+	}
+}
+
 func (a ByCreatedAt) Len() int           { return len(a) }
 func (a ByCreatedAt) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByCreatedAt) Less(i, j int) bool { return a[i].CreatedAt.Before(a[j].CreatedAt) }
@@ -588,7 +633,6 @@ func (h APIHandler) LastTaskLog(c *gin.Context) {
 		return
 	}
 
-	ansiColorRegex := regexp.MustCompile(`\x1b\[[0-9;]*[a-zA-Z]`)
 	cleanString := ansiColorRegex.ReplaceAllString(string(logs), "")
 
 	responseJSONData := []struct {
@@ -635,7 +679,16 @@ func (h APIHandler) preLogs(c *gin.Context) {
 	generation := c.Param("generation")
 	rerun := c.Query("rerun")
 	_ = rerun
-	c.JSON(http.StatusOK, response(http.StatusOK, "", logs(h.DB, infra3ResourceUUID, generation)))
+	taskLogs, err := logs(h.DB, h.LogStore, infra3ResourceUUID, generation)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	if err := splitTaskLogs(c, taskLogs); err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, err.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", taskLogs))
 }
 
 func (h APIHandler) websocketLogs(c *gin.Context) {
@@ -643,6 +696,10 @@ func (h APIHandler) websocketLogs(c *gin.Context) {
 	generation := c.Param("generation")
 	rerun := c.Query("rerun")
 	_ = rerun
+	if _, _, err := lineRange(c); err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, err.Error(), []any{}))
+		return
+	}
 
 	var wsupgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
@@ -679,8 +736,13 @@ func (h APIHandler) websocketLogs(c *gin.Context) {
 			if _, found := h.Cache.Get(infra3ResourceUUID); found {
 				h.Cache.Delete(infra3ResourceUUID)
 
-				for _, log := range logs(h.DB, infra3ResourceUUID, generation) {
-					b, err := json.Marshal(log)
+				taskLogs, err := logs(h.DB, h.LogStore, infra3ResourceUUID, generation)
+				if err != nil {
+					log.Printf("ERROR reading logs of %s: %s", infra3ResourceUUID, err)
+				}
+				splitTaskLogs(c, taskLogs)
+				for _, taskLog := range taskLogs {
+					b, err := json.Marshal(taskLog)
 					if err != nil {
 						return
 					}
@@ -701,13 +763,17 @@ type TaskLog struct {
 	TaskID    int       `json:"task_id"`
 	UpdatedAt time.Time `json:"updated_at"`
 	CreatedAt time.Time `json:"created_at"`
+
+	// Lines replaces the message when the log is requested split by lines
+	Lines      []LogLine `json:"lines,omitempty"`
+	TotalLines int       `json:"total_lines,omitempty"`
 }
 
-func logs(db *gorm.DB, infra3ResourceUUID string, generation string) []TaskLog {
+func logs(db *gorm.DB, store logstore.LogStore, infra3ResourceUUID string, generation string) ([]TaskLog, error) {
 	tasks := []models.TaskPod{}
 	queryResult := allTasksGeneratedForResource(db, infra3ResourceUUID, generation).Scan(&tasks)
 	if queryResult.Error != nil {
-		return nil
+		return nil, queryResult.Error
 	}
 
 	taskMap := map[string][]models.TaskPod{}
@@ -738,60 +804,16 @@ func logs(db *gorm.DB, infra3ResourceUUID string, generation string) []TaskLog {
 
 	var logs []TaskLog
 	for _, task := range filteredData {
-		log := struct {
-			Message   string
-			CreatedAt time.Time
-			UpdatedAt time.Time
-		}{}
+		var log models.Infra3TaskLog
 		if result := resourceLog(db, task.UUID).Scan(&log); result.Error == nil {
-			taskID := -1
-			switch task.TaskType {
-			case "setup":
-				taskID = 0
-			case "preinit":
-				taskID = 1
-			case "init":
-				taskID = 2
-			case "postinit":
-				taskID = 3
-			case "preplan":
-				taskID = 4
-			case "plan":
-				taskID = 5
-			case "postplan":
-				taskID = 6
-			case "preapply":
-				taskID = 7
-			case "apply":
-				taskID = 8
-			case "postapply":
-				taskID = 9
-			case "setup-delete":
-				taskID = 10
-			case "preinit-delete":
-				taskID = 11
-			case "init-delete":
-				taskID = 12
-			case "postinit-delete":
-				taskID = 13
-			case "preplan-delete":
-				taskID = 14
-			case "plan-delete":
-				taskID = 15
-			case "postplan-delete":
-				taskID = 16
-			case "preapply-delete":
-				taskID = 17
-			case "apply-delete":
-				taskID = 18
-			case "postapply-delete":
-				taskID = 19
-			default:
-				taskID = 20
+			message, err := liveTaskLogMessage(context.TODO(), store, log)
+			if err != nil {
+				return nil, err
 			}
+			taskID := taskTypeID(task.TaskType)
 			logs = append(logs, TaskLog{
 				UUID:      task.UUID,
-				Message:   log.Message,
+				Message:   message,
 				TaskType:  task.TaskType,
 				Rerun:     task.Rerun,
 				TaskID:    taskID,
@@ -800,7 +822,55 @@ func logs(db *gorm.DB, infra3ResourceUUID string, generation string) []TaskLog {
 			})
 		}
 	}
-	return logs
+	return logs, nil
+}
+
+// taskTypeID returns the position of the task type in the workflow. Unknown task types sort last.
+func taskTypeID(taskType string) int {
+	switch taskType {
+	case "setup":
+		return 0
+	case "preinit":
+		return 1
+	case "init":
+		return 2
+	case "postinit":
+		return 3
+	case "preplan":
+		return 4
+	case "plan":
+		return 5
+	case "postplan":
+		return 6
+	case "preapply":
+		return 7
+	case "apply":
+		return 8
+	case "postapply":
+		return 9
+	case "setup-delete":
+		return 10
+	case "preinit-delete":
+		return 11
+	case "init-delete":
+		return 12
+	case "postinit-delete":
+		return 13
+	case "preplan-delete":
+		return 14
+	case "plan-delete":
+		return 15
+	case "postplan-delete":
+		return 16
+	case "preapply-delete":
+		return 17
+	case "apply-delete":
+		return 18
+	case "postapply-delete":
+		return 19
+	default:
+		return 20
+	}
 }
 
 // Given some human readable data, getWorkflowInfo queries the database and aggregates data relevant
@@ -867,8 +937,10 @@ func (h APIHandler) getWorkflowInfo(c *gin.Context) {
 		ResourceSpecCreatedAt time.Time `json:"resource_spec_created_at"`
 		ResourceSpecUpdatedAt time.Time `json:"resource_spec_updated_at"`
 
-		Tasks      []task `json:"tasks"`
-		IsApproved *bool  `json:"is_approved"`
+		Tasks           []task                `json:"tasks"`
+		IsApproved      *bool                 `json:"is_approved"`
+		PlanSummary     *models.PlanSummary   `json:"plan_summary"`
+		ApprovalHistory []models.ApprovalVote `json:"approval_history"`
 	}
 	finalResult := [1]ResponseItem{}
 
@@ -949,6 +1021,19 @@ func (h APIHandler) getWorkflowInfo(c *gin.Context) {
 
 	finalResult[0].Tasks = filteredData
 
+	summary, err := h.latestPlanSummary(c, resourceUUID, generation)
+	if err != nil {
+		log.Printf("ERROR summarizing plan of %s generation %s: %s", resourceUUID, generation, err)
+	}
+	finalResult[0].PlanSummary = summary
+
+	// Every vote on the plans of the generation, including revoked votes
+	planUUIDs := h.DB.Model(&models.TaskPod{}).Select("uuid").Where("infra3_resource_uuid = ? AND generation = ? AND task_type = 'plan'", resourceUUID, generation)
+	finalResult[0].ApprovalHistory = []models.ApprovalVote{}
+	if result := h.DB.Where("task_pod_uuid IN (?)", planUUIDs).Order("created_at").Find(&finalResult[0].ApprovalHistory); result.Error != nil {
+		log.Printf("ERROR reading approval history of %s generation %s: %s", resourceUUID, generation, result.Error)
+	}
+
 	queryResult = approvalStatusBasedOnLastestRerunOfResource(h.DB, resourceUUID, generation).Scan(&approvals)
 	if queryResult.Error != nil {
 		c.JSON(http.StatusNotFound, response(http.StatusNotFound, "ApprovalStatusBasedOnLatestRerunOfResource Query Error: "+queryResult.Error.Error(), []any{}))
@@ -956,7 +1041,7 @@ func (h APIHandler) getWorkflowInfo(c *gin.Context) {
 	}
 	if len(approvals) == 0 {
 		finalResult[0].IsApproved = nil
-		c.JSON(http.StatusOK, response(http.StatusOK, "", finalResult))
+		c.JSON(http.StatusOK, response(http.StatusOK, planSummaryMessage(summary), finalResult))
 		return
 	}
 
@@ -1040,7 +1125,9 @@ func (h APIHandler) setApprovalForResource(c *gin.Context) {
 	generation := c.Param("generation")
 
 	jsonData := struct {
-		Approval bool `json:"approval"`
+		Approval  bool   `json:"approval"`
+		Comment   string `json:"comment"`
+		TicketURL string `json:"ticket_url"`
 	}{}
 	err := c.BindJSON(&jsonData)
 	if err != nil {
@@ -1048,6 +1135,16 @@ func (h APIHandler) setApprovalForResource(c *gin.Context) {
 		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), nil))
 		return
 	}
+	vote := models.ApprovalVote{
+		Approver:   username(c),
+		IsApproved: jsonData.Approval,
+		Comment:    jsonData.Comment,
+		TicketURL:  jsonData.TicketURL,
+	}
+	if err := validateApprovalVote(vote); err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, err.Error(), []any{}))
+		return
+	}
 
 	var podUUID string
 	result := requiredApprovalPodUUID(h.DB, resourceUUID, generation).Scan(&podUUID)
@@ -1056,14 +1153,14 @@ func (h APIHandler) setApprovalForResource(c *gin.Context) {
 		return
 	}
 
-	approval := models.Approval{
-		IsApproved:  jsonData.Approval,
-		TaskPodUUID: podUUID,
+	quorum, err := h.castApprovalVote(podUUID, vote)
+	if err != nil {
+		status := approvalVoteStatus(err)
+		c.JSON(status, response(int64(status), err.Error(), []any{}))
+		return
 	}
-
-	createResult := h.DB.Create(&approval)
-	if createResult.Error != nil {
-		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, createResult.Error.Error(), []any{}))
+	if !quorum.Decided {
+		c.JSON(http.StatusAccepted, response(http.StatusAccepted, fmt.Sprintf("%d of %d approvals", quorum.Approvals, quorum.Required), []ApprovalQuorum{*quorum}))
 		return
 	}
 
@@ -1076,8 +1173,9 @@ func (h APIHandler) getApprovalStatusForResource(c *gin.Context) {
 	generation := c.Param("generation")
 
 	var data []struct {
-		IsApproved  bool   `json:"is_approved"`
-		TaskPodUUID string `json:"task_pod_uuid"`
+		IsApproved  bool                `json:"is_approved"`
+		TaskPodUUID string              `json:"task_pod_uuid"`
+		PlanSummary *models.PlanSummary `json:"plan_summary" gorm:"-"`
 	}
 
 	queryResult := approvalStatusBasedOnLastestRerunOfResource(h.DB, resourceUUID, generation).Scan(&data)
@@ -1090,7 +1188,14 @@ func (h APIHandler) getApprovalStatusForResource(c *gin.Context) {
 		c.JSON(http.StatusOK, response(http.StatusOK, "", []any{}))
 		return
 	}
-	c.JSON(http.StatusOK, response(http.StatusOK, "", data))
+	summary, err := h.latestPlanSummary(c, resourceUUID, generation)
+	if err != nil {
+		log.Printf("ERROR summarizing plan of %s generation %s: %s", resourceUUID, generation, err)
+	}
+	for i := range data {
+		data[i].PlanSummary = summary
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, planSummaryMessage(summary), data))
 
 }
 
@@ -1390,6 +1495,7 @@ func (h APIHandler) addResource(c *gin.Context) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	specRedactions := h.Redactor.redactResourceSpec(infra3ResourceSpec)
 
 	cluster := &models.Cluster{
 		Model: gorm.Model{
@@ -1417,6 +1523,7 @@ func (h APIHandler) addResource(c *gin.Context) (string, error) {
 	if result.Error != nil {
 		return "", fmt.Errorf("error saving infra3_resource: %s", result.Error)
 	}
+	h.publishEvent(h.resourceEvent(EventResourceCreated, *infra3Resource, nil))
 
 	err = deleteInfra3ResourcesExceptNewest(h.DB, infra3Resource)
 	if err != nil {
@@ -1427,6 +1534,7 @@ func (h APIHandler) addResource(c *gin.Context) (string, error) {
 	if result.Error != nil {
 		return "", fmt.Errorf("error saving infra3_resource_spec: %s", result.Error)
 	}
+	saveRedactionAudit(h.DB, "resource_spec", infra3ResourceSpec.Infra3ResourceUUID, infra3ResourceSpec.Generation, "", specRedactions)
 
 	apiURL := GetApiURL(c, h.serviceIP)
 	_, err = NewTaskToken(h.DB, *infra3ResourceSpec, h.tenant, clusterName, apiURL, h.clientset)
@@ -1444,6 +1552,51 @@ func (h APIHandler) addResource(c *gin.Context) (string, error) {
 	return "", nil
 }
 
+// storedGeneration returns the generation stored for a generation of the origin resource and if it was
+// stored already. A new origin generation keeps its number unless a rollback took it, then the next free
+// generation is used.
+func storedGeneration(db *gorm.DB, infra3ResourceUUID, originGeneration string) (string, bool, error) {
+	var infra3ResourceSpec models.Infra3ResourceSpec
+	result := db.Where("infra3_resource_uuid = ? AND origin_generation = ?", infra3ResourceUUID, originGeneration).Order("id DESC").First(&infra3ResourceSpec)
+	if result.Error == nil {
+		return infra3ResourceSpec.Generation, true, nil
+	} else if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return "", false, result.Error
+	}
+
+	highest, err := highestGenerations(db, infra3ResourceUUID)
+	if err != nil {
+		return "", false, err
+	}
+	origin, err := strconv.ParseInt(originGeneration, 10, 64)
+	if err != nil {
+		return "", false, fmt.Errorf("generation '%s' is not a number", originGeneration)
+	}
+	if origin < highest.OriginGeneration {
+		return "", false, fmt.Errorf("generation '%s' is less than generation '%d' of the origin resource", originGeneration, highest.OriginGeneration)
+	}
+	return strconv.FormatInt(max(origin, highest.Generation+1), 10), false, nil
+}
+
+// storedGenerations are the highest generation stored for a resource and the highest generation of the
+// origin resource a spec was stored for
+type storedGenerations struct {
+	Generation       int64
+	OriginGeneration int64
+}
+
+func highestGenerations(db *gorm.DB, infra3ResourceUUID string) (storedGenerations, error) {
+	var highest storedGenerations
+	result := db.Raw(`
+		SELECT
+			COALESCE(MAX(CAST(generation AS integer)), 0) AS generation,
+			COALESCE(MAX(CAST(NULLIF(origin_generation, '') AS integer)), 0) AS origin_generation
+		FROM infra3_resource_specs
+		WHERE infra3_resource_uuid = ? AND deleted_at IS NULL
+	`, infra3ResourceUUID).Scan(&highest)
+	return highest, result.Error
+}
+
 // updateResource updates the resource in the vcluster and the database
 func (h APIHandler) updateResource(c *gin.Context) error {
 	clusterName := c.Param("cluster_name")
@@ -1489,23 +1642,33 @@ func (h APIHandler) updateResource(c *gin.Context) error {
 		return fmt.Errorf("error getting infra3Resource: %v", result.Error)
 	}
 
-	// Generation lookups are done from the origin resource and not the generation in the vcluster.
+	// Generation lookups are done from the origin resource and not the generation in the vcluster. The
+	// origin's generation is mapped to the generation stored for it because rollbacks take generations
+	// the origin doesn't know about.
 	gen1 := infra3Resource.CurrentGeneration
 	gen2 := infra3ResourceFromDatabase.CurrentGeneration
-	if compare(gen1, "<", gen2) {
+	generation, found, err := storedGeneration(h.DB, infra3ResourceFromDatabase.UUID, gen1)
+	if err != nil {
+		return fmt.Errorf("error updating resource, %s", err)
+	}
+	if compare(generation, "<", gen2) {
 		return fmt.Errorf("error updating resource, generation '%s' is less than current generation '%s'", gen1, gen2)
 	}
 
-	if compare(gen1, ">", gen2) {
+	newGeneration := !found
+	if newGeneration {
 		// Reset the state of the resource because this is a new generation of the resource spec
 		infra3ResourceFromDatabase.CurrentState = models.Untracked
-		infra3ResourceFromDatabase.CurrentGeneration = infra3Resource.CurrentGeneration
+		infra3ResourceFromDatabase.CurrentGeneration = generation
 	}
 
 	result = h.DB.Save(&infra3ResourceFromDatabase) // Updates database state with any generation changes
 	if result.Error != nil {
 		return result.Error
 	}
+	if newGeneration {
+		h.publishEvent(h.resourceEvent(EventGenerationCreated, infra3ResourceFromDatabase, map[string]any{"previous_generation": gen2}))
+	}
 
 	err = deleteInfra3ResourcesExceptNewest(h.DB, &infra3ResourceFromDatabase)
 	if err != nil {
@@ -1513,16 +1676,21 @@ func (h APIHandler) updateResource(c *gin.Context) error {
 	}
 
 	infra3ResourceSpecFromDatabase := models.Infra3ResourceSpec{}
-	result = h.DB.Where("infra3_resource_uuid = ? AND generation = ?", infra3ResourceFromDatabase.UUID, infra3ResourceFromDatabase.CurrentGeneration).First(&infra3ResourceSpecFromDatabase)
+	result = h.DB.Where("infra3_resource_uuid = ? AND generation = ?", infra3ResourceFromDatabase.UUID, generation).First(&infra3ResourceSpecFromDatabase)
 	if result.Error != nil && errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		infra3ResourceSpec.Generation = generation
+		specRedactions := h.Redactor.redactResourceSpec(infra3ResourceSpec)
 		result = h.DB.Create(&infra3ResourceSpec)
 		if result.Error != nil {
 			return result.Error
 		}
+		saveRedactionAudit(h.DB, "resource_spec", infra3ResourceSpec.Infra3ResourceUUID, infra3ResourceSpec.Generation, "", specRedactions)
 		infra3ResourceSpecFromDatabase = *infra3ResourceSpec
 	} else if result.Error != nil {
 		return fmt.Errorf("error occurred when looking for infra3_resource_spec: %v", result.Error)
 	}
+	// Tasks report the generation of the Tf, which must be the stored one
+	jsonData.Tf.Generation, _ = strconv.ParseInt(generation, 10, 64)
 
 	apiURL := GetApiURL(c, h.serviceIP)
 	_, err = NewTaskToken(h.DB, infra3ResourceSpecFromDatabase, h.tenant, clusterName, apiURL, h.clientset)
@@ -2021,6 +2189,13 @@ func applyOnCreateOrUpdate(ctx context.Context, tf infra3v1.Tf, clientset kubern
 			tf.SetManagedFields(item.GetManagedFields())
 			tf.SetCreationTimestamp(item.GetCreationTimestamp())
 			tf.Status = item.Status
+			// The origin doesn't know about cancels, keep the cancel of the workflow the vcluster runs
+			if value, found := item.Annotations[cancelAnnotation]; found {
+				if tf.Annotations == nil {
+					tf.Annotations = map[string]string{}
+				}
+				tf.Annotations[cancelAnnotation] = value
+			}
 			isPatch = true
 			break
 		}
@@ -0,0 +1,530 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/logstore"
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// retentionLeaderLockKey is the postgres advisory lock held by the replica that runs the retention job
+const retentionLeaderLockKey int64 = 0x6933726574656e74
+
+// RetentionPolicy configures how task logs, task pods, resource specs and refresh tokens are pruned.
+// A zero value for KeepGenerations or MaxAge disables that rule.
+type RetentionPolicy struct {
+	// KeepGenerations is the number of newest generations to keep per resource
+	KeepGenerations int
+
+	// MaxAge drops task logs, expired refresh tokens, soft-deleted resources, events, webhook deliveries and
+	// notifications older than the duration
+	MaxAge time.Duration
+
+	// Interval is how often the background job runs
+	Interval time.Duration
+
+	// DryRun makes the background job only record what would have been pruned
+	DryRun bool
+}
+
+func (p RetentionPolicy) enabled() bool {
+	return p.KeepGenerations > 0 || p.MaxAge > 0
+}
+
+// retentionResourceReport is the per resource breakdown of what a retention pass removes
+type retentionResourceReport struct {
+	Infra3ResourceUUID string `json:"infra3_resource_uuid"`
+	Name               string `json:"name"`
+	Namespace          string `json:"namespace"`
+	ClusterName        string `json:"cluster_name"`
+	Deleted            bool   `json:"deleted"`
+	TaskPods           int64  `json:"task_pods"`
+	TaskLogs           int64  `json:"task_logs"`
+	Bytes              int64  `json:"bytes"`
+}
+
+// RetentionReport describes the rows selected for pruning by the RetentionPolicy
+type RetentionReport struct {
+	KeepGenerations int                       `json:"keep_generations"`
+	MaxAge          string                    `json:"max_age"`
+	Cutoff          *time.Time                `json:"cutoff"`
+	TaskLogs        int64                     `json:"task_logs"`
+	TaskPods        int64                     `json:"task_pods"`
+	ResourceSpecs   int64                     `json:"resource_specs"`
+	RefreshTokens   int64                     `json:"refresh_tokens"`
+	Resources       int64                     `json:"resources"`
+	BytesReclaimed  int64                     `json:"bytes_reclaimed"`
+	Breakdown       []retentionResourceReport `json:"breakdown"`
+
+	taskPodUUIDs    []string
+	resourceSpecIDs []uint
+	refreshTokenIDs []uint
+	resourceUUIDs   []string
+}
+
+// retentionProtectedTasks selects task pods that are never pruned: plans that were approved and every
+// task of a generation that is currently failed.
+const retentionProtectedTasks = `
+	SELECT approvals.task_pod_uuid FROM approvals
+	WHERE approvals.is_approved AND approvals.deleted_at IS NULL
+	UNION
+	SELECT task_pods.uuid FROM task_pods
+	JOIN infra3_resources ON infra3_resources.uuid = task_pods.infra3_resource_uuid
+	WHERE infra3_resources.current_state = 'failed'
+	AND task_pods.generation = infra3_resources.current_generation
+`
+
+// retentionPrunedGenerations selects the generations of each resource that fall outside of the newest
+// "keep" generations. The current generation of a live resource is never selected.
+const retentionPrunedGenerations = `
+	SELECT ranked.infra3_resource_uuid, ranked.generation FROM (
+		SELECT
+			generations.infra3_resource_uuid,
+			generations.generation,
+			DENSE_RANK() OVER (
+				PARTITION BY generations.infra3_resource_uuid
+				ORDER BY CAST(NULLIF(generations.generation, '') AS BIGINT) DESC NULLS LAST
+			) AS generation_rank
+		FROM (
+			SELECT infra3_resource_uuid, generation FROM infra3_resource_specs
+			UNION
+			SELECT infra3_resource_uuid, generation FROM task_pods
+		) generations
+	) ranked
+	JOIN infra3_resources ON infra3_resources.uuid = ranked.infra3_resource_uuid
+	WHERE ranked.generation_rank > @keep
+	AND (infra3_resources.deleted_at IS NOT NULL OR ranked.generation <> infra3_resources.current_generation)
+`
+
+// retentionReport selects everything the policy would prune without changing the database
+func retentionReport(db *gorm.DB, policy RetentionPolicy, now time.Time) (*RetentionReport, error) {
+	report := RetentionReport{
+		KeepGenerations: policy.KeepGenerations,
+		Breakdown:       []retentionResourceReport{},
+	}
+	if !policy.enabled() {
+		return &report, nil
+	}
+
+	// Named arguments are shared by all the queries below. Conditions for disabled rules are left out
+	// of the query entirely.
+	args := map[string]any{
+		"keep":   policy.KeepGenerations,
+		"cutoff": now,
+	}
+	if policy.MaxAge > 0 {
+		cutoff := now.Add(-policy.MaxAge)
+		args["cutoff"] = cutoff
+		report.Cutoff = &cutoff
+		report.MaxAge = policy.MaxAge.String()
+	}
+
+	taskConditions := []string{}
+	specConditions := []string{}
+	if policy.KeepGenerations > 0 {
+		taskConditions = append(taskConditions, "(task_pods.infra3_resource_uuid, task_pods.generation) IN ("+retentionPrunedGenerations+")")
+		specConditions = append(specConditions, "(infra3_resource_specs.infra3_resource_uuid, infra3_resource_specs.generation) IN ("+retentionPrunedGenerations+")")
+	}
+	if policy.MaxAge > 0 {
+		taskConditions = append(taskConditions,
+			"GREATEST(MAX(infra3_task_logs.updated_at), task_pods.updated_at) < @cutoff",
+			"infra3_resources.deleted_at < @cutoff",
+		)
+		specConditions = append(specConditions, "infra3_resources.deleted_at < @cutoff")
+	}
+
+	var tasks []struct {
+		UUID               string
+		Infra3ResourceUUID string
+		Logs               int64
+		Bytes              int64
+	}
+	result := db.Raw(`
+		SELECT
+			task_pods.uuid,
+			task_pods.infra3_resource_uuid,
+			COUNT(infra3_task_logs.id) AS logs,
+			COALESCE(SUM(infra3_task_logs.size), 0) AS bytes
+		FROM task_pods
+		JOIN infra3_resources ON infra3_resources.uuid = task_pods.infra3_resource_uuid
+		LEFT JOIN infra3_task_logs ON infra3_task_logs.task_pod_uuid = task_pods.uuid
+		WHERE NOT (infra3_resources.deleted_at IS NULL AND task_pods.generation = infra3_resources.current_generation)
+		AND task_pods.uuid NOT IN (`+retentionProtectedTasks+`)
+		GROUP BY task_pods.uuid, task_pods.infra3_resource_uuid, task_pods.generation, task_pods.updated_at, infra3_resources.deleted_at
+		HAVING `+strings.Join(taskConditions, " OR "), args).Scan(&tasks)
+	if result.Error != nil {
+		return nil, fmt.Errorf("error selecting task_pods for retention: %s", result.Error)
+	}
+
+	breakdown := map[string]*retentionResourceReport{}
+	for _, task := range tasks {
+		report.taskPodUUIDs = append(report.taskPodUUIDs, task.UUID)
+		report.TaskPods++
+		report.TaskLogs += task.Logs
+		report.BytesReclaimed += task.Bytes
+		if _, found := breakdown[task.Infra3ResourceUUID]; !found {
+			breakdown[task.Infra3ResourceUUID] = &retentionResourceReport{Infra3ResourceUUID: task.Infra3ResourceUUID}
+		}
+		breakdown[task.Infra3ResourceUUID].TaskPods++
+		breakdown[task.Infra3ResourceUUID].TaskLogs += task.Logs
+		breakdown[task.Infra3ResourceUUID].Bytes += task.Bytes
+	}
+
+	if len(specConditions) > 0 {
+		var specs []struct {
+			ID                 uint
+			Infra3ResourceUUID string
+			Bytes              int64
+		}
+		result = db.Raw(`
+			SELECT
+				infra3_resource_specs.id,
+				infra3_resource_specs.infra3_resource_uuid,
+				COALESCE(OCTET_LENGTH(infra3_resource_specs.resource_spec), 0)
+					+ COALESCE(OCTET_LENGTH(infra3_resource_specs.annotations), 0)
+					+ COALESCE(OCTET_LENGTH(infra3_resource_specs.labels), 0) AS bytes
+			FROM infra3_resource_specs
+			JOIN infra3_resources ON infra3_resources.uuid = infra3_resource_specs.infra3_resource_uuid
+			WHERE NOT (infra3_resources.deleted_at IS NULL AND infra3_resource_specs.generation = infra3_resources.current_generation)
+			AND NOT EXISTS (
+				SELECT 1 FROM task_pods
+				WHERE task_pods.infra3_resource_uuid = infra3_resource_specs.infra3_resource_uuid
+				AND task_pods.generation = infra3_resource_specs.generation
+				AND task_pods.uuid IN (`+retentionProtectedTasks+`)
+			)
+			AND (`+strings.Join(specConditions, " OR ")+`)
+		`, args).Scan(&specs)
+		if result.Error != nil {
+			return nil, fmt.Errorf("error selecting infra3_resource_specs for retention: %s", result.Error)
+		}
+		for _, spec := range specs {
+			report.resourceSpecIDs = append(report.resourceSpecIDs, spec.ID)
+			report.ResourceSpecs++
+			report.BytesReclaimed += spec.Bytes
+			if _, found := breakdown[spec.Infra3ResourceUUID]; !found {
+				breakdown[spec.Infra3ResourceUUID] = &retentionResourceReport{Infra3ResourceUUID: spec.Infra3ResourceUUID}
+			}
+			breakdown[spec.Infra3ResourceUUID].Bytes += spec.Bytes
+		}
+	}
+
+	tokenQuery := db.Model(&models.RefreshToken{}).Unscoped().Select("id")
+	tokenConditions := []string{}
+	tokenArgs := []any{}
+	if len(report.resourceSpecIDs) > 0 {
+		tokenConditions = append(tokenConditions, "infra3_resource_spec_id IN ?")
+		tokenArgs = append(tokenArgs, report.resourceSpecIDs)
+	}
+	if policy.MaxAge > 0 {
+		tokenConditions = append(tokenConditions, "canceled_at < ?")
+		tokenArgs = append(tokenArgs, args["cutoff"])
+	}
+	if len(tokenConditions) > 0 {
+		if result := tokenQuery.Where(strings.Join(tokenConditions, " OR "), tokenArgs...).Scan(&report.refreshTokenIDs); result.Error != nil {
+			return nil, fmt.Errorf("error selecting refresh_tokens for retention: %s", result.Error)
+		}
+		report.RefreshTokens = int64(len(report.refreshTokenIDs))
+	}
+
+	if policy.MaxAge > 0 {
+		// Soft-deleted resources are only removed once none of their tasks are protected
+		result = db.Raw(`
+			SELECT infra3_resources.uuid FROM infra3_resources
+			WHERE infra3_resources.deleted_at < @cutoff
+			AND NOT EXISTS (
+				SELECT 1 FROM task_pods
+				WHERE task_pods.infra3_resource_uuid = infra3_resources.uuid
+				AND task_pods.uuid IN (`+retentionProtectedTasks+`)
+			)
+		`, args).Scan(&report.resourceUUIDs)
+		if result.Error != nil {
+			return nil, fmt.Errorf("error selecting infra3_resources for retention: %s", result.Error)
+		}
+		report.Resources = int64(len(report.resourceUUIDs))
+	}
+
+	if len(breakdown) > 0 {
+		uuids := []string{}
+		for uuid := range breakdown {
+			uuids = append(uuids, uuid)
+		}
+		var resources []struct {
+			UUID        string
+			Name        string
+			Namespace   string
+			ClusterName string
+			DeletedAt   *time.Time
+		}
+		db.Raw(`
+			SELECT infra3_resources.uuid, infra3_resources.name, infra3_resources.namespace, infra3_resources.deleted_at, clusters.name AS cluster_name
+			FROM infra3_resources
+			JOIN clusters ON clusters.id = infra3_resources.cluster_id
+			WHERE infra3_resources.uuid IN ?
+		`, uuids).Scan(&resources)
+		for _, r := range resources {
+			breakdown[r.UUID].Name = r.Name
+			breakdown[r.UUID].Namespace = r.Namespace
+			breakdown[r.UUID].ClusterName = r.ClusterName
+			breakdown[r.UUID].Deleted = r.DeletedAt != nil
+		}
+		for _, item := range breakdown {
+			report.Breakdown = append(report.Breakdown, *item)
+		}
+	}
+
+	return &report, nil
+}
+
+// retentionBatchSize keeps IN clauses well below the postgres bind parameter limit
+const retentionBatchSize = 1000
+
+func inBatches[T any](items []T, fn func([]T) error) error {
+	for start := 0; start < len(items); start += retentionBatchSize {
+		end := start + retentionBatchSize
+		if end > len(items) {
+			end = len(items)
+		}
+		if err := fn(items[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prune hard deletes the rows selected in the report. Rows are deleted children first to satisfy the
+// foreign keys between the tables. Logs that were offloaded and task artifacts are removed from the log
+// store once the rows are gone.
+func (report *RetentionReport) prune(ctx context.Context, db *gorm.DB, store logstore.LogStore) error {
+	// Store names and keys of the content to remove from the log store
+	offloaded := [][2]string{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := inBatches(report.taskPodUUIDs, func(uuids []string) error {
+			var taskLogs []models.Infra3TaskLog
+			if result := tx.Unscoped().Select("task_pod_uuid, store, store_key, store_chunks").Where("task_pod_uuid IN ? AND store <> ''", uuids).Find(&taskLogs); result.Error != nil {
+				return fmt.Errorf("error selecting offloaded infra3_task_logs: %s", result.Error)
+			}
+			for _, taskLog := range taskLogs {
+				for _, key := range logChunkKeys(taskLog) {
+					offloaded = append(offloaded, [2]string{taskLog.Store, key})
+				}
+			}
+			var artifacts []models.TaskArtifact
+			if result := tx.Unscoped().Select("task_pod_uuid, store, store_key").Where("task_pod_uuid IN ?", uuids).Find(&artifacts); result.Error != nil {
+				return fmt.Errorf("error selecting task_artifacts: %s", result.Error)
+			}
+			for _, artifact := range artifacts {
+				offloaded = append(offloaded, [2]string{artifact.Store, artifact.StoreKey})
+			}
+			if result := tx.Unscoped().Where("task_pod_uuid IN ?", uuids).Delete(&models.TaskArtifact{}); result.Error != nil {
+				return fmt.Errorf("error deleting task_artifacts: %s", result.Error)
+			}
+			if result := tx.Unscoped().Where("task_pod_uuid IN ?", uuids).Delete(&models.Infra3TaskLog{}); result.Error != nil {
+				return fmt.Errorf("error deleting infra3_task_logs: %s", result.Error)
+			}
+			if result := tx.Unscoped().Where("task_pod_uuid IN ?", uuids).Delete(&models.Approval{}); result.Error != nil {
+				return fmt.Errorf("error deleting approvals: %s", result.Error)
+			}
+			if result := tx.Unscoped().Where("task_pod_uuid IN ?", uuids).Delete(&models.ApprovalVote{}); result.Error != nil {
+				return fmt.Errorf("error deleting approval_votes: %s", result.Error)
+			}
+			if result := tx.Unscoped().Where("task_pod_uuid IN ?", uuids).Delete(&models.ApprovalLink{}); result.Error != nil {
+				return fmt.Errorf("error deleting approval_links: %s", result.Error)
+			}
+			if result := tx.Unscoped().Where("task_pod_uuid IN ?", uuids).Delete(&models.PlanSummary{}); result.Error != nil {
+				return fmt.Errorf("error deleting plan_summaries: %s", result.Error)
+			}
+			if result := tx.Unscoped().Where("uuid IN ?", uuids).Delete(&models.TaskPod{}); result.Error != nil {
+				return fmt.Errorf("error deleting task_pods: %s", result.Error)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = inBatches(report.refreshTokenIDs, func(ids []uint) error {
+			if result := tx.Unscoped().Where("id IN ?", ids).Delete(&models.RefreshToken{}); result.Error != nil {
+				return fmt.Errorf("error deleting refresh_tokens: %s", result.Error)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = inBatches(report.resourceSpecIDs, func(ids []uint) error {
+			if result := tx.Unscoped().Where("id IN ?", ids).Delete(&models.Infra3ResourceSpec{}); result.Error != nil {
+				return fmt.Errorf("error deleting infra3_resource_specs: %s", result.Error)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = inBatches(report.resourceUUIDs, func(uuids []string) error {
+			// Resources that still own rows are left for a later pass
+			for _, table := range []string{"cancellations", "drift_checks", "schedules", "rollbacks"} {
+				result := tx.Exec(`
+					DELETE FROM `+table+`
+					WHERE infra3_resource_uuid IN ?
+					AND NOT EXISTS (SELECT 1 FROM task_pods WHERE task_pods.infra3_resource_uuid = `+table+`.infra3_resource_uuid)
+					AND NOT EXISTS (SELECT 1 FROM infra3_resource_specs WHERE infra3_resource_specs.infra3_resource_uuid = `+table+`.infra3_resource_uuid)
+				`, uuids)
+				if result.Error != nil {
+					return fmt.Errorf("error deleting %s: %s", table, result.Error)
+				}
+			}
+			result := tx.Exec(`
+				DELETE FROM infra3_resources
+				WHERE uuid IN ?
+				AND NOT EXISTS (SELECT 1 FROM task_pods WHERE task_pods.infra3_resource_uuid = infra3_resources.uuid)
+				AND NOT EXISTS (SELECT 1 FROM infra3_resource_specs WHERE infra3_resource_specs.infra3_resource_uuid = infra3_resources.uuid)
+			`, uuids)
+			if result.Error != nil {
+				return fmt.Errorf("error deleting infra3_resources: %s", result.Error)
+			}
+			return nil
+		})
+		if err != nil || report.Cutoff == nil {
+			return err
+		}
+
+		// Webhook deliveries and notifications that are still being retried keep their event
+		if result := tx.Where("created_at < ? AND status <> ?", *report.Cutoff, webhookDeliveryPending).Delete(&models.WebhookDelivery{}); result.Error != nil {
+			return fmt.Errorf("error deleting webhook_deliveries: %s", result.Error)
+		}
+		if result := tx.Where("created_at < ? AND status <> ?", *report.Cutoff, notificationPending).Delete(&models.Notification{}); result.Error != nil {
+			return fmt.Errorf("error deleting notifications: %s", result.Error)
+		}
+		result := tx.Exec(`
+			DELETE FROM events
+			WHERE created_at < ?
+			AND NOT EXISTS (SELECT 1 FROM webhook_deliveries WHERE webhook_deliveries.event_id = events.id)
+			AND NOT EXISTS (SELECT 1 FROM notifications WHERE notifications.event_id = events.id)
+		`, *report.Cutoff)
+		if result.Error != nil {
+			return fmt.Errorf("error deleting events: %s", result.Error)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, object := range offloaded {
+		storeName, key := object[0], object[1]
+		if store == nil || store.Name() != storeName {
+			log.Printf("WARNING %s remains in the %s log store which is not configured", key, storeName)
+			continue
+		}
+		if err := store.Delete(ctx, key); err != nil {
+			log.Printf("ERROR deleting %s from the %s log store: %s", key, storeName, err)
+		}
+	}
+	return nil
+}
+
+// runRetention creates a report and prunes the selected rows unless dryRun is set. Every run is saved
+// as a RetentionRun for the retention metrics.
+func runRetention(db *gorm.DB, store logstore.LogStore, policy RetentionPolicy, dryRun bool) (*RetentionReport, error) {
+	now := time.Now().UTC()
+	run := models.RetentionRun{
+		DryRun:    dryRun,
+		StartedAt: now,
+	}
+
+	report, err := retentionReport(db, policy, now)
+	if err == nil && !dryRun {
+		err = report.prune(context.TODO(), db, store)
+	}
+	if err != nil {
+		run.Error = err.Error()
+	} else {
+		run.TaskLogs = report.TaskLogs
+		run.TaskPods = report.TaskPods
+		run.ResourceSpecs = report.ResourceSpecs
+		run.RefreshTokens = report.RefreshTokens
+		run.Resources = report.Resources
+		run.BytesReclaimed = report.BytesReclaimed
+	}
+	finishedAt := time.Now().UTC()
+	run.FinishedAt = &finishedAt
+	if result := db.Create(&run); result.Error != nil {
+		log.Printf("ERROR saving retention run: %s", result.Error)
+	}
+
+	return report, err
+}
+
+// RunRetention prunes the database on the configured interval until the context is canceled. Only the
+// replica holding the leader lock prunes, so replicas don't delete the same rows concurrently.
+func (h APIHandler) RunRetention(ctx context.Context) {
+	if h.DB == nil || !h.Retention.enabled() {
+		return
+	}
+	interval := h.Retention.Interval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	leader := &leaderLock{db: h.DB, key: retentionLeaderLockKey}
+	defer leader.release()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		isLeader, err := leader.acquire(ctx)
+		if err != nil {
+			log.Printf("ERROR acquiring the retention lock: %s", err)
+		}
+		if isLeader {
+			report, err := runRetention(h.DB, h.LogStore, h.Retention, h.Retention.DryRun)
+			if err != nil {
+				log.Printf("ERROR retention run failed: %s", err)
+			} else {
+				log.Printf("Retention run (dry-run=%t) selected %d task logs, %d task pods, %d resource specs, %d refresh tokens, %d resources (%d bytes)",
+					h.Retention.DryRun, report.TaskLogs, report.TaskPods, report.ResourceSpecs, report.RefreshTokens, report.Resources, report.BytesReclaimed)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// retentionDryRun reports what the retention policy would prune right now. The policy can be overridden
+// with the "keep_generations" and "max_age" query params to preview a different policy.
+func (h APIHandler) retentionDryRun(c *gin.Context) {
+	policy := h.Retention
+	if keep, found := c.GetQuery("keep_generations"); found {
+		if _, err := fmt.Sscan(keep, &policy.KeepGenerations); err != nil {
+			c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, fmt.Sprintf("keep_generations must be an int, got %s", keep), []any{}))
+			return
+		}
+	}
+	if maxAge, found := c.GetQuery("max_age"); found {
+		d, err := time.ParseDuration(maxAge)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, fmt.Sprintf("max_age must be a duration, got %s", maxAge), []any{}))
+			return
+		}
+		policy.MaxAge = d
+	}
+
+	report, err := retentionReport(h.DB, policy, time.Now().UTC())
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", []RetentionReport{*report}))
+}
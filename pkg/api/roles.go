@@ -0,0 +1,89 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/galleybytes/infrakube-stella/pkg/util"
+	"github.com/gin-gonic/gin"
+)
+
+// usernameContextKey holds the username of the validated user JWT in the gin context
+const usernameContextKey = "username"
+
+const (
+	// RolePrivileged can read sensitive values like sensitive terraform outputs and state
+	RolePrivileged = "privileged"
+
+	// RoleStateReader can inspect the terraform state with sensitive values masked
+	RoleStateReader = "state-reader"
+
+	// RoleArtifactReader can download the artifacts uploaded by tasks
+	RoleArtifactReader = "artifact-reader"
+)
+
+// UserRoles maps usernames to the roles granted to them. The admin user is granted every role.
+type UserRoles map[string][]string
+
+// ParseUserRoles reads roles in the form "user=role,user=role". A user is granted several roles by
+// repeating the user.
+func ParseUserRoles(s string) (UserRoles, error) {
+	userRoles := UserRoles{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		username, role, found := strings.Cut(pair, "=")
+		username = strings.TrimSpace(username)
+		role = strings.TrimSpace(role)
+		if !found || username == "" || role == "" {
+			return nil, fmt.Errorf("user role '%s' is not in the form 'user=role'", pair)
+		}
+		if !util.Contains(userRoles[username], role) {
+			userRoles[username] = append(userRoles[username], role)
+		}
+	}
+	return userRoles, nil
+}
+
+// username returns the username of the caller, which is empty for tasks and unauthenticated calls
+func username(c *gin.Context) string {
+	return c.GetString(usernameContextKey)
+}
+
+// hasRole reports if the caller was granted the role
+func (h APIHandler) hasRole(c *gin.Context, role string) bool {
+	return h.userHasRole(username(c), role)
+}
+
+// userHasRole reports if the user was granted the role
+func (h APIHandler) userHasRole(user, role string) bool {
+	if user == "" {
+		return false
+	}
+	if adminUsername != "" && user == adminUsername {
+		return true
+	}
+	return util.Contains(h.UserRoles[user], role)
+}
+
+// knownUser reports if the user was granted any role
+func (h APIHandler) knownUser(user string) bool {
+	if user == "" {
+		return false
+	}
+	return (adminUsername != "" && user == adminUsername) || len(h.UserRoles[user]) > 0
+}
+
+// requireRole responds with forbidden unless the caller was granted one of the roles
+func (h APIHandler) requireRole(c *gin.Context, roles ...string) bool {
+	for _, role := range roles {
+		if h.hasRole(c, role) {
+			return true
+		}
+	}
+	c.JSON(http.StatusForbidden, response(http.StatusForbidden, fmt.Sprintf("one of the roles %s is required", strings.Join(roles, ", ")), []any{}))
+	return false
+}
@@ -0,0 +1,247 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+	infra3v1 "github.com/galleybytes/infrakube/pkg/apis/infra3/v1"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// rollbackCallbackTimeout limits how long the origin cluster's callback may take
+const rollbackCallbackTimeout = 10 * time.Second
+
+// RollbackCallback is sent to APIHandler.RollbackCallbackURL so the origin cluster can write the
+// reverted spec back to its Tf. Until then the origin and the vcluster are out of sync.
+type RollbackCallback struct {
+	Infra3ResourceUUID string            `json:"infra3_resource_uuid"`
+	ClusterName        string            `json:"cluster_name"`
+	Namespace          string            `json:"namespace"`
+	Name               string            `json:"name"`
+	Generation         string            `json:"generation"`
+	RolledBackTo       string            `json:"rolled_back_to"`
+	Spec               infra3v1.TfSpec   `json:"spec"`
+	Labels             map[string]string `json:"labels"`
+	Annotations        map[string]string `json:"annotations"`
+}
+
+// rollbackTf rebuilds the Tf from a stored resource spec. The labels and annotations are the ones of the
+// origin resource at that generation.
+func rollbackTf(infra3Resource models.Infra3Resource, infra3ResourceSpec models.Infra3ResourceSpec) (*infra3v1.Tf, error) {
+	for _, value := range []string{infra3ResourceSpec.ResourceSpec, infra3ResourceSpec.Labels, infra3ResourceSpec.Annotations} {
+		if strings.Contains(value, redactionMarker) {
+			return nil, fmt.Errorf("secrets were redacted from the spec of generation %s, it can't be restored", infra3ResourceSpec.Generation)
+		}
+	}
+
+	tf := infra3v1.Tf{}
+	tf.Name = infra3Resource.Name
+	tf.Namespace = infra3Resource.Namespace
+	tf.UID = types.UID(infra3Resource.UUID)
+	if err := json.Unmarshal([]byte(infra3ResourceSpec.ResourceSpec), &tf.Spec); err != nil {
+		return nil, fmt.Errorf("spec of generation %s is not valid: %s", infra3ResourceSpec.Generation, err)
+	}
+	if infra3ResourceSpec.Labels != "" {
+		json.Unmarshal([]byte(infra3ResourceSpec.Labels), &tf.Labels)
+	}
+	if infra3ResourceSpec.Annotations != "" {
+		json.Unmarshal([]byte(infra3ResourceSpec.Annotations), &tf.Annotations)
+	}
+	return &tf, nil
+}
+
+// sendRollbackCallback posts the reverted spec to the callback url. The body is signed with the
+// callback secret in the "X-Infra3-Signature-256" header when a secret is set.
+func (h APIHandler) sendRollbackCallback(ctx context.Context, callback RollbackCallback) error {
+	b, err := json.Marshal(callback)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, rollbackCallbackTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.RollbackCallbackURL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.RollbackCallbackSecret != "" {
+		req.Header.Set("X-Infra3-Signature-256", signPayload(h.RollbackCallbackSecret, b))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("callback responded %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// rollbackResource applies the spec of a previous generation to the vcluster as a new generation. The
+// reverted spec always requires approval, so nothing is applied before someone reviews the plan. Send
+// {"reason": "..."} to record why. When a callback url is configured the reverted spec is sent to the
+// origin cluster.
+func (h APIHandler) rollbackResource(c *gin.Context) {
+	infra3ResourceUUID := c.Param("infra3_resource_uuid")
+	toGeneration := c.Query("to_generation")
+	if _, err := strconv.Atoi(toGeneration); err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, fmt.Sprintf("to_generation must be a generation, got '%s'", toGeneration), []any{}))
+		return
+	}
+	jsonData := struct {
+		Reason string `json:"reason"`
+	}{}
+	if err := c.ShouldBindJSON(&jsonData); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+
+	var infra3Resource models.Infra3Resource
+	if result := h.DB.First(&infra3Resource, "uuid = ?", infra3ResourceUUID); result.Error != nil {
+		c.JSON(http.StatusNotFound, response(http.StatusNotFound, result.Error.Error(), []any{}))
+		return
+	}
+	if toGeneration == infra3Resource.CurrentGeneration {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, fmt.Sprintf("generation %s is the current generation", toGeneration), []any{}))
+		return
+	}
+	if infra3Resource.CurrentState == models.Running {
+		c.JSON(http.StatusConflict, response(http.StatusConflict, fmt.Sprintf("workflow of '%s/%s' is running, cancel it before rolling back", infra3Resource.Namespace, infra3Resource.Name), []any{}))
+		return
+	}
+	infra3ResourceSpec := h.LookupResourceSpec(toGeneration, infra3ResourceUUID)
+	if infra3ResourceSpec == nil {
+		c.JSON(http.StatusNotFound, response(http.StatusNotFound, fmt.Sprintf("generation %s not found", toGeneration), []any{}))
+		return
+	}
+	tf, err := rollbackTf(infra3Resource, *infra3ResourceSpec)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	tf.Spec.RequireApproval = true
+
+	// Take the next free generation like a new origin generation does, a generation that is not current
+	// anymore may have been stored already
+	highest, err := highestGenerations(h.DB, infra3ResourceUUID)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	tf.Generation = highest.Generation + 1
+	generation := strconv.FormatInt(tf.Generation, 10)
+	spec, err := jsonify(tf.Spec)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	rolledBackSpec := models.Infra3ResourceSpec{
+		Infra3ResourceUUID: infra3ResourceUUID,
+		Generation:         generation,
+		ResourceSpec:       spec,
+		Annotations:        infra3ResourceSpec.Annotations,
+		Labels:             infra3ResourceSpec.Labels,
+		Author:             username(c),
+	}
+	rollback := models.Rollback{
+		Infra3ResourceUUID: infra3ResourceUUID,
+		FromGeneration:     infra3Resource.CurrentGeneration,
+		ToGeneration:       toGeneration,
+		Generation:         generation,
+		RequestedBy:        username(c),
+		Reason:             jsonData.Reason,
+		Status:             models.RollbackPending,
+	}
+	clusterName := getClusterName(infra3Resource.ClusterID, h.DB)
+	apiURL := GetApiURL(c, h.serviceIP)
+	// The cluster name label and the global task options only exist in the vcluster
+	labels := map[string]string{}
+	for key, value := range tf.Labels {
+		labels[key] = value
+	}
+	callback := RollbackCallback{
+		Infra3ResourceUUID: infra3ResourceUUID,
+		ClusterName:        clusterName,
+		Namespace:          tf.Namespace,
+		Name:               tf.Name,
+		Generation:         generation,
+		RolledBackTo:       toGeneration,
+		Spec:               tf.Spec,
+		Labels:             labels,
+		Annotations:        tf.Annotations,
+	}
+	appendClusterNameLabel(tf, clusterName)
+	addGlobalTaskOptions(tf, h.tenant, clusterName, apiURL)
+
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		if result := tx.Create(&rolledBackSpec); result.Error != nil {
+			return result.Error
+		}
+		if result := tx.Create(&rollback); result.Error != nil {
+			return result.Error
+		}
+		return tx.Model(&infra3Resource).Updates(map[string]any{"current_generation": generation, "current_state": models.Untracked}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+
+	// The token and the Tf live in the vcluster and can't be rolled back with the transaction, so they are
+	// created once the rows are stored. When that fails the rollback records the error and the resource
+	// goes back to its generation unless it moved on since.
+	if err := h.applyRollback(c, *tf, rolledBackSpec, clusterName, apiURL); err != nil {
+		rollback.Status = models.RollbackError
+		rollback.Error = err.Error()
+		h.DB.Model(&rollback).Updates(map[string]any{"status": rollback.Status, "error": rollback.Error})
+		h.DB.Model(&models.Infra3Resource{}).
+			Where("uuid = ? AND current_generation = ?", infra3ResourceUUID, generation).
+			Updates(map[string]any{"current_generation": infra3Resource.CurrentGeneration, "current_state": infra3Resource.CurrentState})
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, fmt.Sprintf("failed to apply the rollback: %s", err), []models.Rollback{rollback}))
+		return
+	}
+	rollback.Status = models.RolledBack
+	h.DB.Model(&rollback).Update("status", rollback.Status)
+
+	if h.RollbackCallbackURL != "" {
+		rollback.CallbackStatus = "sent"
+		if err := h.sendRollbackCallback(c, callback); err != nil {
+			rollback.CallbackStatus = "failed"
+			rollback.CallbackError = err.Error()
+		}
+		h.DB.Model(&rollback).Updates(map[string]any{"callback_status": rollback.CallbackStatus, "callback_error": rollback.CallbackError})
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, "", []models.Rollback{rollback}))
+}
+
+// applyRollback creates the task token of the rolled back generation and applies the Tf to the vcluster
+func (h APIHandler) applyRollback(ctx context.Context, tf infra3v1.Tf, rolledBackSpec models.Infra3ResourceSpec, clusterName, apiURL string) error {
+	if _, err := NewTaskToken(h.DB, rolledBackSpec, h.tenant, clusterName, apiURL, h.clientset); err != nil {
+		return err
+	}
+	return applyOnCreateOrUpdate(ctx, tf, h.clientset, h.tenant, h.fswatchImage)
+}
+
+// getRollbacks lists the rollbacks of a resource, newest first
+func (h APIHandler) getRollbacks(c *gin.Context) {
+	rollbacks := []models.Rollback{}
+	if result := h.DB.Where("infra3_resource_uuid = ?", c.Param("infra3_resource_uuid")).Order("created_at DESC").Find(&rollbacks); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", rollbacks))
+}
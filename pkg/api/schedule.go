@@ -0,0 +1,345 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+	"github.com/galleybytes/infrakube-stella/pkg/util"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// DefaultScheduleInterval is how often the scheduler looks for due schedules
+	DefaultScheduleInterval = 30 * time.Second
+
+	// scheduleLeaderLockKey is the postgres advisory lock held by the replica that runs the schedules
+	scheduleLeaderLockKey int64 = 0x69336c6561646572
+
+	scheduleKindRerun = "rerun"
+	scheduleKindDrift = "drift"
+)
+
+// leaderLock is a session level postgres advisory lock. The lock is held by a dedicated connection so
+// it is released by postgres when the replica holding it goes away.
+type leaderLock struct {
+	db   *gorm.DB
+	key  int64
+	conn *sql.Conn
+}
+
+// acquire reports if this replica is the leader, trying to take the lock when it isn't yet
+func (l *leaderLock) acquire(ctx context.Context) (bool, error) {
+	if l.conn != nil {
+		if err := l.conn.PingContext(ctx); err == nil {
+			return true, nil
+		}
+		// The session that held the lock is gone and so is the lock
+		l.release()
+	}
+
+	sqlDB, err := l.db.DB()
+	if err != nil {
+		return false, err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", l.key).Scan(&locked); err != nil {
+		conn.Close()
+		return false, err
+	}
+	if !locked {
+		conn.Close()
+		return false, nil
+	}
+	l.conn = conn
+	return true, nil
+}
+
+func (l *leaderLock) release() {
+	if l.conn == nil {
+		return
+	}
+	l.conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", l.key)
+	l.conn.Close()
+	l.conn = nil
+}
+
+// nextScheduleRun returns the next run of the cron expression after t in the timezone of the schedule.
+// When DST ends the same wall clock time happens twice; a run at the wall clock time of lastFired is
+// skipped so the schedule fires once.
+func nextScheduleRun(expr, timezone string, t time.Time, lastFired *time.Time) (*time.Time, error) {
+	cron, err := util.ParseCron(expr)
+	if err != nil {
+		return nil, err
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone '%s'", timezone)
+	}
+	next := cron.Next(t.In(location))
+	if lastFired != nil {
+		last := lastFired.In(location)
+		for !next.IsZero() && next.Format("200601021504") == last.Format("200601021504") {
+			next = cron.Next(next)
+		}
+	}
+	if next.IsZero() {
+		return nil, nil
+	}
+	next = next.UTC()
+	return &next, nil
+}
+
+// runSchedule reruns the workflow of the schedule's resource, or starts a drift check for drift schedules.
+// A workflow that is already running is not interrupted; the run is skipped and the reason is saved on
+// the schedule.
+func (h APIHandler) runSchedule(ctx context.Context, schedule models.Schedule, now time.Time) error {
+	nextRunAt, err := nextScheduleRun(schedule.Cron, schedule.Timezone, now, schedule.NextRunAt)
+	if err != nil {
+		return err
+	}
+	updates := map[string]any{
+		"next_run_at":   nextRunAt,
+		"last_run_at":   now,
+		"last_fired_at": schedule.NextRunAt,
+		"last_error":    "",
+	}
+
+	var infra3Resource models.Infra3Resource
+	if result := h.DB.First(&infra3Resource, "uuid = ?", schedule.Infra3ResourceUUID); result.Error != nil {
+		updates["last_error"] = result.Error.Error()
+	} else if infra3Resource.CurrentState == models.Running {
+		updates["last_error"] = "skipped, the workflow was running"
+	} else if schedule.Kind == scheduleKindDrift {
+		check, err := h.startDriftCheck(ctx, infra3Resource.UUID, fmt.Sprintf("schedule-%d", schedule.ID))
+		if err != nil {
+			updates["last_error"] = fmt.Sprintf("skipped drift check: %s", err)
+		} else {
+			updates["last_change_cause"] = check.ChangeCause
+		}
+	} else {
+		clusterName := getClusterName(infra3Resource.ClusterID, h.DB)
+		changeCause, err := rerun(h.clientset, clusterName, infra3Resource.Namespace, infra3Resource.Name, fmt.Sprintf("schedule-%d", schedule.ID), ctx)
+		if err != nil {
+			updates["last_error"] = fmt.Sprintf("failed to trigger rerun: %s", err)
+		} else {
+			updates["last_change_cause"] = changeCause
+		}
+	}
+
+	return h.DB.Model(&models.Schedule{}).Where("id = ?", schedule.ID).Updates(updates).Error
+}
+
+// RunSchedules reruns the workflows of due schedules until the context is canceled. Only the replica
+// holding the leader lock runs schedules.
+func (h APIHandler) RunSchedules(ctx context.Context) {
+	if h.DB == nil || h.ScheduleInterval <= 0 {
+		return
+	}
+	leader := &leaderLock{db: h.DB, key: scheduleLeaderLockKey}
+	defer leader.release()
+
+	ticker := time.NewTicker(h.ScheduleInterval)
+	defer ticker.Stop()
+	for {
+		isLeader, err := leader.acquire(ctx)
+		if err != nil {
+			log.Printf("ERROR acquiring the scheduler lock: %s", err)
+		}
+		if isLeader {
+			now := time.Now().UTC()
+			var schedules []models.Schedule
+			if result := h.DB.Where("enabled AND next_run_at <= ?", now).Find(&schedules); result.Error != nil {
+				log.Printf("ERROR selecting schedules: %s", result.Error)
+			}
+			for _, schedule := range schedules {
+				if err := h.runSchedule(ctx, schedule, now); err != nil {
+					log.Printf("ERROR running schedule %d of %s: %s", schedule.ID, schedule.Infra3ResourceUUID, err)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scheduleRequest is the body of create and update schedule requests
+type scheduleRequest struct {
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	Cron     string `json:"cron"`
+	Timezone string `json:"timezone"`
+	Enabled  *bool  `json:"enabled"`
+}
+
+// apply validates the request and sets it on the schedule
+func (r scheduleRequest) apply(schedule *models.Schedule) error {
+	if r.Timezone == "" {
+		r.Timezone = "UTC"
+	}
+	if r.Kind == "" {
+		r.Kind = scheduleKindRerun
+	}
+	if r.Kind != scheduleKindRerun && r.Kind != scheduleKindDrift {
+		return fmt.Errorf("unknown schedule kind '%s', use '%s' or '%s'", r.Kind, scheduleKindRerun, scheduleKindDrift)
+	}
+	nextRunAt, err := nextScheduleRun(r.Cron, r.Timezone, time.Now(), schedule.LastFiredAt)
+	if err != nil {
+		return err
+	}
+	schedule.Name = r.Name
+	schedule.Kind = r.Kind
+	schedule.Cron = r.Cron
+	schedule.Timezone = r.Timezone
+	schedule.Enabled = r.Enabled == nil || *r.Enabled
+	schedule.NextRunAt = nil
+	if schedule.Enabled {
+		schedule.NextRunAt = nextRunAt
+	}
+	return nil
+}
+
+// getSchedules lists the schedules of a resource
+func (h APIHandler) getSchedules(c *gin.Context) {
+	schedules := []models.Schedule{}
+	if result := h.DB.Where("infra3_resource_uuid = ?", c.Param("infra3_resource_uuid")).Order("id").Find(&schedules); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", schedules))
+}
+
+// addSchedule creates a schedule for a resource. Send {"cron": "0 3 * * 1", "timezone": "Europe/Berlin"}
+// and optionally "name" and "enabled". The timezone defaults to UTC.
+func (h APIHandler) addSchedule(c *gin.Context) {
+	infra3ResourceUUID := c.Param("infra3_resource_uuid")
+
+	var jsonData scheduleRequest
+	if err := c.BindJSON(&jsonData); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	var infra3Resource models.Infra3Resource
+	if result := h.DB.First(&infra3Resource, "uuid = ?", infra3ResourceUUID); result.Error != nil {
+		c.JSON(http.StatusNotFound, response(http.StatusNotFound, result.Error.Error(), []any{}))
+		return
+	}
+
+	schedule := models.Schedule{
+		Infra3ResourceUUID: infra3ResourceUUID,
+		CreatedBy:          username(c),
+		UpdatedBy:          username(c),
+	}
+	if err := jsonData.apply(&schedule); err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, err.Error(), []any{}))
+		return
+	}
+	if !h.driftScheduleAllowed(c, schedule) {
+		return
+	}
+	if result := h.DB.Create(&schedule); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusCreated, response(http.StatusCreated, "", []models.Schedule{schedule}))
+}
+
+// driftScheduleAllowed responds with an error when the schedule is a drift schedule of a resource that
+// doesn't hold the apply for approval
+func (h APIHandler) driftScheduleAllowed(c *gin.Context, schedule models.Schedule) bool {
+	if schedule.Kind != scheduleKindDrift {
+		return true
+	}
+	requireApproval, err := h.requiresApproval(schedule.Infra3ResourceUUID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, response(http.StatusNotFound, err.Error(), []any{}))
+		return false
+	}
+	if !requireApproval {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, "drift detection requires requireApproval so the apply does not run", []any{}))
+		return false
+	}
+	return true
+}
+
+// schedule finds the schedule in the url params and responds with an error when it does not exist
+func (h APIHandler) schedule(c *gin.Context) (*models.Schedule, bool) {
+	id, err := strconv.ParseUint(c.Param("schedule_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, fmt.Sprintf("schedule_id must be a number, got '%s'", c.Param("schedule_id")), []any{}))
+		return nil, false
+	}
+	var schedule models.Schedule
+	result := h.DB.Where("id = ? AND infra3_resource_uuid = ?", id, c.Param("infra3_resource_uuid")).First(&schedule)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, response(http.StatusNotFound, fmt.Sprintf("schedule %d not found", id), []any{}))
+		return nil, false
+	}
+	if result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return nil, false
+	}
+	return &schedule, true
+}
+
+func (h APIHandler) getSchedule(c *gin.Context) {
+	schedule, found := h.schedule(c)
+	if !found {
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", []models.Schedule{*schedule}))
+}
+
+// updateSchedule replaces the cron expression, timezone, name and enabled flag of a schedule. The next
+// run is calculated again.
+func (h APIHandler) updateSchedule(c *gin.Context) {
+	schedule, found := h.schedule(c)
+	if !found {
+		return
+	}
+	var jsonData scheduleRequest
+	if err := c.BindJSON(&jsonData); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	if err := jsonData.apply(schedule); err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, err.Error(), []any{}))
+		return
+	}
+	if !h.driftScheduleAllowed(c, *schedule) {
+		return
+	}
+	schedule.UpdatedBy = username(c)
+	if result := h.DB.Save(schedule); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", []models.Schedule{*schedule}))
+}
+
+func (h APIHandler) deleteSchedule(c *gin.Context) {
+	schedule, found := h.schedule(c)
+	if !found {
+		return
+	}
+	if result := h.DB.Unscoped().Delete(schedule); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+// TestNextScheduleRunDST checks that a schedule in the hour that repeats when DST ends fires once. In
+// Europe/Berlin 02:30 happens at 00:30 UTC and again at 01:30 UTC on 2026-10-25.
+func TestNextScheduleRunDST(t *testing.T) {
+	first := time.Date(2026, 10, 25, 0, 30, 0, 0, time.UTC)
+
+	next, err := nextScheduleRun("30 2 * * *", "Europe/Berlin", first.Add(10*time.Second), &first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2026, 10, 26, 1, 30, 0, 0, time.UTC); next == nil || !next.Equal(want) {
+		t.Errorf("next run after the first 02:30 is %v, want %v", next, want)
+	}
+
+	// Without a previous run both 02:30 are runs of the schedule
+	next, err = nextScheduleRun("30 2 * * *", "Europe/Berlin", first.Add(10*time.Second), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2026, 10, 25, 1, 30, 0, 0, time.UTC); next == nil || !next.Equal(want) {
+		t.Errorf("next run is %v, want %v", next, want)
+	}
+
+	// Schedules that don't run in the repeated hour are not affected
+	next, err = nextScheduleRun("0 * * * *", "Europe/Berlin", first, &first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2026, 10, 25, 1, 0, 0, 0, time.UTC); next == nil || !next.Equal(want) {
+		t.Errorf("next hourly run is %v, want %v", next, want)
+	}
+}
@@ -0,0 +1,316 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// DefaultStateQueryTimeout is used when APIHandler.StateQueryTimeout is not set
+const DefaultStateQueryTimeout = 2 * time.Minute
+
+const (
+	stateOutputBegin = "---I3-STATE-OUTPUT-BEGIN---"
+	stateOutputEnd   = "---I3-STATE-OUTPUT-END---"
+)
+
+// stateQueryScript initializes the main module and runs the terraform command in it. Stdout is written
+// between markers so it can be told apart from stderr in the pod log. The output of init is only shown when
+// init fails.
+func stateQueryScript(terraformCommand string) []string {
+	return []string{
+		"/bin/bash",
+		"-c",
+		`cd $I3_MAIN_MODULE && \
+		out=$(mktemp) && \
+		err=$(mktemp) && \
+		terraform init -input=false -no-color >$err 2>&1 && \
+		` + terraformCommand + ` >$out 2>$err
+		rc=$?
+		echo "` + stateOutputBegin + `"
+		cat $out
+		echo "` + stateOutputEnd + `"
+		cat $err
+		exit $rc`,
+	}
+}
+
+// stateQueryResult is the stdout and stderr of a state query pod
+type stateQueryResult struct {
+	Stdout string
+	Stderr string
+}
+
+// stateQuerySecurityContext runs state pods as the task runner user that owns the generation dirs. State
+// queries only read the module and the state, so unlike debug pods they don't need root.
+func stateQuerySecurityContext() *corev1.SecurityContext {
+	user := int64(2000)
+	group := int64(2000)
+	runAsNonRoot := true
+	privileged := false
+	allowPrivilegeEscalation := false
+	return &corev1.SecurityContext{
+		RunAsUser:                &user,
+		RunAsGroup:               &group,
+		RunAsNonRoot:             &runAsNonRoot,
+		Privileged:               &privileged,
+		AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+	}
+}
+
+// runStateQuery runs a read-only terraform command in a short-lived pod and returns its output once the
+// pod completes. The pod is always deleted, including when the timeout is reached.
+func (h APIHandler) runStateQuery(c *gin.Context, clusterName, namespace, name string, command []string) (*stateQueryResult, error) {
+	timeout := h.StateQueryTimeout
+	if timeout <= 0 {
+		timeout = DefaultStateQueryTimeout
+	}
+	ctx, cancel := context.WithTimeout(c, timeout)
+	defer cancel()
+
+	config, err := getVclusterConfig(h.clientset, "internal", clusterName)
+	if err != nil {
+		return nil, err
+	}
+	tf, err := getResource(h.clientset, clusterName, namespace, name, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("tf resource '%s/%s' not found", namespace, name)
+	}
+	pod := generatePod(tf, command)
+	pod.GenerateName = strings.TrimSuffix(pod.GenerateName, "debug-") + "state-"
+	pod.Labels["app.kubernetes.io/instance"] = "state"
+	for i := range pod.Spec.InitContainers {
+		pod.Spec.InitContainers[i].SecurityContext = stateQuerySecurityContext()
+	}
+	for i := range pod.Spec.Containers {
+		pod.Spec.Containers[i].SecurityContext = stateQuerySecurityContext()
+	}
+
+	clientset := kubernetes.NewForConfigOrDie(config)
+	podClient := clientset.CoreV1().Pods(namespace)
+	pod, err = podClient.Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer podClient.Delete(context.Background(), pod.Name, metav1.DeleteOptions{})
+
+	var phase corev1.PodPhase
+	for phase != corev1.PodSucceeded && phase != corev1.PodFailed {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("state query did not complete within %s", timeout)
+		case <-time.After(2 * time.Second):
+		}
+		current, err := podClient.Get(ctx, pod.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		phase = current.Status.Phase
+	}
+
+	b, err := podClient.GetLogs(pod.Name, &corev1.PodLogOptions{Container: pod.Spec.Containers[0].Name}).DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := parseStateQueryLog(string(b))
+	if phase == corev1.PodFailed {
+		stderr, _ := h.Redactor.Redact(result.Stderr, nil)
+		return nil, fmt.Errorf("terraform failed: %s", strings.TrimSpace(stderr))
+	}
+	return &result, nil
+}
+
+func parseStateQueryLog(podLog string) stateQueryResult {
+	_, afterBegin, found := strings.Cut(podLog, stateOutputBegin+"\n")
+	if !found {
+		return stateQueryResult{Stderr: podLog}
+	}
+	stdout, stderr, _ := strings.Cut(afterBegin, stateOutputEnd+"\n")
+	return stateQueryResult{Stdout: stdout, Stderr: stderr}
+}
+
+// maskSensitiveValues replaces the values marked in terraform's "sensitive_values" with the redaction
+// marker. A sensitive mark of true masks the whole value, maps and lists mark nested values.
+func maskSensitiveValues(value, sensitive any) any {
+	switch mark := sensitive.(type) {
+	case bool:
+		if mark {
+			return redactionMarker
+		}
+	case map[string]any:
+		if values, ok := value.(map[string]any); ok {
+			for key, nested := range mark {
+				if v, found := values[key]; found {
+					values[key] = maskSensitiveValues(v, nested)
+				}
+			}
+		}
+	case []any:
+		if values, ok := value.([]any); ok {
+			for i := range mark {
+				if i < len(values) {
+					values[i] = maskSensitiveValues(values[i], mark[i])
+				}
+			}
+		}
+	}
+	return value
+}
+
+// stateModule is the part of "terraform show -json" that holds resources
+type stateModule struct {
+	Address      string           `json:"address,omitempty"`
+	Resources    []map[string]any `json:"resources,omitempty"`
+	ChildModules []stateModule    `json:"child_modules,omitempty"`
+}
+
+type stateDocument struct {
+	FormatVersion    string `json:"format_version"`
+	TerraformVersion string `json:"terraform_version"`
+	Values           struct {
+		Outputs    map[string]map[string]any `json:"outputs,omitempty"`
+		RootModule stateModule               `json:"root_module"`
+	} `json:"values"`
+}
+
+// maskState masks sensitive resource attributes and outputs of the state
+func maskState(state *stateDocument) {
+	var walk func(module *stateModule)
+	walk = func(module *stateModule) {
+		for _, resource := range module.Resources {
+			resource["values"] = maskSensitiveValues(resource["values"], resource["sensitive_values"])
+		}
+		for i := range module.ChildModules {
+			walk(&module.ChildModules[i])
+		}
+	}
+	walk(&state.Values.RootModule)
+	for _, output := range state.Values.Outputs {
+		if sensitive, _ := output["sensitive"].(bool); sensitive {
+			output["value"] = redactionMarker
+		}
+	}
+}
+
+// stateResource finds a resource by address in the state
+func stateResource(module stateModule, address string) map[string]any {
+	for _, resource := range module.Resources {
+		if resource["address"] == address {
+			return resource
+		}
+	}
+	for _, child := range module.ChildModules {
+		if resource := stateResource(child, address); resource != nil {
+			return resource
+		}
+	}
+	return nil
+}
+
+// showState runs "terraform show -json" and returns the state with sensitive values masked unless the
+// caller has the privileged role. Known secret formats are always redacted.
+func (h APIHandler) showState(c *gin.Context) (*stateDocument, error) {
+	clusterName := c.Param("cluster_name")
+	namespace := c.Param("namespace")
+	name := c.Param("name")
+
+	result, err := h.runStateQuery(c, clusterName, namespace, name, stateQueryScript("terraform show -json -no-color"))
+	if err != nil {
+		return nil, err
+	}
+
+	var state stateDocument
+	stdout := strings.TrimSpace(result.Stdout)
+	if stdout == "" || stdout == "{}" {
+		return &state, nil
+	}
+	decoder := json.NewDecoder(bytes.NewBufferString(stdout))
+	decoder.UseNumber()
+	if err := decoder.Decode(&state); err != nil {
+		return nil, fmt.Errorf("could not read 'terraform show -json' output: %s", err)
+	}
+	if !h.hasRole(c, RolePrivileged) {
+		maskState(&state)
+	}
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	redacted, _ := h.Redactor.redactJSON(string(b))
+	var redactedState stateDocument
+	decoder = json.NewDecoder(bytes.NewBufferString(redacted))
+	decoder.UseNumber()
+	if err := decoder.Decode(&redactedState); err != nil {
+		return nil, err
+	}
+	return &redactedState, nil
+}
+
+// getStateList returns the addresses of the resources in the state
+func (h APIHandler) getStateList(c *gin.Context) {
+	if !h.requireRole(c, RoleStateReader, RolePrivileged) {
+		return
+	}
+	result, err := h.runStateQuery(c, c.Param("cluster_name"), c.Param("namespace"), c.Param("name"), stateQueryScript("terraform state list"))
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	addresses := []string{}
+	for _, line := range strings.Split(result.Stdout, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			addresses = append(addresses, line)
+		}
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", addresses))
+}
+
+// getStateResource returns a single resource of the state, the structured equivalent of
+// "terraform state show <address>". The address is passed in the "address" query param.
+func (h APIHandler) getStateResource(c *gin.Context) {
+	if !h.requireRole(c, RoleStateReader, RolePrivileged) {
+		return
+	}
+	address := c.Query("address")
+	if address == "" {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, "address is required", []any{}))
+		return
+	}
+	state, err := h.showState(c)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	resource := stateResource(state.Values.RootModule, address)
+	if resource == nil {
+		c.JSON(http.StatusNotFound, response(http.StatusNotFound, fmt.Sprintf("resource '%s' not found in state", address), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", []map[string]any{resource}))
+}
+
+// getStateJSON returns the whole state like "terraform show -json"
+func (h APIHandler) getStateJSON(c *gin.Context) {
+	if !h.requireRole(c, RoleStateReader, RolePrivileged) {
+		return
+	}
+	state, err := h.showState(c)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", []stateDocument{*state}))
+}
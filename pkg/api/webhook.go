@@ -0,0 +1,456 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// DefaultWebhookDeliveryInterval is how often pending webhook deliveries are retried
+	DefaultWebhookDeliveryInterval = 5 * time.Second
+
+	webhookTimeout = 10 * time.Second
+
+	// maxWebhookDeliveriesLimit limits the page size of the delivery log
+	maxWebhookDeliveriesLimit = 500
+
+	webhookDeliveryPending   = "pending"
+	webhookDeliveryDelivered = "delivered"
+	webhookDeliveryFailed    = "failed"
+)
+
+// signPayload returns the "X-Infra3-Signature-256" header value of the body
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookDeliveryStatuses are the statuses of webhook deliveries
+var webhookDeliveryStatuses = deliveryStatuses{
+	pending:   webhookDeliveryPending,
+	delivered: webhookDeliveryDelivered,
+	failed:    webhookDeliveryFailed,
+}
+
+// eventMatches reports if the event matches the event type, cluster and namespace patterns of a
+// subscription. No event type patterns match every event type.
+func eventMatches(eventTypes []string, cluster, namespace string, event models.Event) bool {
+	if matched, _ := path.Match(cluster, event.ClusterName); !matched {
+		return false
+	}
+	if matched, _ := path.Match(namespace, event.Namespace); !matched {
+		return false
+	}
+	if len(eventTypes) == 0 {
+		return true
+	}
+	for _, pattern := range eventTypes {
+		if matched, _ := path.Match(pattern, event.Type); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// validateEventPatterns checks the patterns of a subscription. Every event type pattern must match at
+// least one of the EventTypes.
+func validateEventPatterns(eventTypes []string, cluster, namespace string) error {
+	for _, pattern := range []string{cluster, namespace} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("pattern '%s' is invalid: %s", pattern, err)
+		}
+	}
+	for _, pattern := range eventTypes {
+		known := false
+		for _, eventType := range EventTypes {
+			matched, err := path.Match(pattern, eventType)
+			if err != nil {
+				return fmt.Errorf("pattern '%s' is invalid: %s", pattern, err)
+			}
+			known = known || matched
+		}
+		if !known {
+			return fmt.Errorf("event type '%s' does not match any of %s", pattern, strings.Join(EventTypes, ", "))
+		}
+	}
+	return nil
+}
+
+// enqueueWebhookDeliveries creates a delivery of the event for every enabled webhook subscribed to it and
+// makes the first attempt right away
+func (h APIHandler) enqueueWebhookDeliveries(event models.Event) {
+	var webhooks []models.Webhook
+	if result := h.DB.Where("enabled").Find(&webhooks); result.Error != nil {
+		log.Printf("ERROR listing webhooks for %s event: %s", event.Type, result.Error)
+		return
+	}
+	for _, webhook := range webhooks {
+		if !eventMatches(webhook.EventTypes, webhook.Cluster, webhook.Namespace, event) {
+			continue
+		}
+		delivery := models.WebhookDelivery{
+			WebhookID:     webhook.ID,
+			EventID:       event.ID,
+			EventType:     event.Type,
+			Status:        webhookDeliveryPending,
+			NextAttemptAt: time.Now(),
+		}
+		if result := h.DB.Create(&delivery); result.Error != nil {
+			log.Printf("ERROR queueing %s event for webhook '%s': %s", event.Type, webhook.Name, result.Error)
+			continue
+		}
+		go h.attemptWebhookDelivery(context.Background(), delivery.ID)
+	}
+}
+
+// postJSON posts the body to the endpoint and returns the status code and the start of the response body.
+// Responses other than 2xx are returned as errors.
+func postJSON(ctx context.Context, endpoint string, body []byte, header http.Header) (int, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	for key := range header {
+		req.Header.Set(key, header.Get(key))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "infra3-stella-webhook")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, string(b), fmt.Errorf("responded %s", resp.Status)
+	}
+	return resp.StatusCode, string(b), nil
+}
+
+// sendWebhook posts the event to the webhook url. The body is signed with the webhook secret in the
+// "X-Infra3-Signature-256" header when a secret is set.
+func sendWebhook(ctx context.Context, webhook models.Webhook, deliveryID uint, event models.Event) (int, string, error) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return 0, "", err
+	}
+	header := http.Header{}
+	header.Set("X-Infra3-Event", event.Type)
+	header.Set("X-Infra3-Delivery", strconv.FormatUint(uint64(deliveryID), 10))
+	if webhook.Secret != "" {
+		header.Set("X-Infra3-Signature-256", signPayload(webhook.Secret, b))
+	}
+	return postJSON(ctx, webhook.URL, b, header)
+}
+
+// webhookQueue sends webhook deliveries
+func (h APIHandler) webhookQueue() deliveryQueue {
+	return deliveryQueue{
+		name:     "webhook delivery",
+		model:    &models.WebhookDelivery{},
+		statuses: webhookDeliveryStatuses,
+		lease:    2 * webhookTimeout,
+		send:     h.sendWebhookDelivery,
+	}
+}
+
+// sendWebhookDelivery posts the event of the delivery to its webhook
+func (h APIHandler) sendWebhookDelivery(ctx context.Context, deliveryID uint) (int, map[string]any, error) {
+	var delivery models.WebhookDelivery
+	if result := h.DB.First(&delivery, deliveryID); result.Error != nil {
+		return 0, nil, result.Error
+	}
+	var webhook models.Webhook
+	var event models.Event
+	if result := h.DB.Unscoped().First(&webhook, delivery.WebhookID); result.Error != nil {
+		return delivery.Attempts, map[string]any{}, fmt.Errorf("%w: error reading webhook: %s", errUndeliverable, result.Error)
+	}
+	if webhook.DeletedAt.Valid {
+		return delivery.Attempts, map[string]any{}, fmt.Errorf("%w: webhook was deleted", errUndeliverable)
+	}
+	if result := h.DB.First(&event, delivery.EventID); result.Error != nil {
+		return delivery.Attempts, map[string]any{}, fmt.Errorf("%w: error reading event: %s", errUndeliverable, result.Error)
+	}
+	start := time.Now()
+	statusCode, body, err := sendWebhook(ctx, webhook, delivery.ID, event)
+	return delivery.Attempts, map[string]any{
+		"status_code":   statusCode,
+		"response_body": body,
+		"duration_ms":   time.Since(start).Milliseconds(),
+	}, err
+}
+
+// attemptWebhookDelivery sends the delivery when it is due and records the outcome
+func (h APIHandler) attemptWebhookDelivery(ctx context.Context, deliveryID uint) {
+	h.attemptDelivery(ctx, h.webhookQueue(), deliveryID)
+}
+
+// RunWebhookDeliveries retries pending webhook deliveries and notifications every WebhookDeliveryInterval
+// until the context is done. Notifications held back by quiet hours are sent by this loop too.
+func (h APIHandler) RunWebhookDeliveries(ctx context.Context) {
+	if h.DB == nil || h.WebhookDeliveryInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(h.WebhookDeliveryInterval)
+	defer ticker.Stop()
+	for {
+		h.runDeliveries(ctx, h.webhookQueue())
+		h.runDeliveries(ctx, h.notificationQueue())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// webhookRequest is the body of create and update webhook requests
+type webhookRequest struct {
+	Name       string   `json:"name"`
+	URL        string   `json:"url"`
+	Secret     *string  `json:"secret"`
+	EventTypes []string `json:"event_types"`
+	Cluster    string   `json:"cluster"`
+	Namespace  string   `json:"namespace"`
+	Enabled    *bool    `json:"enabled"`
+}
+
+// apply validates the request and sets it on the webhook. Empty patterns match everything, the secret is
+// kept when it is not sent and webhooks are enabled unless "enabled" is false.
+func (r webhookRequest) apply(webhook *models.Webhook) error {
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	u, err := url.Parse(r.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an http or https url, got '%s'", r.URL)
+	}
+	if r.Cluster == "" {
+		r.Cluster = "*"
+	}
+	if r.Namespace == "" {
+		r.Namespace = "*"
+	}
+	if err := validateEventPatterns(r.EventTypes, r.Cluster, r.Namespace); err != nil {
+		return err
+	}
+	webhook.Name = r.Name
+	webhook.URL = r.URL
+	if r.Secret != nil {
+		webhook.Secret = *r.Secret
+	}
+	webhook.EventTypes = r.EventTypes
+	webhook.Cluster = r.Cluster
+	webhook.Namespace = r.Namespace
+	webhook.Enabled = r.Enabled == nil || *r.Enabled
+	return nil
+}
+
+func (h APIHandler) getWebhooks(c *gin.Context) {
+	webhooks := []models.Webhook{}
+	if result := h.DB.Order("id").Find(&webhooks); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", webhooks))
+}
+
+// addWebhook creates a webhook, eg {"name": "chatops", "url": "https://hooks.example.com/infra3",
+// "secret": "s3cr3t", "event_types": ["approval.*", "workflow.failed"], "cluster": "prod-*"}. Only
+// privileged users can manage webhooks.
+func (h APIHandler) addWebhook(c *gin.Context) {
+	if !h.requireRole(c, RolePrivileged) {
+		return
+	}
+	var jsonData webhookRequest
+	if err := c.BindJSON(&jsonData); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	webhook := models.Webhook{CreatedBy: username(c), UpdatedBy: username(c)}
+	if err := jsonData.apply(&webhook); err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, err.Error(), []any{}))
+		return
+	}
+	if result := h.DB.Create(&webhook); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusCreated, response(http.StatusCreated, "", []models.Webhook{webhook}))
+}
+
+// webhookFromParam finds the webhook in the url params and responds with an error when it does not exist
+func (h APIHandler) webhookFromParam(c *gin.Context) (*models.Webhook, bool) {
+	id, err := strconv.ParseUint(c.Param("webhook_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, fmt.Sprintf("webhook_id must be a number, got '%s'", c.Param("webhook_id")), []any{}))
+		return nil, false
+	}
+	var webhook models.Webhook
+	if result := h.DB.First(&webhook, id); result.Error != nil {
+		c.JSON(http.StatusNotFound, response(http.StatusNotFound, fmt.Sprintf("webhook %d not found", id), []any{}))
+		return nil, false
+	}
+	return &webhook, true
+}
+
+func (h APIHandler) updateWebhook(c *gin.Context) {
+	if !h.requireRole(c, RolePrivileged) {
+		return
+	}
+	webhook, found := h.webhookFromParam(c)
+	if !found {
+		return
+	}
+	var jsonData webhookRequest
+	if err := c.BindJSON(&jsonData); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, err.Error(), []any{}))
+		return
+	}
+	if err := jsonData.apply(webhook); err != nil {
+		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, err.Error(), []any{}))
+		return
+	}
+	webhook.UpdatedBy = username(c)
+	if result := h.DB.Save(webhook); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", []models.Webhook{*webhook}))
+}
+
+func (h APIHandler) deleteWebhook(c *gin.Context) {
+	if !h.requireRole(c, RolePrivileged) {
+		return
+	}
+	webhook, found := h.webhookFromParam(c)
+	if !found {
+		return
+	}
+	if result := h.DB.Delete(webhook); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// getWebhookDeliveries lists the newest deliveries of the webhook. Filter with "status" and "event_type"
+// and page with "offset" and "limit".
+func (h APIHandler) getWebhookDeliveries(c *gin.Context) {
+	webhook, found := h.webhookFromParam(c)
+	if !found {
+		return
+	}
+	offset, _ := strconv.Atoi(c.Query("offset"))
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 {
+		limit = 50
+	}
+	limit = min(limit, maxWebhookDeliveriesLimit)
+	offset = max(offset, 0)
+	query := h.DB.Where("webhook_id = ?", webhook.ID)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if eventType := c.Query("event_type"); eventType != "" {
+		query = query.Where("event_type = ?", eventType)
+	}
+	deliveries := []models.WebhookDelivery{}
+	if result := query.Order("id DESC").Offset(offset).Limit(limit).Find(&deliveries); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	c.JSON(http.StatusOK, response(http.StatusOK, "", deliveries))
+}
+
+// redeliverWebhookDelivery sends the event of a delivery again as a new delivery
+func (h APIHandler) redeliverWebhookDelivery(c *gin.Context) {
+	if !h.requireRole(c, RolePrivileged) {
+		return
+	}
+	webhook, found := h.webhookFromParam(c)
+	if !found {
+		return
+	}
+	var delivery models.WebhookDelivery
+	if result := h.DB.First(&delivery, "id = ? AND webhook_id = ?", c.Param("delivery_id"), webhook.ID); result.Error != nil {
+		status := http.StatusUnprocessableEntity
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, response(int64(status), fmt.Sprintf("delivery %s of webhook %d: %s", c.Param("delivery_id"), webhook.ID, result.Error), []any{}))
+		return
+	}
+	redelivery := models.WebhookDelivery{
+		WebhookID:     webhook.ID,
+		EventID:       delivery.EventID,
+		EventType:     delivery.EventType,
+		Status:        webhookDeliveryPending,
+		NextAttemptAt: time.Now(),
+		RedeliveryOf:  &delivery.ID,
+	}
+	if result := h.DB.Create(&redelivery); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	go h.attemptWebhookDelivery(context.Background(), redelivery.ID)
+	c.JSON(http.StatusAccepted, response(http.StatusAccepted, "", []models.WebhookDelivery{redelivery}))
+}
+
+// testWebhook sends a ping event to the webhook and responds with the delivery once it was attempted.
+// Failed pings are not retried.
+func (h APIHandler) testWebhook(c *gin.Context) {
+	if !h.requireRole(c, RolePrivileged) {
+		return
+	}
+	webhook, found := h.webhookFromParam(c)
+	if !found {
+		return
+	}
+	event := models.Event{
+		Type: EventPing,
+		Data: map[string]any{"webhook_id": webhook.ID, "sent_by": username(c)},
+	}
+	if result := h.DB.Create(&event); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	delivery := models.WebhookDelivery{
+		WebhookID:     webhook.ID,
+		EventID:       event.ID,
+		EventType:     event.Type,
+		Status:        webhookDeliveryPending,
+		NextAttemptAt: time.Now(),
+	}
+	if result := h.DB.Create(&delivery); result.Error != nil {
+		c.JSON(http.StatusUnprocessableEntity, response(http.StatusUnprocessableEntity, result.Error.Error(), []any{}))
+		return
+	}
+	h.attemptWebhookDelivery(c, delivery.ID)
+	h.DB.Model(&models.WebhookDelivery{}).Where("id = ? AND status = ?", delivery.ID, webhookDeliveryPending).Update("status", webhookDeliveryFailed)
+	h.DB.First(&delivery, delivery.ID)
+	c.JSON(http.StatusOK, response(http.StatusOK, delivery.Error, []models.WebhookDelivery{delivery}))
+}
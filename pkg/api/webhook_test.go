@@ -0,0 +1,160 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+)
+
+// webhookReceiver is a webhook endpoint that fails the first failures requests and records what it got
+type webhookReceiver struct {
+	mu       sync.Mutex
+	failures int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, _ := io.ReadAll(req.Body)
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, b)
+	if len(r.requests) <= r.failures {
+		http.Error(w, "try again later", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// TestSendWebhookSignature checks that the receiver can verify the body with the webhook secret
+func TestSendWebhookSignature(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	event := models.Event{Type: EventWorkflowFailed, Namespace: "default", Name: "vpc", Generation: "3"}
+	webhook := models.Webhook{URL: server.URL, Secret: "s3cr3t"}
+	statusCode, body, err := sendWebhook(context.Background(), webhook, 42, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statusCode != http.StatusOK || body != "ok" {
+		t.Errorf("response is %d %q, want 200 \"ok\"", statusCode, body)
+	}
+
+	req, b := receiver.requests[0], receiver.bodies[0]
+	mac := hmac.New(sha256.New, []byte("s3cr3t"))
+	mac.Write(b)
+	if got, want := req.Header.Get("X-Infra3-Signature-256"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("signature is %q, want %q", got, want)
+	}
+	if got := req.Header.Get("X-Infra3-Event"); got != EventWorkflowFailed {
+		t.Errorf("event header is %q, want %q", got, EventWorkflowFailed)
+	}
+	if got := req.Header.Get("X-Infra3-Delivery"); got != "42" {
+		t.Errorf("delivery header is %q, want \"42\"", got)
+	}
+	var sent models.Event
+	if err := json.Unmarshal(b, &sent); err != nil || sent.Name != "vpc" {
+		t.Errorf("body is %s, want the event", b)
+	}
+
+	// Webhooks without a secret are not signed
+	if _, _, err := sendWebhook(context.Background(), models.Webhook{URL: server.URL}, 43, event); err != nil {
+		t.Fatal(err)
+	}
+	if got := receiver.requests[1].Header.Get("X-Infra3-Signature-256"); got != "" {
+		t.Errorf("unsigned webhook sent signature %q", got)
+	}
+}
+
+// TestWebhookDeliveryRetry attempts a delivery like attemptDelivery until it is decided and checks
+// the backoff between the attempts
+func TestWebhookDeliveryRetry(t *testing.T) {
+	receiver := &webhookReceiver{failures: 3}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	webhook := models.Webhook{URL: server.URL}
+	event := models.Event{Type: EventApprovalRequired}
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	status := webhookDeliveryPending
+	var backoffs []time.Duration
+	attempts := 0
+	for status == webhookDeliveryPending {
+		attempts++
+		statusCode, _, err := sendWebhook(context.Background(), webhook, 1, event)
+		if attempts <= receiver.failures && (err == nil || statusCode != http.StatusServiceUnavailable) {
+			t.Fatalf("attempt %d responded %d %v, want a 503 error", attempts, statusCode, err)
+		}
+		var nextAttemptAt time.Time
+		status, nextAttemptAt = webhookDeliveryStatuses.outcome(attempts, err, now)
+		if status == webhookDeliveryPending {
+			backoffs = append(backoffs, nextAttemptAt.Sub(now))
+			now = nextAttemptAt
+		}
+	}
+	if status != webhookDeliveryDelivered || attempts != 4 {
+		t.Errorf("delivery is %s after %d attempts, want delivered after 4", status, attempts)
+	}
+	want := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second}
+	if len(backoffs) != len(want) {
+		t.Fatalf("backoffs are %v, want %v", backoffs, want)
+	}
+	for i := range want {
+		if backoffs[i] != want[i] {
+			t.Errorf("backoffs are %v, want %v", backoffs, want)
+			break
+		}
+	}
+
+	// A webhook that keeps failing gives up after deliveryMaxAttempts
+	receiver = &webhookReceiver{failures: deliveryMaxAttempts + 1}
+	failing := httptest.NewServer(receiver)
+	defer failing.Close()
+	status, attempts = webhookDeliveryPending, 0
+	for status == webhookDeliveryPending {
+		attempts++
+		_, _, err := sendWebhook(context.Background(), models.Webhook{URL: failing.URL}, 2, event)
+		status, _ = webhookDeliveryStatuses.outcome(attempts, err, now)
+	}
+	if status != webhookDeliveryFailed || attempts != deliveryMaxAttempts {
+		t.Errorf("delivery is %s after %d attempts, want failed after %d", status, attempts, deliveryMaxAttempts)
+	}
+	if len(receiver.requests) != deliveryMaxAttempts {
+		t.Errorf("receiver got %d requests, want %d", len(receiver.requests), deliveryMaxAttempts)
+	}
+
+	// Deliveries that can't be sent are not retried
+	if status, _ := webhookDeliveryStatuses.outcome(1, fmt.Errorf("%w: webhook was deleted", errUndeliverable), now); status != webhookDeliveryFailed {
+		t.Errorf("undeliverable delivery is %s, want failed", status)
+	}
+}
+
+// TestDeliveryRetryAfter checks that the backoff doubles up to deliveryMaxRetryBackoff
+func TestDeliveryRetryAfter(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  10 * time.Second,
+		2:  20 * time.Second,
+		5:  160 * time.Second,
+		9:  2560 * time.Second,
+		10: time.Hour,
+		50: time.Hour,
+	} {
+		if got := deliveryRetryAfter(attempts); got != want {
+			t.Errorf("deliveryRetryAfter(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
@@ -22,11 +22,56 @@ func Init(url string) *gorm.DB {
 		&models.Approval{},
 		&models.TaskPod{},
 		&models.RefreshToken{},
+		&models.RetentionRun{},
+		&models.RedactionAudit{},
+		&models.LogObject{},
+		&models.PlanSummary{},
+		&models.TaskArtifact{},
+		&models.Cancellation{},
+		&models.DriftCheck{},
+		&models.Schedule{},
+		&models.BulkJob{},
+		&models.BulkJobItem{},
+		&models.Rollback{},
+		&models.ApprovalPolicy{},
+		&models.ApprovalVote{},
+		&models.AutoApprovalRule{},
+		&models.ApprovalLink{},
+		&models.Event{},
+		&models.Webhook{},
+		&models.WebhookDelivery{},
+		&models.NotificationChannel{},
+		&models.Notification{},
+		&models.Subscription{},
+		&models.FeedReadMarker{},
 	)
 
 	if err != nil {
 		log.Panic(err)
 	}
 
+	// A revoked vote frees the approver to vote again, which the unique index on every vote of an approver
+	// replaced by idx_approval_votes_active_approver prevents
+	if db.Migrator().HasIndex(&models.ApprovalVote{}, "idx_approval_votes_approver") {
+		if err := db.Migrator().DropIndex(&models.ApprovalVote{}, "idx_approval_votes_approver"); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	// Specs stored before the origin generation was recorded were sent by the origin, except the ones
+	// created by a rollback
+	err = db.Exec(`
+		UPDATE infra3_resource_specs SET origin_generation = generation
+		WHERE (origin_generation IS NULL OR origin_generation = '')
+			AND NOT EXISTS (
+				SELECT 1 FROM rollbacks
+				WHERE rollbacks.infra3_resource_uuid = infra3_resource_specs.infra3_resource_uuid
+					AND rollbacks.generation = infra3_resource_specs.generation
+			)
+	`).Error
+	if err != nil {
+		log.Panic(err)
+	}
+
 	return db
 }
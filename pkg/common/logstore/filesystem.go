@@ -0,0 +1,74 @@
+package logstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Filesystem stores logs as files under Dir. The directory is expected to be a persistent volume that
+// is shared by every replica of the API.
+type Filesystem struct {
+	Dir string
+}
+
+func (f *Filesystem) Name() string {
+	return "filesystem"
+}
+
+func (f *Filesystem) path(key string) (string, error) {
+	p := filepath.FromSlash(key)
+	if !filepath.IsLocal(p) {
+		return "", fmt.Errorf("invalid log store key '%s'", key)
+	}
+	return filepath.Join(f.Dir, p), nil
+}
+
+// Write saves to a temporary file first so readers never see a partially written log
+func (f *Filesystem) Write(ctx context.Context, key string, data []byte) error {
+	filename, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+func (f *Filesystem) Read(ctx context.Context, key string) ([]byte, error) {
+	filename, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return b, err
+}
+
+func (f *Filesystem) Delete(ctx context.Context, key string) error {
+	filename, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filename); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
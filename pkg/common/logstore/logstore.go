@@ -0,0 +1,62 @@
+// Package logstore saves task logs that are too large to keep in the infra3_task_logs table. The
+// metadata of a log always stays in postgres, only the content is offloaded to a LogStore.
+package logstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// ErrNotFound is returned by Read when nothing is stored under the key
+var ErrNotFound = errors.New("log not found in log store")
+
+// LogStore reads and writes log content by key. Keys are slash separated paths, eg
+// "<resource-uuid>/<generation>/<task-pod-uuid>.log". Write replaces any content already stored under
+// the key.
+type LogStore interface {
+	// Name is saved alongside the key of offloaded logs to know which store to read them from
+	Name() string
+	Write(ctx context.Context, key string, data []byte) error
+	Read(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Config selects and configures the LogStore returned by New
+type Config struct {
+	// Kind is one of "postgres", "filesystem" or "s3"
+	Kind string
+
+	// Dir is the root directory of the "filesystem" store
+	Dir string
+
+	S3 S3
+}
+
+func New(db *gorm.DB, config Config) (LogStore, error) {
+	switch config.Kind {
+	case "", "postgres":
+		if db == nil {
+			return nil, fmt.Errorf("the postgres log store requires a database")
+		}
+		return &Postgres{DB: db}, nil
+	case "filesystem":
+		if config.Dir == "" {
+			return nil, fmt.Errorf("the filesystem log store requires a directory")
+		}
+		return &Filesystem{Dir: config.Dir}, nil
+	case "s3":
+		s3 := config.S3
+		if s3.Endpoint == "" || s3.Bucket == "" {
+			return nil, fmt.Errorf("the s3 log store requires an endpoint and a bucket")
+		}
+		if s3.Region == "" {
+			s3.Region = "us-east-1"
+		}
+		return &s3, nil
+	default:
+		return nil, fmt.Errorf("unknown log store '%s', use 'postgres', 'filesystem' or 's3'", config.Kind)
+	}
+}
@@ -0,0 +1,51 @@
+package logstore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/galleybytes/infrakube-stella/pkg/common/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Postgres stores logs in the log_objects table. Unlike the message column of infra3_task_logs, the
+// content is saved as bytea and has no size limit.
+type Postgres struct {
+	DB *gorm.DB
+}
+
+func (p *Postgres) Name() string {
+	return "postgres"
+}
+
+func (p *Postgres) Write(ctx context.Context, key string, data []byte) error {
+	now := time.Now().UTC()
+	object := models.LogObject{
+		Key:       key,
+		Data:      data,
+		Size:      uint64(len(data)),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	return p.DB.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"data", "size", "updated_at"}),
+	}).Create(&object).Error
+}
+
+func (p *Postgres) Read(ctx context.Context, key string) ([]byte, error) {
+	var object models.LogObject
+	if result := p.DB.WithContext(ctx).First(&object, "key = ?", key); result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, result.Error
+	}
+	return object.Data, nil
+}
+
+func (p *Postgres) Delete(ctx context.Context, key string) error {
+	return p.DB.WithContext(ctx).Where("key = ?", key).Delete(&models.LogObject{}).Error
+}
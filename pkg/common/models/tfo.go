@@ -12,6 +12,25 @@ type Infra3TaskLog struct {
 	TaskPodUUID string  `json:"task_pod_uuid"`
 	Message     string  `json:"message" gorm:"type:varchar(1048576)"`
 	Size        uint64  `json:"size"`
+
+	// Store and StoreKey are set when the message was offloaded to a log store. The log is offloaded in
+	// StoreChunks chunks and Message holds the content written after the last chunk.
+	Store       string `json:"store,omitempty"`
+	StoreKey    string `json:"store_key,omitempty"`
+	StoreChunks int    `json:"store_chunks,omitempty"`
+
+	// Pending is the redacted trailing line that was sent but not saved to Message yet because it may be
+	// the start of a secret. It is saved once the line ends or the task is done.
+	Pending string `json:"-"`
+}
+
+// LogObject is the content of a task log offloaded to the postgres log store
+type LogObject struct {
+	Key       string    `json:"key" gorm:"primaryKey"`
+	Data      []byte    `json:"-"`
+	Size      uint64    `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
 type Infra3Resource struct {
@@ -46,6 +65,14 @@ type Infra3ResourceSpec struct {
 	TaskToken          string         `json:"task_token"`
 	Annotations        string         `json:"annotations"`
 	Labels             string         `json:"labels"`
+
+	// OriginGeneration is the generation of the origin resource the spec was sent with. It is empty for
+	// specs created by a rollback, which is why it can differ from Generation.
+	OriginGeneration string `json:"origin_generation" gorm:"index"`
+
+	// Author is the user that changed the spec, as named by the origin cluster, or who requested the
+	// rollback. It is empty when the origin doesn't name the user.
+	Author string `json:"author"`
 }
 
 type TaskPod struct {
@@ -69,8 +96,379 @@ type Approval struct {
 	IsApproved  bool    `json:"is_approved"`
 	TaskPod     TaskPod `json:"task_pod,omitempty"`
 	TaskPodUUID string  `json:"task_pod_uuid"`
+
+	// Approver, Comment and TicketURL are copied from the vote that decided the approval
+	Approver  string `json:"approver"`
+	Comment   string `json:"comment"`
+	TicketURL string `json:"ticket_url"`
+
+	// ExpiresAt is when the plan becomes too old for the approval to be used. An approval is invalidated
+	// when it expires or when a newer plan replaces the one it approved.
+	ExpiresAt         *time.Time `json:"expires_at"`
+	InvalidatedAt     *time.Time `json:"invalidated_at"`
+	InvalidatedReason string     `json:"invalidated_reason"`
+
+	// AutoApprovalRuleID is the rule that approved the plan without a human approver
+	AutoApprovalRuleID *uint `json:"auto_approval_rule_id"`
+}
+
+// ApprovalPolicy requires several approvers for plans of resources in matching clusters and namespaces.
+// Cluster and Namespace are glob patterns. Approvers must have the Group role when it is set.
+type ApprovalPolicy struct {
+	gorm.Model
+	Cluster           string `json:"cluster"`
+	Namespace         string `json:"namespace"`
+	Required          int    `json:"required"`
+	Group             string `json:"group"`
+	AllowSelfApproval bool   `json:"allow_self_approval"`
+	CreatedBy         string `json:"created_by"`
+
+	// TTL is how long after the plan was created it can be approved and applied, eg "24h". Empty uses the
+	// global approval TTL.
+	TTL string `json:"ttl"`
+}
+
+// ApprovalVote is the approve or deny of a single approver. The Approval of the plan is saved once the
+// votes satisfy the approval policy. A revoked vote is kept as history and the approver may vote again.
+type ApprovalVote struct {
+	gorm.Model
+	TaskPod          TaskPod    `json:"-"`
+	TaskPodUUID      string     `json:"task_pod_uuid" gorm:"index:idx_approval_votes_active_approver,unique,where:revoked_at IS NULL"`
+	Approver         string     `json:"approver" gorm:"index:idx_approval_votes_active_approver,unique,where:revoked_at IS NULL"`
+	IsApproved       bool       `json:"is_approved"`
+	Comment          string     `json:"comment"`
+	TicketURL        string     `json:"ticket_url"`
+	ApprovalPolicyID uint       `json:"approval_policy_id"`
+	RevokedAt        *time.Time `json:"revoked_at"`
+	RevokedBy        string     `json:"revoked_by"`
+
+	// MintedBy is who minted the approval link the vote was cast with
+	MintedBy string `json:"minted_by"`
+}
+
+// ApprovalLink is a signed single-use link that lets the approver approve or deny a plan without logging
+// in. The row records who minted the link and how it was used.
+type ApprovalLink struct {
+	ID          string     `json:"id" gorm:"primaryKey"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	TaskPod     TaskPod    `json:"-"`
+	TaskPodUUID string     `json:"task_pod_uuid" gorm:"index"`
+	Approver    string     `json:"approver"`
+	CreatedBy   string     `json:"created_by"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	UsedAt      *time.Time `json:"used_at"`
+	UsedAction  string     `json:"used_action"`
+	UsedFrom    string     `json:"used_from"`
+	Result      string     `json:"result"`
+}
+
+// AutoApprovalRule approves plans of resources in matching clusters and namespaces when the plan summary
+// satisfies every condition of the rule. Cluster and Namespace are glob patterns and ResourceTypes is an
+// allowlist of glob patterns, eg "aws_s3_bucket*". A nil MaxChanges does not limit the number of changes.
+type AutoApprovalRule struct {
+	gorm.Model
+	Name          string   `json:"name" gorm:"uniqueIndex"`
+	Enabled       bool     `json:"enabled"`
+	Cluster       string   `json:"cluster"`
+	Namespace     string   `json:"namespace"`
+	NoDestroy     bool     `json:"no_destroy"`
+	MaxChanges    *int     `json:"max_changes"`
+	ResourceTypes []string `json:"resource_types" gorm:"serializer:json"`
+	CreatedBy     string   `json:"created_by"`
+	UpdatedBy     string   `json:"updated_by"`
 }
 
+// Event is something that happened to a resource or its workflow, eg "approval.required". Events are
+// delivered to the webhooks subscribed to them. Events with a DedupKey are only recorded once.
+type Event struct {
+	ID                 uint           `json:"id" gorm:"primaryKey"`
+	CreatedAt          time.Time      `json:"created_at" gorm:"index"`
+	Type               string         `json:"type" gorm:"index"`
+	Infra3ResourceUUID string         `json:"infra3_resource_uuid" gorm:"index"`
+	ClusterName        string         `json:"cluster_name"`
+	Namespace          string         `json:"namespace"`
+	Name               string         `json:"name"`
+	Generation         string         `json:"generation"`
+	TaskPodUUID        string         `json:"task_pod_uuid"`
+	Data               map[string]any `json:"data" gorm:"serializer:json"`
+	DedupKey           string         `json:"-" gorm:"index:idx_events_dedup_key,unique,where:dedup_key <> ''"`
+}
+
+// Webhook subscribes a url to events. EventTypes, Cluster and Namespace are glob patterns and an empty
+// EventTypes subscribes to every event. Deliveries are signed with the Secret when it is set.
+type Webhook struct {
+	gorm.Model
+	Name       string   `json:"name"`
+	URL        string   `json:"url"`
+	Secret     string   `json:"-"`
+	EventTypes []string `json:"event_types" gorm:"serializer:json"`
+	Cluster    string   `json:"cluster"`
+	Namespace  string   `json:"namespace"`
+	Enabled    bool     `json:"enabled"`
+	CreatedBy  string   `json:"created_by"`
+	UpdatedBy  string   `json:"updated_by"`
+}
+
+// WebhookDelivery is the log of sending an event to a webhook. Pending deliveries are retried at
+// NextAttemptAt until they succeed or run out of attempts. RedeliveryOf is the delivery that was resent.
+type WebhookDelivery struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	CreatedAt     time.Time  `json:"created_at" gorm:"index"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	WebhookID     uint       `json:"webhook_id" gorm:"index"`
+	EventID       uint       `json:"event_id" gorm:"index"`
+	EventType     string     `json:"event_type"`
+	Status        string     `json:"status" gorm:"index"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at" gorm:"index"`
+	LastAttemptAt *time.Time `json:"last_attempt_at"`
+	StatusCode    int        `json:"status_code"`
+	Error         string     `json:"error"`
+	ResponseBody  string     `json:"response_body"`
+	DurationMS    int64      `json:"duration_ms"`
+	DeliveredAt   *time.Time `json:"delivered_at"`
+	RedeliveryOf  *uint      `json:"redelivery_of"`
+}
+
+// NotificationChannel posts readable messages about events to a chat, eg a Slack or Teams incoming
+// webhook, or emails them to the Recipients and the addresses in the notify annotation of the resource.
+// EventTypes, Cluster and Namespace are glob patterns that route the events of a team to its channel.
+// Messages are held back between QuietHoursStart and QuietHoursEnd ("22:00") in the Timezone and repeated
+// failures of a generation are suppressed for the DedupWindow.
+type NotificationChannel struct {
+	gorm.Model
+	Name            string   `json:"name" gorm:"uniqueIndex"`
+	Kind            string   `json:"kind"`
+	URL             string   `json:"-"`
+	Recipients      []string `json:"recipients" gorm:"serializer:json"`
+	EventTypes      []string `json:"event_types" gorm:"serializer:json"`
+	Cluster         string   `json:"cluster"`
+	Namespace       string   `json:"namespace"`
+	QuietHoursStart string   `json:"quiet_hours_start"`
+	QuietHoursEnd   string   `json:"quiet_hours_end"`
+	Timezone        string   `json:"timezone"`
+	DedupWindow     string   `json:"dedup_window"`
+	Enabled         bool     `json:"enabled"`
+	CreatedBy       string   `json:"created_by"`
+	UpdatedBy       string   `json:"updated_by"`
+
+	// Approver gets approve and deny links in the approval messages of the channel. The channel must only
+	// reach the approver, eg a direct message webhook or the approver's email address.
+	Approver string `json:"approver"`
+}
+
+// Notification is the log of posting an event to a notification channel. Recipients are the addresses an
+// email was sent to. A notification suppressed as a repeat points to the notification it repeats in
+// DuplicateOf.
+type Notification struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	CreatedAt     time.Time  `json:"created_at" gorm:"index"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	ChannelID     uint       `json:"channel_id" gorm:"index"`
+	EventID       uint       `json:"event_id" gorm:"index"`
+	EventType     string     `json:"event_type"`
+	DedupKey      string     `json:"dedup_key" gorm:"index"`
+	Recipients    []string   `json:"recipients" gorm:"serializer:json"`
+	Status        string     `json:"status" gorm:"index"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at" gorm:"index"`
+	LastAttemptAt *time.Time `json:"last_attempt_at"`
+	StatusCode    int        `json:"status_code"`
+	Error         string     `json:"error"`
+	DeliveredAt   *time.Time `json:"delivered_at"`
+	DuplicateOf   *uint      `json:"duplicate_of"`
+}
+
+// Subscription adds the events of a resource, or of the resources matching the Cluster, Namespace and Name
+// glob patterns, to the feed of the user. An empty EventTypes subscribes to every event type.
+type Subscription struct {
+	gorm.Model
+	Username           string   `json:"username" gorm:"index"`
+	Infra3ResourceUUID string   `json:"infra3_resource_uuid"`
+	Cluster            string   `json:"cluster"`
+	Namespace          string   `json:"namespace"`
+	Name               string   `json:"name"`
+	EventTypes         []string `json:"event_types" gorm:"serializer:json"`
+}
+
+// FeedReadMarker is the newest event of the feed the user has read. Newer events are unread.
+type FeedReadMarker struct {
+	Username        string    `json:"username" gorm:"primaryKey"`
+	LastReadEventID uint      `json:"last_read_event_id"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// PlanSummary is the structured result of a plan task. Add, Change and Destroy are counted the way
+// terraform counts them in "Plan: X to add, Y to change, Z to destroy", so a replaced resource is counted
+// as both an add and a destroy.
+type PlanSummary struct {
+	gorm.Model
+	TaskPod            TaskPod  `json:"-"`
+	TaskPodUUID        string   `json:"task_pod_uuid" gorm:"uniqueIndex"`
+	Infra3ResourceUUID string   `json:"infra3_resource_uuid" gorm:"index"`
+	Generation         string   `json:"generation"`
+	Source             string   `json:"source"`
+	Add                int      `json:"add"`
+	Change             int      `json:"change"`
+	Replace            int      `json:"replace"`
+	Destroy            int      `json:"destroy"`
+	HasDestroy         bool     `json:"has_destroy"`
+	NoChanges          bool     `json:"no_changes"`
+	ToAdd              []string `json:"to_add" gorm:"serializer:json"`
+	ToChange           []string `json:"to_change" gorm:"serializer:json"`
+	ToReplace          []string `json:"to_replace" gorm:"serializer:json"`
+	ToDestroy          []string `json:"to_destroy" gorm:"serializer:json"`
+
+	// LogSize is the size of the plan log when the summary was parsed from it. FromTotals is set once the
+	// counts were read from the totals line of the log rather than counted from the resource headers.
+	LogSize    uint64 `json:"-"`
+	FromTotals bool   `json:"-"`
+}
+
+// TaskArtifact is a file uploaded by a task pod, eg the saved plan file or the lock file. The content
+// is kept in the log store and never changes once uploaded.
+type TaskArtifact struct {
+	gorm.Model
+	TaskPod            TaskPod `json:"-"`
+	TaskPodUUID        string  `json:"task_pod_uuid" gorm:"uniqueIndex:idx_task_artifacts_kind"`
+	Kind               string  `json:"kind" gorm:"uniqueIndex:idx_task_artifacts_kind"`
+	Infra3ResourceUUID string  `json:"infra3_resource_uuid" gorm:"index"`
+	Generation         string  `json:"generation"`
+	Filename           string  `json:"filename"`
+	ContentType        string  `json:"content_type"`
+	Size               uint64  `json:"size"`
+	SHA256             string  `json:"sha256"`
+	Store              string  `json:"-"`
+	StoreKey           string  `json:"-"`
+}
+
+// Cancellation records who stopped a running workflow and why
+type Cancellation struct {
+	gorm.Model
+	Infra3Resource     Infra3Resource `json:"-"`
+	Infra3ResourceUUID string         `json:"infra3_resource_uuid" gorm:"index"`
+	Generation         string         `json:"generation"`
+	CanceledBy         string         `json:"canceled_by"`
+	Reason             string         `json:"reason"`
+	TaskType           string         `json:"task_type"`
+	StoppedPods        []string       `json:"stopped_pods" gorm:"serializer:json"`
+}
+
+// DriftCheck is a single drift-detection plan. Plans without changes are denied so the apply never runs.
+type DriftCheck struct {
+	gorm.Model
+	Infra3Resource     Infra3Resource `json:"-"`
+	Infra3ResourceUUID string         `json:"infra3_resource_uuid" gorm:"index"`
+	TriggeredBy        string         `json:"triggered_by"`
+	ChangeCause        string         `json:"change_cause"`
+	Status             DriftStatus    `json:"status" gorm:"index"`
+	PlanTaskPodUUID    string         `json:"plan_task_pod_uuid"`
+	Generation         string         `json:"generation"`
+	Add                int            `json:"add"`
+	Change             int            `json:"change"`
+	Destroy            int            `json:"destroy"`
+	CompletedAt        *time.Time     `json:"completed_at"`
+	Error              string         `json:"error"`
+}
+
+type DriftStatus string
+
+const (
+	DriftPending DriftStatus = "pending"
+	NoDrift      DriftStatus = "no_drift"
+	Drifted      DriftStatus = "drift"
+	DriftError   DriftStatus = "error"
+)
+
+// Schedule reruns the workflow of a resource on a cron schedule, eg to rotate certificates. Schedules of
+// the "drift" kind start a drift check instead of a plain rerun.
+type Schedule struct {
+	gorm.Model
+	Infra3Resource     Infra3Resource `json:"-"`
+	Infra3ResourceUUID string         `json:"infra3_resource_uuid" gorm:"index"`
+	Name               string         `json:"name"`
+	Kind               string         `json:"kind"`
+	Cron               string         `json:"cron"`
+	Timezone           string         `json:"timezone"`
+	Enabled            bool           `json:"enabled"`
+	NextRunAt          *time.Time     `json:"next_run_at" gorm:"index"`
+	LastRunAt          *time.Time     `json:"last_run_at"`
+	LastFiredAt        *time.Time     `json:"last_fired_at"`
+	LastChangeCause    string         `json:"last_change_cause"`
+	LastError          string         `json:"last_error"`
+	CreatedBy          string         `json:"created_by"`
+	UpdatedBy          string         `json:"updated_by"`
+}
+
+// BulkJobFilter selects the resources of a bulk job. Namespace is a glob pattern, eg "team-*". Every
+// label must match the labels of the resource.
+type BulkJobFilter struct {
+	Cluster   string            `json:"cluster,omitempty"`
+	Namespace string            `json:"namespace,omitempty"`
+	State     string            `json:"state,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// BulkJob runs an action, eg a rerun, on every resource selected by the filter
+type BulkJob struct {
+	gorm.Model
+	Action      string        `json:"action"`
+	Filter      BulkJobFilter `json:"filter" gorm:"serializer:json"`
+	Concurrency int           `json:"concurrency"`
+	Status      string        `json:"status"`
+	Total       int           `json:"total"`
+	Succeeded   int           `json:"succeeded"`
+	Failed      int           `json:"failed"`
+	Skipped     int           `json:"skipped"`
+	CreatedBy   string        `json:"created_by"`
+	FinishedAt  *time.Time    `json:"finished_at"`
+
+	// LeaseUntil is renewed by the replica running the job. A running job whose lease passed was left
+	// behind by a replica that stopped and is resumed by another one.
+	LeaseUntil *time.Time `json:"-" gorm:"index"`
+
+	Items []BulkJobItem `json:"items,omitempty"`
+}
+
+// BulkJobItem is the result of the action of a bulk job on a single resource
+type BulkJobItem struct {
+	gorm.Model
+	BulkJobID          uint       `json:"bulk_job_id" gorm:"index"`
+	Infra3ResourceUUID string     `json:"infra3_resource_uuid"`
+	ClusterName        string     `json:"cluster_name"`
+	Namespace          string     `json:"namespace"`
+	Name               string     `json:"name"`
+	Status             string     `json:"status"`
+	Message            string     `json:"message"`
+	FinishedAt         *time.Time `json:"finished_at"`
+}
+
+// Rollback records a resource that was reverted to the spec of a previous generation. The reverted spec
+// is saved as a new generation.
+type Rollback struct {
+	gorm.Model
+	Infra3Resource     Infra3Resource `json:"-"`
+	Infra3ResourceUUID string         `json:"infra3_resource_uuid" gorm:"index"`
+	FromGeneration     string         `json:"from_generation"`
+	ToGeneration       string         `json:"to_generation"`
+	Generation         string         `json:"generation"`
+	RequestedBy        string         `json:"requested_by"`
+	Reason             string         `json:"reason"`
+	Status             RollbackStatus `json:"status"`
+	Error              string         `json:"error"`
+	CallbackStatus     string         `json:"callback_status"`
+	CallbackError      string         `json:"callback_error"`
+}
+
+type RollbackStatus string
+
+const (
+	RollbackPending RollbackStatus = "pending"
+	RolledBack      RollbackStatus = "applied"
+	RollbackError   RollbackStatus = "error"
+)
+
 type ResourceState string
 
 type RefreshToken struct {
@@ -86,9 +484,36 @@ type RefreshToken struct {
 	Infra3ResourceSpecID uint               `json:"infra3_resource_spec_id"`
 }
 
+// RedactionAudit counts the secrets masked by a redaction rule before a task log or resource spec was saved
+type RedactionAudit struct {
+	gorm.Model
+	Source             string `json:"source"`
+	Infra3ResourceUUID string `json:"infra3_resource_uuid" gorm:"index"`
+	Generation         string `json:"generation"`
+	TaskPodUUID        string `json:"task_pod_uuid"`
+	Rule               string `json:"rule"`
+	Count              int64  `json:"count"`
+}
+
+// RetentionRun records the outcome of a pruning pass over old logs, tasks and resource specs
+type RetentionRun struct {
+	gorm.Model
+	DryRun         bool       `json:"dry_run"`
+	TaskLogs       int64      `json:"task_logs"`
+	TaskPods       int64      `json:"task_pods"`
+	ResourceSpecs  int64      `json:"resource_specs"`
+	RefreshTokens  int64      `json:"refresh_tokens"`
+	Resources      int64      `json:"resources"`
+	BytesReclaimed int64      `json:"bytes_reclaimed"`
+	StartedAt      time.Time  `json:"started_at"`
+	FinishedAt     *time.Time `json:"finished_at"`
+	Error          string     `json:"error"`
+}
+
 const (
 	Untracked ResourceState = "untracked"
 	Running   ResourceState = "running"
 	Failed    ResourceState = "failed"
 	Completed ResourceState = "completed"
+	Canceled  ResourceState = "canceled"
 )
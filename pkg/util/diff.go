@@ -0,0 +1,157 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxDiffCells limits the size of the table used to find the longest common subsequence of two texts.
+// Larger texts are diffed as a removal of every changed line followed by an addition.
+const maxDiffCells = 4 << 20
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+
+	// a and b are the number of lines of each text before the op
+	a, b int
+}
+
+// diffLines returns the edit script that turns the lines of a into the lines of b
+func diffLines(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	middleA := a[prefix : len(a)-suffix]
+	middleB := b[prefix : len(b)-suffix]
+
+	ops := []diffOp{}
+	for i := 0; i < prefix; i++ {
+		ops = append(ops, diffOp{kind: ' ', line: a[i], a: i, b: i})
+	}
+
+	n, m := len(middleA), len(middleB)
+	i, j := 0, 0
+	if n*m <= maxDiffCells {
+		// lcs[i][j] is the length of the longest common subsequence of middleA[i:] and middleB[j:]
+		lcs := make([][]int32, n+1)
+		for i := range lcs {
+			lcs[i] = make([]int32, m+1)
+		}
+		for i := n - 1; i >= 0; i-- {
+			for j := m - 1; j >= 0; j-- {
+				if middleA[i] == middleB[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+		for i < n && j < m {
+			switch {
+			case middleA[i] == middleB[j]:
+				ops = append(ops, diffOp{kind: ' ', line: middleA[i], a: prefix + i, b: prefix + j})
+				i++
+				j++
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				ops = append(ops, diffOp{kind: '-', line: middleA[i], a: prefix + i, b: prefix + j})
+				i++
+			default:
+				ops = append(ops, diffOp{kind: '+', line: middleB[j], a: prefix + i, b: prefix + j})
+				j++
+			}
+		}
+	}
+	for ; i < n; i++ {
+		ops = append(ops, diffOp{kind: '-', line: middleA[i], a: prefix + i, b: prefix + j})
+	}
+	for ; j < m; j++ {
+		ops = append(ops, diffOp{kind: '+', line: middleB[j], a: prefix + n, b: prefix + j})
+	}
+
+	for k := 0; k < suffix; k++ {
+		ops = append(ops, diffOp{kind: ' ', line: a[len(a)-suffix+k], a: len(a) - suffix + k, b: len(b) - suffix + k})
+	}
+	return ops
+}
+
+func splitDiffLines(text string) []string {
+	text = strings.TrimSuffix(text, "\n")
+	if text == "" {
+		return []string{}
+	}
+	return strings.Split(text, "\n")
+}
+
+// hunkRange formats the range of a hunk header like diff does, leaving out a length of one
+func hunkRange(start, length int) string {
+	if length == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, length)
+}
+
+// UnifiedDiff returns the changes between two texts in the unified format of "diff -u" with the given
+// number of context lines. An empty string is returned when the texts are equal.
+func UnifiedDiff(fromName, toName, from, to string, context int) string {
+	ops := diffLines(splitDiffLines(from), splitDiffLines(to))
+
+	var out strings.Builder
+	for start := 0; start < len(ops); {
+		// Find the next change and extend the hunk while the gap to the following change is small enough
+		// to share context lines
+		first := start
+		for first < len(ops) && ops[first].kind == ' ' {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+		last := first
+		for next := first + 1; next < len(ops); next++ {
+			if ops[next].kind == ' ' {
+				continue
+			}
+			if next-last > 2*context {
+				break
+			}
+			last = next
+		}
+
+		hunkStart := max(first-context, start)
+		hunkEnd := min(last+context+1, len(ops))
+		aLen, bLen := 0, 0
+		for _, op := range ops[hunkStart:hunkEnd] {
+			if op.kind != '+' {
+				aLen++
+			}
+			if op.kind != '-' {
+				bLen++
+			}
+		}
+		aStart, bStart := ops[hunkStart].a, ops[hunkStart].b
+		if aLen > 0 {
+			aStart++
+		}
+		if bLen > 0 {
+			bStart++
+		}
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(aStart, aLen), hunkRange(bStart, bLen))
+		for _, op := range ops[hunkStart:hunkEnd] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.line)
+			out.WriteByte('\n')
+		}
+		start = hunkEnd
+	}
+	return out.String()
+}
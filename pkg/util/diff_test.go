@@ -0,0 +1,114 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The expected diffs were made with "diff -u --label from --label to"
+func TestUnifiedDiff(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		from, to string
+		want     string
+	}{
+		{"equal", "a\nb\n", "a\nb\n", ""},
+		{
+			"change and append",
+			"a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n",
+			"a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\n",
+			"--- from\n+++ to\n@@ -1,5 +1,5 @@\n a\n-b\n+B\n c\n d\n e\n@@ -8,3 +8,4 @@\n h\n i\n j\n+k\n",
+		},
+		{
+			"changes close enough to share context",
+			"a\nb\nc\nd\ne\nf\ng\n",
+			"a\nB\nc\nd\ne\nF\ng\n",
+			"--- from\n+++ to\n@@ -1,7 +1,7 @@\n a\n-b\n+B\n c\n d\n e\n-f\n+F\n g\n",
+		},
+		{"from empty", "", "x\n", "--- from\n+++ to\n@@ -0,0 +1 @@\n+x\n"},
+		{"to empty", "x\n", "", "--- from\n+++ to\n@@ -1 +0,0 @@\n-x\n"},
+		{"missing trailing newline is ignored", "a\nb", "a\nb\n", ""},
+	} {
+		if got := UnifiedDiff("from", "to", tc.from, tc.to, 3); got != tc.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tc.name, got, tc.want)
+		}
+	}
+}
+
+// applyUnifiedDiff applies a diff made by UnifiedDiff to from
+func applyUnifiedDiff(t *testing.T, from, diff string) string {
+	a := splitDiffLines(from)
+	lines := splitDiffLines(diff)
+	out := []string{}
+	next := 0
+	for i := 2; i < len(lines); i++ {
+		line := lines[i]
+		if strings.HasPrefix(line, "@@") {
+			var start int
+			fmt.Sscanf(strings.Fields(line)[1], "-%d", &start)
+			if strings.HasSuffix(strings.Fields(line)[1], ",0") {
+				start++
+			}
+			for ; next < start-1; next++ {
+				out = append(out, a[next])
+			}
+			continue
+		}
+		switch line[0] {
+		case ' ':
+			if a[next] != line[1:] {
+				t.Fatalf("context line %d is %q, want %q", next+1, line[1:], a[next])
+			}
+			out = append(out, a[next])
+			next++
+		case '-':
+			if a[next] != line[1:] {
+				t.Fatalf("removed line %d is %q, want %q", next+1, line[1:], a[next])
+			}
+			next++
+		case '+':
+			out = append(out, line[1:])
+		}
+	}
+	out = append(out, a[next:]...)
+	if len(out) == 0 {
+		return ""
+	}
+	return strings.Join(out, "\n") + "\n"
+}
+
+func numberedLines(n int, change func(i int) string) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		b.WriteString(change(i))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// TestUnifiedDiffApplies checks that the diff turns from into to, including texts too large for the
+// longest common subsequence table
+func TestUnifiedDiffApplies(t *testing.T) {
+	for _, n := range []int{50, 3000} {
+		from := numberedLines(n, strconv.Itoa)
+		to := numberedLines(n, func(i int) string {
+			if i%7 == 0 {
+				return "changed " + strconv.Itoa(i)
+			}
+			return strconv.Itoa(i)
+		}) + "appended\n"
+		if n*n <= maxDiffCells == (n == 3000) {
+			t.Fatalf("%d lines don't exercise the expected diff algorithm", n)
+		}
+
+		diff := UnifiedDiff("from", "to", from, to, 3)
+		if got := applyUnifiedDiff(t, from, diff); got != to {
+			t.Errorf("%d lines: applying the diff did not produce the new text", n)
+		}
+		if got := applyUnifiedDiff(t, to, UnifiedDiff("to", "from", to, from, 3)); got != from {
+			t.Errorf("%d lines: applying the reverse diff did not produce the old text", n)
+		}
+	}
+}